@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access tokens let clients skip the database on every request. They're
+// short-lived and signed: the base64 of their claims, a dot, and the base64
+// HMAC-SHA256 of that. They only carry ids. Revoked sessions are kept in the
+// revoked_sessions table for as long as their access tokens could last, and
+// every process reloads them in the background, so revoking a session stops
+// its access tokens within revokedSessionsReloadInterval. Session tokens are
+// the refresh tokens they're exchanged for at /account/token. Clients send
+// them as bearer tokens; the session token still works with Basic auth
+// everywhere.
+
+// accessTokenTTL is how long access tokens work for. Set ACCESS_TOKEN_TTL to
+// a duration such as "5m" to override it.
+var accessTokenTTL = 15 * time.Minute
+
+// How often revoked sessions are reloaded.
+const revokedSessionsReloadInterval = 10 * time.Second
+
+// accessTokenKey signs access tokens. It's derived from TOKEN_HASH_KEY, so
+// changing that signs everyone out of both.
+var accessTokenKey []byte
+
+func init() {
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Panicf("Invalid ACCESS_TOKEN_TTL %q", ttl)
+		}
+		accessTokenTTL = d
+	}
+
+	revokedSessions.until = make(map[int]time.Time)
+}
+
+// accessClaims is what an access token says about its bearer.
+type accessClaims struct {
+	AccountID int   `json:"sub"`
+	SessionID int   `json:"sid"`
+	LicenseID int   `json:"lic"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+type accessTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	TokenType   string    `json:"tokenType"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// revokedSessions are sessions revoked recently enough that access tokens
+// issued to them may not have expired yet, and until when.
+var revokedSessions struct {
+	sync.RWMutex
+	until map[int]time.Time
+}
+
+// loadRevokedSessions loads the sessions revoked recently, and reloads them in
+// the background so sessions revoked by other processes are picked up.
+func loadRevokedSessions() {
+	if err := reloadRevokedSessions(); err != nil {
+		log.Panic(err)
+	}
+
+	go func() {
+		for range time.Tick(revokedSessionsReloadInterval) {
+			// Keep the sessions already known if the database is
+			// unreachable.
+			if err := reloadRevokedSessions(); err != nil {
+				log.Printf("Failed to reload the revoked sessions: %v", err)
+			}
+		}
+	}()
+}
+
+func reloadRevokedSessions() error {
+	rows, err := dbGlobal.Query(findRevokedSessionsQuery, time.Now().Add(-accessTokenTTL))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	until := make(map[int]time.Time)
+	for rows.Next() {
+		var sessionID int
+		var revokedAt time.Time
+		if err := rows.Scan(&sessionID, &revokedAt); err != nil {
+			return err
+		}
+		until[sessionID] = revokedAt.Add(accessTokenTTL)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	revokedSessions.Lock()
+	defer revokedSessions.Unlock()
+	// Keep sessions revoked here since the query, and forget the ones
+	// whose access tokens have all expired.
+	for sessionID, u := range revokedSessions.until {
+		if _, ok := until[sessionID]; !ok && time.Now().Before(u) {
+			until[sessionID] = u
+		}
+	}
+	revokedSessions.until = until
+	return nil
+}
+
+// forgetAccessTokens makes the access tokens issued to sessions stop working
+// on this process at once. Other processes pick the sessions up from the
+// revoked_sessions table.
+func forgetAccessTokens(sessionIDs ...int) {
+	revokedSessions.Lock()
+	defer revokedSessions.Unlock()
+
+	for _, sessionID := range sessionIDs {
+		revokedSessions.until[sessionID] = time.Now().Add(accessTokenTTL)
+	}
+}
+
+func isRevoked(sessionID int) bool {
+	revokedSessions.RLock()
+	defer revokedSessions.RUnlock()
+
+	until, ok := revokedSessions.until[sessionID]
+	return ok && time.Now().Before(until)
+}
+
+func signAccessToken(claims accessClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, accessTokenKey)
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyAccessToken returns the claims of an access token, if it's signed by
+// us, unexpired and its session not revoked.
+func verifyAccessToken(token string) (accessClaims, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return accessClaims{}, false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return accessClaims{}, false
+	}
+	mac := hmac.New(sha256.New, accessTokenKey)
+	mac.Write([]byte(parts[0]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return accessClaims{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return accessClaims{}, false
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return accessClaims{}, false
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt || isRevoked(claims.SessionID) {
+		return accessClaims{}, false
+	}
+	return claims, true
+}
+
+// bearerToken returns the bearer token of a request, if it has one.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return header[7:], true
+}
+
+// issueAccessToken exchanges a session token, sent with Basic auth, for an
+// access token.
+func issueAccessToken(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	expiresAt := time.Now().Add(accessTokenTTL).Truncate(time.Second)
+	token, err := signAccessToken(accessClaims{
+		AccountID: acc.id,
+		SessionID: acc.sessionID,
+		LicenseID: acc.licenseID,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, errInternal
+	}
+
+	return accessTokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresAt: expiresAt}, nil
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"strings"
 )
 
 type account struct {
 	id        int
+	licenseID int
+	// sessionID is the session the request was authenticated with.
+	sessionID int
 	code      string
 	firstName string
 	lastName  string
@@ -19,6 +21,8 @@ type createRequest struct {
 	LicenseKey string `json:"licenseKey"`
 	FirstName  string `json:"firstName"`
 	LastName   string `json:"lastName,omitempty"`
+	// DeviceName names the account's first session.
+	DeviceName string `json:"deviceName,omitempty"`
 }
 
 type createResponse struct {
@@ -38,32 +42,58 @@ func create(acc account, w http.ResponseWriter, r *http.Request) (response, erro
 	if ok, id, err := checkLicense(req.LicenseKey); err != nil {
 		return nil, err
 	} else if ok {
-		return createAccount(id, req.FirstName, req.LastName)
+		return createAccount(id, req.FirstName, req.LastName, req.DeviceName, sessionIP(r))
 	} else {
 		return nil, errInvalidLicense
 	}
 }
 
-func createAccount(licenseID int, firstName, lastName string) (response, error) {
-	if firstName == "" || strings.Count(firstName, " ") == len(firstName) {
+func createAccount(licenseID int, firstName, lastName, deviceName, ip string) (response, error) {
+	firstName, ok := normalizeName(firstName)
+	if !ok || firstName == "" || len(deviceName) > maxDeviceNameLength {
 		return nil, errInvalidBody
 	}
-
-	code, err := randString(12)
-	if err != nil {
-		log.Println(err)
-		return nil, errInternal
+	if lastName, ok = normalizeName(lastName); !ok {
+		return nil, errInvalidBody
 	}
 
-	token, err := randString(128)
+	tx, err := dbGlobal.Begin()
 	if err != nil {
 		log.Print(err)
 		return nil, errInternal
 	}
+	defer tx.Rollback()
 
-	row := dbGlobal.QueryRow(createAccountQuery, licenseID, code, token, firstName, lastName)
+	// Codes of deleted accounts are never handed out again, so links to
+	// them don't lead to someone else.
 	var id int
-	if err := row.Scan(&id); err != nil {
+	var code string
+	for attempt := 0; ; attempt++ {
+		if attempt == maxCodeAttempts {
+			log.Printf("no free code for a new account on license %v", licenseID)
+			return nil, errInternal
+		}
+
+		if code, err = randString(12); err != nil {
+			log.Println(err)
+			return nil, errInternal
+		}
+
+		row := tx.QueryRow(createAccountQuery, licenseID, code, firstName, lastName)
+		if err := row.Scan(&id); err == nil {
+			break
+		} else if err != sql.ErrNoRows {
+			log.Print(err)
+			return nil, errInternal
+		}
+	}
+
+	_, token, err := createSession(tx, id, deviceName, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
 		log.Print(err)
 		return nil, errInternal
 	}
@@ -75,14 +105,22 @@ func createAccount(licenseID int, firstName, lastName string) (response, error)
 	}, nil
 }
 
+// createShareableLink returns the link to a code. Accounts whose primary code
+// is revoked have none.
 func createShareableLink(code string) string {
+	if code == "" {
+		return ""
+	}
 	return "https://joinairtap.com/with/" + code
 }
 
 type discoverResponse struct {
-	ID        int    `json:"accountId"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName,omitempty"`
+	ID         int         `json:"accountId"`
+	FirstName  string      `json:"firstName"`
+	LastName   string      `json:"lastName,omitempty"`
+	PublicKeys []publicKey `json:"publicKeys"`
+	// LinkID is the invite link the code was, or 0 for the primary code.
+	LinkID int `json:"linkId"`
 }
 
 func discover(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
@@ -93,20 +131,42 @@ func discover(acc account, w http.ResponseWriter, r *http.Request) (response, er
 		return nil, errInvalidCode
 	}
 
-	row := dbGlobal.QueryRow(discoverAccountQuery, code)
+	limitKeys := discoverKeys(acc, r)
+	if retryAfter, err := discoverLimits.allow(limitKeys...); err != nil {
+		setRetryAfter(w, retryAfter)
+		return nil, err
+	}
 
-	var id int
+	// Primary codes first, then invite links. A link's use is only counted
+	// the first time an account other than its owner resolves it, making
+	// them contacts, and it keeps resolving for them and the owner once used
+	// up.
+	var id, linkID int
 	var firstName, lastName string
-	if err := row.Scan(&id, &firstName, &lastName); err == sql.ErrNoRows {
+	err := dbGlobal.QueryRow(discoverAccountQuery, code).Scan(&id, &firstName, &lastName)
+	if err == sql.ErrNoRows {
+		err = dbGlobal.QueryRow(discoverInviteLinkQuery, code, acc.id).Scan(&id, &firstName, &lastName, &linkID)
+	}
+	if err == sql.ErrNoRows {
+		discoverLimits.fail(limitKeys...)
 		return nil, errInvalidCode
 	} else if err != nil {
 		log.Println(err)
 		return nil, errInternal
 	}
 
+	addContact(acc.id, id)
+
+	keys, err := findPublicKeys(id)
+	if err != nil {
+		return nil, err
+	}
+
 	return discoverResponse{
-		ID:        id,
-		FirstName: firstName,
-		LastName:  lastName,
+		ID:         id,
+		FirstName:  firstName,
+		LastName:   lastName,
+		PublicKeys: keys,
+		LinkID:     linkID,
 	}, nil
 }
@@ -6,37 +6,89 @@ import (
 	"net/http"
 	"strconv"
 	"time"
-
-	"server/lib/geobalance"
-
-	pTurn "github.com/pion/turn/v2"
 )
 
+// auth authenticates requests with either an access token or, with Basic
+// auth, a session token.
 func auth(f internalHandler) internalHandler {
+	basic := sessionAuth(f)
+	return func(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+		token, ok := bearerToken(r)
+		if !ok {
+			return basic(acc, w, r)
+		}
+
+		claims, ok := verifyAccessToken(token)
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+
+		// Names and codes change, so handlers needing them look them up.
+		return f(account{id: claims.AccountID, licenseID: claims.LicenseID, sessionID: claims.SessionID}, w, r)
+	}
+}
+
+// sessionAuth authenticates requests with a session token alone, using Basic
+// auth.
+func sessionAuth(f internalHandler) internalHandler {
 	return func(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
 		id, token, ok := r.BasicAuth()
 		if !ok {
 			return nil, errInvalidCredentials
 		}
 
-		var firstName, lastName, code string
-		row := dbGlobal.QueryRow(authenticateQuery, id, token)
-		if err := row.Scan(&firstName, &lastName, &code); err == sql.ErrNoRows {
+		i, err := strconv.Atoi(id)
+		if err != nil {
 			return nil, errInvalidCredentials
-		} else if err != nil {
+		}
+
+		var firstName, lastName, code, storedToken string
+		var licenseID, sessionID int
+		rows, err := dbGlobal.Query(authenticateQuery, i)
+		if err != nil {
 			log.Print(err)
 			return nil, errInternal
 		}
+		defer rows.Close()
 
-		i, _ := strconv.Atoi(id)
-		return f(account{id: i, firstName: firstName, lastName: lastName, code: code}, w, r)
-	}
-}
+		// Check the token against every session of the account, so how long
+		// this takes doesn't give away which one it's closest to.
+		found := false
+		for rows.Next() {
+			var rowSessionID int
+			var storedHash string
+			if err := rows.Scan(&firstName, &lastName, &code, &licenseID, &storedToken, &rowSessionID, &storedHash); err != nil {
+				log.Print(err)
+				return nil, errInternal
+			}
+			found = true
+			if checkTokenHash(token, storedHash) {
+				sessionID = rowSessionID
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+		rows.Close()
+
+		if !found {
+			return nil, errInvalidCredentials
+		} else if sessionID == 0 {
+			if !checkLegacyToken(token, storedToken) {
+				return nil, errInvalidCredentials
+			} else if sessionID, err = hashLegacyToken(i, token); err == sql.ErrNoRows {
+				return nil, errInvalidCredentials
+			} else if err != nil {
+				log.Print(err)
+				return nil, errInternal
+			}
+		}
+
+		touchSession(sessionID, r)
 
-type turnCredentials struct {
-	URL      string `json:"url"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+		return f(account{id: i, licenseID: licenseID, sessionID: sessionID, firstName: firstName, lastName: lastName, code: code}, w, r)
+	}
 }
 
 type startResponse struct {
@@ -45,42 +97,60 @@ type startResponse struct {
 	LastName        string            `json:"lastName"`
 	ShareableLink   string            `json:"shareableLink"`
 	TurnCredentials []turnCredentials `json:"turnCredentials"`
+	// IceServers are the STUN and TURN servers to use, best first.
+	// TurnCredentials has the TURN servers alone, for older clients.
+	IceServers []iceServer `json:"iceServers"`
+	// TurnExpiresAt is when the TURN credentials stop working. Clients
+	// should fetch new ones from /account/turn before then.
+	TurnExpiresAt time.Time `json:"turnExpiresAt"`
+	// ProbeTargets are for measuring round-trip times to each region, to
+	// report to /account/rtt.
+	ProbeTargets []probeTarget `json:"probeTargets"`
+}
+
+// findProfile fills in the names and code of an account authenticated with an
+// access token.
+func findProfile(acc *account) error {
+	if acc.firstName != "" {
+		return nil
+	}
+
+	if err := dbGlobal.QueryRow(findProfileQuery, acc.id).Scan(&acc.firstName, &acc.lastName, &acc.code); err == sql.ErrNoRows {
+		return errInvalidCredentials
+	} else if err != nil {
+		log.Print(err)
+		return errInternal
+	}
+	return nil
 }
 
 func start(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
-	var countryCode = r.Header.Get("CF-IPCountry")
-	if countryCode == "" {
-		countryCode = "unknown"
+	if err := findProfile(&acc); err != nil {
+		return nil, err
 	}
 
-	creds, err := turn(countryCode)
+	client, err := routeClient(acc, r)
 	if err != nil {
 		return nil, err
 	}
 
+	// Accounts over their TURN quota can still sign in, without TURN
+	// servers.
+	servers, expiresAt, err := turn(client, "")
+	if err == errTURNQuotaExceeded {
+		servers = []iceServer{}
+	} else if err != nil {
+		return nil, err
+	}
+
 	return startResponse{
 		ID:              acc.id,
 		FirstName:       acc.firstName,
 		LastName:        acc.lastName,
 		ShareableLink:   createShareableLink(acc.code),
-		TurnCredentials: creds,
+		IceServers:      servers,
+		TurnCredentials: legacyTURNCredentials(servers),
+		TurnExpiresAt:   expiresAt,
+		ProbeTargets:    probeTargets(),
 	}, nil
 }
-
-func turn(countryCode string) ([]turnCredentials, error) {
-	url, key := geobalance.Balance(countryCode)
-	// Create credentials valid for a year.
-	username, password, err := pTurn.GenerateLongTermCredentials(key, 365*24*time.Hour)
-	if err != nil {
-		log.Print(err)
-		return nil, errInternal
-	}
-
-	creds := turnCredentials{
-		URL:      url,
-		Username: username,
-		Password: password,
-	}
-
-	return []turnCredentials{creds}, nil
-}
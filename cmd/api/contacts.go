@@ -0,0 +1,27 @@
+package main
+
+import "log"
+
+// Accounts become contacts when one looks the other up by code. Only contacts
+// can ring each other's devices, invite each other over the relay, or ask for
+// TURN servers picked for the two of them.
+
+// addContact records that an account looked another up.
+func addContact(accountID, contactID int) {
+	if accountID == contactID {
+		return
+	}
+	if _, err := dbGlobal.Exec(addContactQuery, accountID, contactID); err != nil {
+		log.Print(err)
+	}
+}
+
+// areContacts reports whether either account has looked the other up.
+func areContacts(a, b int) bool {
+	var ok bool
+	if err := dbGlobal.QueryRow(areContactsQuery, a, b).Scan(&ok); err != nil {
+		log.Print(err)
+		return false
+	}
+	return ok
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"server/lib/push"
+	"server/lib/relay"
+	"server/lib/turncred"
 )
 
 func TestDB(t *testing.T) {
@@ -30,11 +38,125 @@ func TestDB(t *testing.T) {
 	startFunc := auth(start)
 	testAccountStart(t, startFunc, req, expectedFirstName, expectedLastName, id)
 
+	testTokenHashing(t, license, id, token)
+
+	testSessions(t, id, token)
+
+	testWSTicket(t, id, token)
+
+	testUpdateProfile(t, id, token, expectedFirstName, expectedLastName)
+
+	testRefreshTURN(t, id, token)
+
+	testReportRTT(t, id, token)
+
+	testPairTURN(t, license, id, token)
+
+	testTURNUsage(t, license, id, token)
+
+	testPushOffline(t, license, id, token)
+
+	publicKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	testRegisterKey(t, auth(registerKey), makeAuthenticatedRequest(id, token), "laptop", publicKey, id)
+	testLookupKeys(t, license, id, token, publicKey)
+
 	discoverFunc := auth(discover)
 	code := strings.Split(link, "/")[len(strings.Split(link, "/"))-1]
 	url, _ := url.Parse("api.airtap.dev/account/discover?code=" + code)
 	req.URL = url
 	testAccountDiscover(t, discoverFunc, req, expectedFirstName, expectedLastName, id)
+
+	testExportAccount(t, id, token, code, publicKey)
+
+	testInviteLinks(t, license, id, token, code)
+
+	testDeleteAccount(t, license, id, token)
+}
+
+func testDeleteAccount(t *testing.T, license string, id int, token string) {
+	_, licenseID, err := testLicenseCheck(t, license)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seats := func() int {
+		var n int
+		if err := dbGlobal.QueryRow(findLicenseUsers, licenseID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	before := seats()
+
+	deletedID, deletedToken, link := testCreateAccount(t, license, "Bessus", "Bactria")
+	code := link[strings.LastIndex(link, "/")+1:]
+	conn := &closeRecorder{}
+	var sessionID int
+	if err := dbGlobal.QueryRow("SELECT id FROM sessions WHERE account_id = $1;", deletedID).Scan(&sessionID); err != nil {
+		t.Fatal(err)
+	}
+	defer trackSession(sessionID, conn)()
+	polling := pollServer.Transport(deletedID)
+
+	// Its TURN usage stays with the license.
+	usage := func() (bytes int64) {
+		if err := dbGlobal.QueryRow(findTURNQuotaQuery, licenseID).Scan(new(sql.NullInt64), new(sql.NullInt64), &bytes, new(int64)); err != nil {
+			t.Fatal(err)
+		}
+		return bytes
+	}
+	username, _ := turncred.New("secretkey", turnUser(deletedID, ""), time.Now().Add(time.Hour))
+	if _, err := recordTURNUsage("", []turnUsage{{Username: username, Bytes: 700, Seconds: 10}}); err != nil {
+		t.Fatal(err)
+	}
+	usedBefore := usage()
+
+	if res, err := auth(deleteSelf)(account{}, nil, makeAuthenticatedRequest(deletedID, deletedToken)); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(deleteAccountResponse); !ok || r.ID != deletedID {
+		t.Errorf("bad delete response: %v", res)
+	}
+
+	if !conn.closed {
+		t.Error("websocket of a deleted account left open")
+	}
+	if !polling.Closed() {
+		t.Error("long-poll of a deleted account left open")
+	}
+	if usedAfter := usage(); usedAfter != usedBefore {
+		t.Errorf("license TURN usage went from %v to %v", usedBefore, usedAfter)
+	}
+	if _, err := auth(start)(account{}, nil, makeAuthenticatedRequest(deletedID, deletedToken)); err != errInvalidCredentials {
+		t.Errorf("deleted account still signs in: %v", err)
+	}
+	if after := seats(); after != before {
+		t.Errorf("license seat not freed: %v, then %v", before, after)
+	}
+
+	// Its code is never handed out again.
+	var id2 int
+	if err := dbGlobal.QueryRow(createAccountQuery, licenseID, code, "Someone", "").Scan(&id2); err == nil {
+		t.Errorf("code of a deleted account reused by %v", id2)
+	}
+
+	// Admins delete accounts with ADMIN_TOKEN.
+	adminID, _, _ := testCreateAccount(t, license, "Spitamenes", "Sogdia")
+	os.Setenv("ADMIN_TOKEN", "admintoken")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	adminDelete := func(bearer string) error {
+		req := makeBearerRequest(bearer)
+		req.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"accountId":%v}`, adminID)))
+		_, err := adminAuth(adminDeleteAccount)(account{}, nil, req)
+		return err
+	}
+	if err := adminDelete("wrongtoken"); err != errInvalidCredentials {
+		t.Errorf("admin delete with the wrong token: %v", err)
+	}
+	if err := adminDelete("admintoken"); err != nil {
+		t.Error(err)
+	}
+	if err := adminDelete("admintoken"); err != errInvalidBody {
+		t.Errorf("deleted an account twice: %v", err)
+	}
 }
 
 func testAccountDiscover(t *testing.T, f internalHandler, req *http.Request, firstName, lastName string, id int) {
@@ -46,6 +168,697 @@ func testAccountDiscover(t *testing.T, f internalHandler, req *http.Request, fir
 		if r.ID != id || r.FirstName != firstName || r.LastName != lastName {
 			t.Errorf("bad account info returned: %v %v %v", r.ID, r.FirstName, r.LastName)
 		}
+
+		if len(r.PublicKeys) != 1 {
+			t.Errorf("bad public keys returned: %v", r.PublicKeys)
+		}
+	}
+}
+
+func testReportRTT(t *testing.T, id int, token string) {
+	req := makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"network":"home","measurements":[{"region":"sfo","rttMs":10},{"region":"fra","rttMs":200}]}`)))
+	if res, err := auth(reportRTT)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(rttResponse); !ok || r.Network != "home" || len(r.Measurements) != 2 {
+		t.Errorf("bad RTT report response: %v", res)
+	}
+
+	// A German client on that network goes to San Francisco first.
+	req = makeAuthenticatedRequest(id, token)
+	req.Header.Set("CF-IPCountry", "DE")
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn?network=home")
+	if res, err := auth(refreshTURN)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(turnResponse); !ok || len(r.TurnCredentials) == 0 || !strings.Contains(r.TurnCredentials[0].URL, "sfo") {
+		t.Errorf("measured round-trip times ignored: %v", res)
+	}
+
+	req = makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"network":"home","measurements":[{"region":"sfo","rttMs":-1}]}`)))
+	if _, err := auth(reportRTT)(account{}, nil, req); err != errInvalidBody {
+		t.Errorf("negative round-trip time accepted: %v", err)
+	}
+}
+
+func testPairTURN(t *testing.T, license string, id int, token string) {
+	peerID, peerToken, _ := testCreateAccount(t, license, "Roxana", "Bactria")
+
+	req := makeAuthenticatedRequest(id, token)
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn/pair?accountId=" + strconv.Itoa(peerID))
+	if _, err := auth(pairTURN)(account{}, nil, req); err != errInvalidBody {
+		t.Errorf("pair TURN given for a stranger: %v", err)
+	}
+	addContact(peerID, id)
+
+	urls := make([]string, 2)
+	for i, side := range []struct {
+		id, peerID int
+		token      string
+		country    string
+	}{{id, peerID, token, "DE"}, {peerID, id, peerToken, "US"}} {
+		req := makeAuthenticatedRequest(side.id, side.token)
+		req.Header.Set("CF-IPCountry", side.country)
+		req.URL, _ = url.Parse("api.airtap.dev/account/turn/pair?accountId=" + strconv.Itoa(side.peerID))
+		if res, err := auth(pairTURN)(account{}, nil, req); err != nil {
+			t.Error(err)
+		} else if r, ok := res.(turnResponse); !ok || len(r.TurnCredentials) == 0 {
+			t.Errorf("bad pair TURN response: %v", res)
+		} else {
+			urls[i] = r.TurnCredentials[0].URL
+		}
+	}
+
+	if urls[0] == "" || urls[0] != urls[1] {
+		t.Errorf("peers got different relays: %v", urls)
+	}
+}
+
+func testTURNUsage(t *testing.T, license string, id int, token string) {
+	req := makeAuthenticatedRequest(id, token)
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn")
+	res, err := auth(refreshTURN)(account{}, nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := res.(turnResponse).IceServers[0].Username
+	if accountID, ok := turnUserAccount(username); !ok || accountID != id {
+		t.Errorf("username %q doesn't name the account", username)
+	}
+
+	os.Setenv("TURN_USAGE_TOKEN", "usagetoken")
+	defer os.Unsetenv("TURN_USAGE_TOKEN")
+	report := func(authorization, body string) (response, error) {
+		req := &http.Request{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(body))}
+		req.Header.Set("Authorization", authorization)
+		return turnServerAuth(reportTURNUsage)(account{}, nil, req)
+	}
+
+	body := fmt.Sprintf(`{"usage":[{"username":%q,"bytes":1000,"seconds":60},{"username":"1600000000","bytes":5,"seconds":1}]}`, username)
+	if _, err := report("Bearer wrongtoken", body); err != errInvalidCredentials {
+		t.Errorf("usage accepted with the wrong token: %v", err)
+	}
+	if res, err := report("Bearer usagetoken", body); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(turnUsageResponse); !ok || r.Recorded != 1 {
+		t.Errorf("bad usage report response: %v", res)
+	}
+
+	// A retried report is only counted once.
+	body = fmt.Sprintf(`{"reportId":"report-1","usage":[{"username":%q,"bytes":500,"seconds":30}]}`, username)
+	for i := 0; i < 2; i++ {
+		if res, err := report("Bearer usagetoken", body); err != nil {
+			t.Error(err)
+		} else if r, ok := res.(turnUsageResponse); !ok || r.Recorded != 1 {
+			t.Errorf("bad usage report response: %v", res)
+		}
+	}
+	var usedBytes int64
+	if err := dbGlobal.QueryRow("SELECT bytes FROM turn_usage WHERE account_id = $1;", id).Scan(&usedBytes); err != nil {
+		t.Error(err)
+	} else if usedBytes != 1500 {
+		t.Errorf("got %v bytes used", usedBytes)
+	}
+
+	// Once the license's quota is used up, there are no more credentials.
+	if _, err := dbGlobal.Exec("UPDATE license_keys SET turn_quota_bytes = 1500 WHERE license = $1;", license); err != nil {
+		t.Fatal(err)
+	}
+	defer dbGlobal.Exec("UPDATE license_keys SET turn_quota_bytes = NULL WHERE license = $1;", license)
+
+	req = makeAuthenticatedRequest(id, token)
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn")
+	if _, err := auth(refreshTURN)(account{}, nil, req); err != errTURNQuotaExceeded {
+		t.Errorf("credentials issued over quota: %v", err)
+	}
+
+	req = makeAuthenticatedRequest(id, token)
+	if res, err := auth(start)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(startResponse); !ok || len(r.IceServers) != 0 {
+		t.Errorf("TURN servers handed out over quota: %v", res)
+	}
+}
+
+func testRefreshTURN(t *testing.T, id int, token string) {
+	req := makeAuthenticatedRequest(id, token)
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn")
+	if res, err := auth(refreshTURN)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(turnResponse); !ok || len(r.IceServers) == 0 || len(r.TurnCredentials) == 0 || !r.ExpiresAt.After(time.Now()) {
+		t.Errorf("bad turn credentials refreshed: %v", res)
+	}
+
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn?service=turn&username=alice")
+	if res, err := auth(refreshTURN)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(turnRESTResponse); !ok || !strings.HasSuffix(r.Username, ":"+strconv.Itoa(id)+"/alice") || r.Password == "" || r.TTL <= 0 || len(r.URIs) == 0 {
+		t.Errorf("bad TURN REST API response: %v", res)
+	}
+
+	req.URL, _ = url.Parse("api.airtap.dev/account/turn?service=stun")
+	if _, err := auth(refreshTURN)(account{}, nil, req); err != errInvalidBody {
+		t.Errorf("unknown service accepted: %v", err)
+	}
+}
+
+func testPushOffline(t *testing.T, license string, id int, token string) {
+	fake := &push.Fake{}
+	notifiers[push.PlatformAPNS] = fake
+	defer delete(notifiers, push.PlatformAPNS)
+
+	req := makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"platform":"APNS","token":"device-token"}`)))
+	if res, err := auth(registerPushToken)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(pushTokenResponse); !ok || r.Platform != push.PlatformAPNS {
+		t.Errorf("bad push token registered: %v", res)
+	}
+
+	// Strangers can't ring the account, or take its device's token while it's
+	// signed in there.
+	strangerID, strangerToken, _ := testCreateAccount(t, license, "Memnon", "Rhodes")
+	req = makeAuthenticatedRequest(strangerID, strangerToken)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"platform":"APNS","token":"device-token"}`)))
+	if _, err := auth(registerPushToken)(account{}, nil, req); err != errInvalidBody {
+		t.Errorf("push token taken over: %v", err)
+	}
+	notifyOffline(strangerID, id, relay.INVITE)
+	if sent := fake.Sent(); len(sent) != 0 {
+		t.Errorf("stranger pushed: %+v", sent)
+	}
+
+	// Contacts can, once they've looked the account up.
+	callerID, _, _ := testCreateAccount(t, license, "Hephaestion", "Amyntoros")
+	addContact(callerID, id)
+	notifyOffline(callerID, id, relay.OFFER)
+	// Repeated offers don't ring again right away.
+	notifyOffline(callerID, id, relay.OFFER)
+
+	if sent := fake.Sent(); len(sent) != 1 {
+		t.Errorf("got %v pushes, expected 1", len(sent))
+	} else if sent[0].Token != "device-token" || sent[0].Message.FromID != callerID || sent[0].Message.FromName != "Hephaestion Amyntoros" {
+		t.Errorf("bad push sent: %+v", sent[0])
+	}
+
+	// Either side looking the other up is enough.
+	if !areContacts(id, callerID) || areContacts(id, strangerID) {
+		t.Error("wrong contacts")
+	}
+}
+
+func testRegisterKey(t *testing.T, f internalHandler, req *http.Request, deviceID, publicKey string, id int) {
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf(`{"deviceId":"%v","publicKey":"%v"}`, deviceID, publicKey))))
+	if res, err := f(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(keysResponse); !ok {
+		t.Errorf("got unexpected register key return type: %v", r)
+	} else if r.ID != id || len(r.PublicKeys) != 1 || r.PublicKeys[0].DeviceID != deviceID || r.PublicKeys[0].PublicKey != publicKey {
+		t.Errorf("bad public keys returned: %v %v", r.ID, r.PublicKeys)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf(`{"deviceId":"%v","publicKey":"c2hvcnQ="}`, deviceID))))
+	if _, err := f(account{}, nil, req); err != errInvalidPublicKey {
+		t.Errorf("short public key accepted: %v", err)
+	}
+}
+
+func testLookupKeys(t *testing.T, license string, id int, token, publicKey string) {
+	lookup := func(accountID int) (response, error) {
+		req := makeAuthenticatedRequest(id, token)
+		req.URL, _ = url.Parse(fmt.Sprintf("api.airtap.dev/account/keys?accountId=%v", accountID))
+		return auth(lookupKeys)(account{}, nil, req)
+	}
+
+	if res, err := lookup(id); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(keysResponse); !ok || r.ID != id || len(r.PublicKeys) != 1 || r.PublicKeys[0].PublicKey != publicKey {
+		t.Errorf("bad own public keys: %v", res)
+	}
+
+	// Only contacts' keys can be looked up.
+	strangerID, _, _ := testCreateAccount(t, license, "Porus", "Paurava")
+	if _, err := lookup(strangerID); err != errInvalidBody {
+		t.Errorf("keys of a stranger looked up: %v", err)
+	}
+}
+
+func testTokenHashing(t *testing.T, license string, id int, token string) {
+	var storedHash string
+	if err := dbGlobal.QueryRow("SELECT token_hash FROM sessions WHERE account_id = $1;", id).Scan(&storedHash); err != nil {
+		t.Fatal(err)
+	} else if storedHash != hashToken(token) {
+		t.Errorf("token stored as %q", storedHash)
+	}
+
+	if _, err := auth(start)(account{}, nil, makeAuthenticatedRequest(id, token[:127]+"x")); err != errInvalidCredentials {
+		t.Errorf("wrong token accepted: %v", err)
+	}
+
+	// Tokens from before hashing still work, and become sessions.
+	legacyID, legacyToken, _ := testCreateAccount(t, license, "Darius", "Persia")
+	if _, err := dbGlobal.Exec("DELETE FROM sessions WHERE account_id = $1;", legacyID); err != nil {
+		t.Fatal(err)
+	} else if _, err := dbGlobal.Exec("UPDATE accounts SET token = $2 WHERE id = $1;", legacyID, legacyToken); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth(start)(account{}, nil, makeAuthenticatedRequest(legacyID, legacyToken)); err != nil {
+		t.Errorf("legacy token rejected: %v", err)
+	}
+	var storedToken string
+	if err := dbGlobal.QueryRow("SELECT COALESCE(token, '') FROM accounts WHERE id = $1;", legacyID).Scan(&storedToken); err != nil {
+		t.Fatal(err)
+	} else if storedToken != "" {
+		t.Errorf("legacy token still stored: %q", storedToken)
+	}
+	if err := dbGlobal.QueryRow("SELECT token_hash FROM sessions WHERE account_id = $1;", legacyID).Scan(&storedHash); err != nil {
+		t.Fatal(err)
+	} else if storedHash != hashToken(legacyToken) {
+		t.Errorf("legacy token hashed as %q", storedHash)
+	}
+
+	// Tokens hashed in the background still work, even if the request read
+	// them before they were hashed.
+	legacyID, legacyToken, _ = testCreateAccount(t, license, "Xerxes", "Persia")
+	if _, err := dbGlobal.Exec("DELETE FROM sessions WHERE account_id = $1;", legacyID); err != nil {
+		t.Fatal(err)
+	} else if _, err := dbGlobal.Exec("UPDATE accounts SET token = $2 WHERE id = $1;", legacyID, legacyToken); err != nil {
+		t.Fatal(err)
+	}
+	hashedID, err := hashStoredToken(legacyID, legacyToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionID, err := hashLegacyToken(legacyID, legacyToken); err != nil || sessionID != hashedID {
+		t.Errorf("token hashed in the background: got session %v, %v, expected %v", sessionID, err, hashedID)
+	}
+	if _, err := auth(start)(account{}, nil, makeAuthenticatedRequest(legacyID, legacyToken)); err != nil {
+		t.Errorf("token hashed in the background rejected: %v", err)
+	}
+}
+
+func testWSTicket(t *testing.T, id int, token string) {
+	mint := func(body string) string {
+		req := makeAuthenticatedRequest(id, token)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		res, err := auth(issueWSTicket)(account{}, nil, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, ok := res.(wsTicketResponse)
+		if !ok || r.Ticket == "" || !r.ExpiresAt.After(time.Now()) {
+			t.Fatalf("bad ticket response: %v", res)
+		}
+		return r.Ticket
+	}
+
+	var got account
+	f := wsAuth(func(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+		got = acc
+		return nil, nil
+	})
+	upgrade := func(query, protocol, origin string) error {
+		got = account{}
+		req := &http.Request{Header: http.Header{}}
+		req.URL, _ = url.Parse("api.airtap.dev/ws" + query)
+		if protocol != "" {
+			req.Header.Set("Sec-WebSocket-Protocol", protocol)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		_, err := f(account{}, nil, req)
+		return err
+	}
+
+	ticket := mint("")
+	if err := upgrade("?ticket="+ticket, "", ""); err != nil || got.id != id {
+		t.Errorf("ticket in the query rejected: %v", err)
+	}
+	if err := upgrade("?ticket="+ticket, "", ""); err != errInvalidCredentials {
+		t.Errorf("ticket used twice: %v", err)
+	}
+
+	ticket = mint("")
+	if err := upgrade("", "airtap, ticket."+ticket, ""); err != nil || got.id != id {
+		t.Errorf("ticket in a subprotocol rejected: %v", err)
+	}
+
+	ticket = mint(`{"origin":"https://web.airtap.dev"}`)
+	if err := upgrade("?ticket="+ticket, "", "https://evil.example"); err != errInvalidCredentials {
+		t.Errorf("ticket used from another origin: %v", err)
+	}
+	ticket = mint(`{"origin":"https://web.airtap.dev"}`)
+	if err := upgrade("?ticket="+ticket, "", "https://web.airtap.dev"); err != nil || got.id != id {
+		t.Errorf("ticket rejected from its origin: %v", err)
+	}
+
+	// Revoking a session forgets its tickets.
+	req := makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"deviceName":"Browser"}`))
+	res, err := auth(login)(account{}, nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := res.(loginResponse)
+	req = makeAuthenticatedRequest(id, browser.Token)
+	req.Body = ioutil.NopCloser(strings.NewReader(""))
+	res, err = auth(issueWSTicket)(account{}, nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket = res.(wsTicketResponse).Ticket
+	req = makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"sessionId":%v}`, browser.SessionID)))
+	if _, err := auth(revokeSession)(account{}, nil, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := upgrade("?ticket="+ticket, "", ""); err != errInvalidCredentials {
+		t.Errorf("ticket of a revoked session used: %v", err)
+	}
+}
+
+func testUpdateProfile(t *testing.T, id int, token, firstName, lastName string) {
+	patch := func(body string) (response, error) {
+		req := makeAuthenticatedRequest(id, token)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		return auth(updateProfile)(account{}, nil, req)
+	}
+
+	// Only the names sent change, trimmed.
+	if res, err := patch(`{"lastName":" \u200bthe Great\u00a0"}`); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(profileResponse); !ok || r.ID != id || r.FirstName != firstName || r.LastName != "the Great" {
+		t.Errorf("bad profile: %v", res)
+	}
+
+	// The limit is in characters, not bytes.
+	if res, err := patch(fmt.Sprintf(`{"firstName":%q}`, strings.Repeat("é", 30))); err != nil {
+		t.Error(err)
+	} else if r, ok := res.(profileResponse); !ok || r.FirstName != strings.Repeat("é", 30) {
+		t.Errorf("bad profile: %v", res)
+	}
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"firstName":%q}`, strings.Repeat("a", 31)),
+		`{"firstName":"  "}`,
+		`{"lastName":"tab\there"}`,
+	} {
+		if _, err := patch(body); err != errInvalidBody {
+			t.Errorf("%v accepted: %v", body, err)
+		}
+	}
+
+	if _, err := patch(fmt.Sprintf(`{"firstName":%q,"lastName":%q}`, firstName, lastName)); err != nil {
+		t.Error(err)
+	}
+}
+
+func testExportAccount(t *testing.T, id int, token, code, publicKey string) {
+	res, err := auth(exportAccount)(account{}, nil, makeAuthenticatedRequest(id, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := res.(exportResponse)
+	if !ok {
+		t.Fatalf("bad export: %v", res)
+	}
+
+	if r.Account.ID != id || r.Account.Code != code || r.Account.CreatedAt.IsZero() || r.License.ID == 0 {
+		t.Errorf("bad account: %+v, license: %+v", r.Account, r.License)
+	}
+	if len(r.Sessions) == 0 || len(r.PublicKeys) == 0 || r.PublicKeys[0].PublicKey != publicKey || len(r.RTTMeasurements) == 0 || len(r.TURNUsage) == 0 {
+		t.Errorf("missing records: %+v", r.Export)
+	}
+
+	// Nothing in it signs anyone in.
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), token) || strings.Contains(string(b), hashToken(token)) {
+		t.Error("export has the account's token")
+	}
+	for _, s := range r.Sessions {
+		if s.TokenHash != "[redacted]" {
+			t.Errorf("session token hash not redacted: %+v", s)
+		}
+	}
+}
+
+func testInviteLinks(t *testing.T, license string, id int, token, code string) {
+	call := func(f internalHandler, body string) (response, error) {
+		req := makeAuthenticatedRequest(id, token)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		return auth(f)(account{}, nil, req)
+	}
+	discoverCodeAs := func(id int, token, code string) (response, error) {
+		req := makeAuthenticatedRequest(id, token)
+		req.URL, _ = url.Parse("api.airtap.dev/account/discover?code=" + code)
+		return auth(discover)(account{}, nil, req)
+	}
+	discoverCode := func(code string) (response, error) {
+		return discoverCodeAs(id, token, code)
+	}
+
+	for _, body := range []string{
+		`{"maxUses":0}`,
+		`{"expiresAt":"2020-01-01T00:00:00Z"}`,
+		fmt.Sprintf(`{"label":%q}`, strings.Repeat("a", 65)),
+	} {
+		if _, err := call(createInviteLink, body); err != errInvalidBody {
+			t.Errorf("%v accepted: %v", body, err)
+		}
+	}
+
+	// A link good for one use resolves once, and says it was the one used.
+	res, err := call(createInviteLink, `{"label":"forum","maxUses":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := res.(inviteLinkResponse)
+	if !link.Active || link.Code == code || link.ShareableLink == "" {
+		t.Errorf("bad link: %+v", link)
+	}
+	// The owner looking it up doesn't use it.
+	if _, err := discoverCode(link.Code); err != nil {
+		t.Errorf("owner's lookup of their link: %v", err)
+	}
+	inviteeID, inviteeToken, _ := testCreateAccount(t, license, "Olympias", "Epirus")
+	if res, err := discoverCodeAs(inviteeID, inviteeToken, link.Code); err != nil {
+		t.Error(err)
+	} else if r := res.(discoverResponse); r.ID != id || r.LinkID != link.ID {
+		t.Errorf("bad discover response: %+v", r)
+	}
+	// Retries by the invitee don't use it again, and keep working.
+	if _, err := discoverCodeAs(inviteeID, inviteeToken, link.Code); err != nil {
+		t.Errorf("invitee's retry rejected: %v", err)
+	}
+	var uses int
+	if err := dbGlobal.QueryRow("SELECT uses FROM invite_links WHERE id = $1;", link.ID).Scan(&uses); err != nil {
+		t.Fatal(err)
+	} else if uses != 1 {
+		t.Errorf("link used %v times", uses)
+	}
+	otherID, otherToken, _ := testCreateAccount(t, license, "Cleopatra", "Macedon")
+	if _, err := discoverCodeAs(otherID, otherToken, link.Code); err != errInvalidCode {
+		t.Errorf("used up link resolved: %v", err)
+	}
+
+	// Revoked links stop resolving, and the others keep working.
+	res, err = call(createInviteLink, fmt.Sprintf(`{"expiresAt":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring := res.(inviteLinkResponse)
+	res, err = call(createInviteLink, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := res.(inviteLinkResponse)
+	if _, err := call(revokeInviteLink, fmt.Sprintf(`{"linkId":%v}`, revoked.ID)); err != nil {
+		t.Error(err)
+	}
+	if _, err := discoverCode(revoked.Code); err != errInvalidCode {
+		t.Errorf("revoked link resolved: %v", err)
+	}
+	if res, err := discoverCode(expiring.Code); err != nil || res.(discoverResponse).LinkID != expiring.ID {
+		t.Errorf("got %v, %v", res, err)
+	}
+	if _, err := call(revokeInviteLink, `{"linkId":1,"primary":true}`); err != errInvalidBody {
+		t.Errorf("revoked both a link and the primary code: %v", err)
+	}
+
+	// So does the primary code, until it's rotated.
+	res, err = call(revokeInviteLink, `{"primary":true}`)
+	if err != nil {
+		t.Fatal(err)
+	} else if r := res.(inviteLinksResponse); r.ShareableLink != "" || len(r.Links) != 3 || r.Links[0].Active || r.Links[2].Active || !r.Links[1].Active {
+		t.Errorf("bad links: %+v", r)
+	}
+	if _, err := discoverCode(code); err != errInvalidCode {
+		t.Errorf("revoked code resolved: %v", err)
+	}
+
+	res, err = call(rotatePrimaryCode, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shareableLink := res.(inviteLinksResponse).ShareableLink
+	newCode := strings.TrimPrefix(shareableLink, "https://joinairtap.com/with/")
+	if newCode == "" || newCode == shareableLink || newCode == code {
+		t.Errorf("bad rotated link: %v", shareableLink)
+	}
+	if res, err := discoverCode(newCode); err != nil || res.(discoverResponse).LinkID != 0 {
+		t.Errorf("got %v, %v", res, err)
+	}
+	if _, err := discoverCode(code); err != errInvalidCode {
+		t.Errorf("rotated code resolved: %v", err)
+	}
+}
+
+type closeRecorder struct{ closed bool }
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func testSessions(t *testing.T, id int, token string) {
+	defer func(trusted bool) { trustProxy = trusted }(trustProxy)
+	trustProxy = true
+
+	req := makeAuthenticatedRequest(id, token)
+	req.Header.Set("X-Forwarded-For", "198.51.100.4")
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"deviceName":"New laptop"}`))
+	res, err := auth(login)(account{}, nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := res.(loginResponse)
+	if !ok || r.ID != id || r.SessionID == 0 || len(r.Token) != 128 {
+		t.Fatalf("bad login response: %v", res)
+	}
+
+	if res, err := auth(listSessions)(account{}, nil, makeAuthenticatedRequest(id, r.Token)); err != nil {
+		t.Error(err)
+	} else if sessions, ok := res.(sessionsResponse); !ok || len(sessions.Sessions) != 2 || sessions.Sessions[1].DeviceName != "New laptop" || sessions.Sessions[1].IP != "198.51.100.4" || !sessions.Sessions[1].Current || sessions.Sessions[0].Current {
+		t.Errorf("bad sessions: %v", res)
+	}
+
+	accessToken := testAccessToken(t, id, r.Token)
+
+	// Revoking the session closes its websockets and long-polls and signs it
+	// out.
+	conn := &closeRecorder{}
+	defer trackSession(r.SessionID, conn)()
+	polling := pollServer.Transport(id)
+	trackPollTransport(r.SessionID, polling)
+
+	req = makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"sessionId":%v}`, r.SessionID)))
+	if res, err := auth(revokeSession)(account{}, nil, req); err != nil {
+		t.Error(err)
+	} else if sessions, ok := res.(sessionsResponse); !ok || len(sessions.Sessions) != 1 {
+		t.Errorf("bad sessions after revoking: %v", res)
+	}
+	if !conn.closed {
+		t.Error("websocket of a revoked session left open")
+	}
+	if !polling.Closed() {
+		t.Error("long-poll of a revoked session left open")
+	}
+
+	// Revoking a session leaves the account's long-poll open if another
+	// session opened it.
+	var firstSessionID int
+	if err := dbGlobal.QueryRow("SELECT id FROM sessions WHERE account_id = $1 ORDER BY id LIMIT 1;", id).Scan(&firstSessionID); err != nil {
+		t.Fatal(err)
+	}
+	shared := pollServer.Transport(id)
+	trackPollTransport(firstSessionID, shared)
+	req = makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"deviceName":"Phone"}`))
+	res, err = auth(login)(account{}, nil, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := res.(loginResponse)
+	trackPollTransport(phone.SessionID, shared)
+	req = makeAuthenticatedRequest(id, token)
+	req.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"sessionId":%v}`, phone.SessionID)))
+	if _, err := auth(revokeSession)(account{}, nil, req); err != nil {
+		t.Error(err)
+	}
+	if shared.Closed() {
+		t.Error("long-poll of another session closed")
+	}
+	pollServer.Disconnect(id)
+	if _, err := auth(start)(account{}, nil, makeAuthenticatedRequest(id, r.Token)); err != errInvalidCredentials {
+		t.Errorf("revoked session still works: %v", err)
+	}
+	if _, err := auth(start)(account{}, nil, makeBearerRequest(accessToken)); err != errInvalidCredentials {
+		t.Errorf("access token of a revoked session still works: %v", err)
+	}
+
+	// Other processes find out from the database.
+	revokedSessions.Lock()
+	delete(revokedSessions.until, r.SessionID)
+	revokedSessions.Unlock()
+	if err := reloadRevokedSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth(start)(account{}, nil, makeBearerRequest(accessToken)); err != errInvalidCredentials {
+		t.Errorf("access token of a session revoked elsewhere still works: %v", err)
+	}
+}
+
+func testAccessToken(t *testing.T, id int, token string) string {
+	res, err := sessionAuth(issueAccessToken)(account{}, nil, makeAuthenticatedRequest(id, token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := res.(accessTokenResponse)
+	if !ok || r.AccessToken == "" || r.TokenType != "Bearer" || !r.ExpiresAt.After(time.Now()) {
+		t.Fatalf("bad access token response: %v", res)
+	}
+
+	if res, err := auth(start)(account{}, nil, makeBearerRequest(r.AccessToken)); err != nil {
+		t.Error(err)
+	} else if s, ok := res.(startResponse); !ok || s.ID != id || s.FirstName == "" {
+		t.Errorf("bad start response with an access token: %v", res)
+	}
+
+	if _, err := auth(start)(account{}, nil, makeBearerRequest(r.AccessToken+"x")); err != errInvalidCredentials {
+		t.Errorf("tampered access token accepted: %v", err)
+	}
+
+	// Access tokens only carry ids.
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.SplitN(r.AccessToken, ".", 2)[0])
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil || len(claims) != 4 || claims["fn"] != nil || claims["code"] != nil {
+		t.Errorf("access token claims more than ids: %s", payload)
+	}
+
+	// Access tokens can't be exchanged for more access tokens.
+	if _, err := sessionAuth(issueAccessToken)(account{}, nil, makeBearerRequest(r.AccessToken)); err != errInvalidCredentials {
+		t.Errorf("access token refreshed itself: %v", err)
+	}
+
+	expired, _ := signAccessToken(accessClaims{AccountID: id, ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	if _, err := auth(start)(account{}, nil, makeBearerRequest(expired)); err != errInvalidCredentials {
+		t.Errorf("expired access token accepted: %v", err)
+	}
+
+	return r.AccessToken
+}
+
+func makeBearerRequest(accessToken string) *http.Request {
+	return &http.Request{
+		URL: &url.URL{},
+		Header: map[string][]string{
+			"Authorization": {"Bearer " + accessToken},
+		},
 	}
 }
 
@@ -53,6 +866,7 @@ func makeAuthenticatedRequest(id int, token string) *http.Request {
 	header := "BASIC " + base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(id)+":"+token))
 
 	return &http.Request{
+		URL: &url.URL{},
 		Header: map[string][]string{
 			"Authorization": {header},
 		},
@@ -74,6 +888,18 @@ func testAccountStart(t *testing.T, f internalHandler, req *http.Request, firstN
 		} else if r.TurnCredentials[0].URL == "" || r.TurnCredentials[0].Username == "" || r.TurnCredentials[0].Password == "" {
 			t.Errorf("bad turn credentials returned: %v %v %v", r.TurnCredentials[0].URL, r.TurnCredentials[0].Username, r.TurnCredentials[0].Password)
 		}
+
+		if len(r.IceServers) < 2 || len(r.IceServers[0].URLs) == 0 || r.IceServers[0].Credential == "" {
+			t.Errorf("bad ICE servers returned: %v", r.IceServers)
+		}
+
+		if len(r.ProbeTargets) == 0 || r.ProbeTargets[0].URL == "" {
+			t.Errorf("bad probe targets returned: %v", r.ProbeTargets)
+		}
+
+		if !r.TurnExpiresAt.After(time.Now()) || r.TurnExpiresAt.After(time.Now().Add(turnCredentialTTL)) {
+			t.Errorf("bad turn credentials expiry returned: %v", r.TurnExpiresAt)
+		}
 	}
 }
 
@@ -100,7 +926,7 @@ func testLicenseCheck(t *testing.T, license string) (bool, int, error) {
 }
 
 func testLicenseCreationQuery(t *testing.T) string {
-	row := dbGlobal.QueryRow(issueQuery, 10)
+	row := dbGlobal.QueryRow(issueQuery, 20)
 
 	var (
 		license        string
@@ -112,7 +938,7 @@ func testLicenseCreationQuery(t *testing.T) string {
 		t.Error(err)
 	}
 
-	if license == "" || maxActivations != 10 || revoked {
+	if license == "" || maxActivations != 20 || revoked {
 		t.Errorf("wrong license created: %v %v %v", license, maxActivations, revoked)
 	}
 
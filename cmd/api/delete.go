@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Deleting an account deletes everything about it but its TURN usage, which
+// is kept for its license without the account, frees its seat on its license,
+// signs out and disconnects its devices, and keeps its code so it's never
+// handed out again.
+
+type deleteAccountRequest struct {
+	AccountID int `json:"accountId"`
+}
+
+type deleteAccountResponse struct {
+	ID int `json:"accountId"`
+}
+
+// adminAuth lets through requests carrying the ADMIN_TOKEN as a bearer token.
+// Without one set, nothing gets through.
+func adminAuth(f internalHandler) internalHandler {
+	return func(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+		expected := os.Getenv("ADMIN_TOKEN")
+		token, _ := bearerToken(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			return nil, errInvalidCredentials
+		}
+
+		return f(acc, w, r)
+	}
+}
+
+// deleteAccount deletes an account. deletedBy says who asked, "self" or
+// "admin".
+func deleteAccount(id int, deletedBy string) error {
+	tx, err := dbGlobal.Begin()
+	if err != nil {
+		log.Print(err)
+		return errInternal
+	}
+	defer tx.Rollback()
+
+	// Its sessions' access tokens stop working on every process.
+	rows, err := tx.Query(revokeAccountSessionsQuery, id)
+	if err != nil {
+		log.Print(err)
+		return errInternal
+	}
+	var sessionIDs []int
+	for rows.Next() {
+		var sessionID int
+		if err := rows.Scan(&sessionID); err != nil {
+			rows.Close()
+			log.Print(err)
+			return errInternal
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return errInternal
+	}
+
+	// Its TURN usage stays with its license, so deleting accounts doesn't
+	// reset the license's monthly quota.
+	if _, err := tx.Exec(keepTURNUsageQuery, id); err != nil {
+		log.Print(err)
+		return errInternal
+	}
+
+	// Everything else about the account goes with it, by ON DELETE CASCADE.
+	var deletedID int
+	if err := tx.QueryRow(deleteAccountQuery, id, deletedBy).Scan(&deletedID); err == sql.ErrNoRows {
+		return errInvalidBody
+	} else if err != nil {
+		log.Print(err)
+		return errInternal
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return errInternal
+	}
+
+	forgetWSTickets(id)
+	forgetAccessTokens(sessionIDs...)
+	for _, sessionID := range sessionIDs {
+		closeSession(sessionID)
+	}
+	pollServer.Disconnect(id)
+
+	return nil
+}
+
+// deleteSelf deletes the account making the request.
+func deleteSelf(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	if err := deleteAccount(acc.id, "self"); err != nil {
+		return nil, err
+	}
+
+	return deleteAccountResponse{ID: acc.id}, nil
+}
+
+// adminDeleteAccount deletes the account in the request.
+func adminDeleteAccount(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req deleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AccountID <= 0 {
+		return nil, errInvalidBody
+	}
+
+	if err := deleteAccount(req.AccountID, "admin"); err != nil {
+		return nil, err
+	}
+
+	return deleteAccountResponse{ID: req.AccountID}, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Codes are all it takes to find out who an account is, so /account/discover
+// is rate limited per account and per address to keep it from being used to
+// scrape names. Lookups of codes that don't resolve slow a client down, and
+// clients that keep making them are banned for a while, longer each time.
+// Lookups that come too soon are turned away with a Retry-After. Limits are
+// kept in memory, so each process has its own.
+
+const (
+	discoverWindow = 10 * time.Minute
+	// Lookups allowed in a window. Addresses get more, as many accounts can
+	// share one behind NAT.
+	maxAccountDiscovers = 30
+	maxIPDiscovers      = 100
+	// After discoverFailuresBeforeDelay failed lookups in a window, a client
+	// has to wait a second before its next lookup, doubling with each further
+	// failure up to maxDiscoverDelay.
+	discoverFailuresBeforeDelay = 5
+	maxDiscoverDelay            = 8 * time.Second
+	// discoverFailuresBeforeBan failed lookups in a window get a client banned
+	// for discoverBan, doubling with every ban in discoverStrikeTTL up to
+	// maxDiscoverBan.
+	discoverFailuresBeforeBan = 20
+	discoverBan               = 15 * time.Minute
+	maxDiscoverBan            = 24 * time.Hour
+	discoverStrikeTTL         = 24 * time.Hour
+	// How often clients with nothing left to remember are forgotten.
+	discoverPruneInterval = time.Minute
+)
+
+// discoverKey is who is looking codes up: an account, or an address.
+type discoverKey struct {
+	kind string
+	id   string
+}
+
+type discoverClient struct {
+	windowStart time.Time
+	lookups     int
+	failures    int
+	bannedUntil time.Time
+	// notBefore is when a slowed down client may look up again.
+	notBefore time.Time
+	// strikes is how many times the client was banned, until
+	// discoverStrikeTTL after the last time.
+	strikes int
+	lastBan time.Time
+}
+
+type discoverLimiter struct {
+	mutex   sync.Mutex
+	clients map[discoverKey]*discoverClient
+	now     func() time.Time
+	// lastPrune is when clients were last pruned.
+	lastPrune time.Time
+}
+
+type discoverClientReport struct {
+	Kind        string     `json:"kind"`
+	ID          string     `json:"id"`
+	Lookups     int        `json:"lookups"`
+	Failures    int        `json:"failures"`
+	Strikes     int        `json:"strikes"`
+	BannedUntil *time.Time `json:"bannedUntil"`
+}
+
+type discoverReportResponse struct {
+	// Lookups and Failures add up every account's current window.
+	Lookups  int `json:"lookups"`
+	Failures int `json:"failures"`
+	// Clients are the accounts and addresses with abnormal volume: banned,
+	// slowed down, or past half their limit.
+	Clients []discoverClientReport `json:"clients"`
+}
+
+var discoverLimits = newDiscoverLimiter(time.Now)
+
+func newDiscoverLimiter(now func() time.Time) *discoverLimiter {
+	return &discoverLimiter{clients: make(map[discoverKey]*discoverClient), now: now}
+}
+
+func discoverKeys(acc account, r *http.Request) []discoverKey {
+	keys := []discoverKey{{kind: "account", id: strconv.Itoa(acc.id)}}
+	if ip := sessionIP(r); ip != "" {
+		keys = append(keys, discoverKey{kind: "ip", id: ip})
+	}
+	return keys
+}
+
+func maxDiscovers(key discoverKey) int {
+	if key.kind == "ip" {
+		return maxIPDiscovers
+	}
+	return maxAccountDiscovers
+}
+
+// client returns what's known about a key, starting a new window if the last
+// one is over.
+func (l *discoverLimiter) client(key discoverKey, now time.Time) *discoverClient {
+	c, ok := l.clients[key]
+	if !ok {
+		c = &discoverClient{windowStart: now}
+		l.clients[key] = c
+	}
+	if now.Sub(c.windowStart) >= discoverWindow {
+		c.windowStart, c.lookups, c.failures = now, 0, 0
+	}
+	if c.strikes > 0 && now.Sub(c.lastBan) >= discoverStrikeTTL {
+		c.strikes = 0
+	}
+	return c
+}
+
+// allow counts a lookup by every key, unless one of them is banned, out of
+// lookups or slowed down. Then it returns errTooManyDiscovers, with how long
+// until the lookup would be allowed.
+func (l *discoverLimiter) allow(keys ...discoverKey) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastPrune) >= discoverPruneInterval {
+		l.prune(now)
+	}
+
+	var retryAfter time.Duration
+	clients := make([]*discoverClient, len(keys))
+	for i, key := range keys {
+		clients[i] = l.client(key, now)
+		if wait := clients[i].wait(key, now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, errTooManyDiscovers
+	}
+
+	for _, c := range clients {
+		c.lookups++
+	}
+	return 0, nil
+}
+
+// wait returns how long until a client may look up again.
+func (c *discoverClient) wait(key discoverKey, now time.Time) time.Duration {
+	switch {
+	case now.Before(c.bannedUntil):
+		return c.bannedUntil.Sub(now)
+	case c.lookups >= maxDiscovers(key):
+		return c.windowStart.Add(discoverWindow).Sub(now)
+	case now.Before(c.notBefore):
+		return c.notBefore.Sub(now)
+	}
+	return 0
+}
+
+// fail records a lookup of a code that didn't resolve, slowing down or
+// banning keys that have made too many.
+func (l *discoverLimiter) fail(keys ...discoverKey) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	for _, key := range keys {
+		c := l.client(key, now)
+		if c.failures++; c.failures < discoverFailuresBeforeBan {
+			c.notBefore = now.Add(c.delay())
+			continue
+		}
+
+		ban := maxDiscoverBan
+		if c.strikes < 16 && discoverBan<<uint(c.strikes) < maxDiscoverBan {
+			ban = discoverBan << uint(c.strikes)
+		}
+		c.bannedUntil, c.lastBan, c.notBefore = now.Add(ban), now, time.Time{}
+		c.strikes++
+		c.windowStart, c.lookups, c.failures = now, 0, 0
+		log.Printf("banned %v %v from discovering accounts for %v, strike %v", key.kind, key.id, ban, c.strikes)
+	}
+}
+
+func (c *discoverClient) delay() time.Duration {
+	if c.failures < discoverFailuresBeforeDelay {
+		return 0
+	}
+	if n := c.failures - discoverFailuresBeforeDelay; n < 16 && time.Second<<uint(n) < maxDiscoverDelay {
+		return time.Second << uint(n)
+	}
+	return maxDiscoverDelay
+}
+
+// prune forgets clients with nothing left to remember, so the map doesn't
+// grow. It walks every client, so lookups only do it once a
+// discoverPruneInterval.
+func (l *discoverLimiter) prune(now time.Time) {
+	l.lastPrune = now
+	for key, c := range l.clients {
+		if now.Sub(c.windowStart) >= discoverWindow && !now.Before(c.bannedUntil) && (c.strikes == 0 || now.Sub(c.lastBan) >= discoverStrikeTTL) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// report adds up lookups and lists the clients worth a look.
+func (l *discoverLimiter) report() discoverReportResponse {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	res := discoverReportResponse{Clients: []discoverClientReport{}}
+	for key, c := range l.clients {
+		lookups, failures := c.lookups, c.failures
+		if now.Sub(c.windowStart) >= discoverWindow {
+			lookups, failures = 0, 0
+		}
+		if key.kind == "account" {
+			res.Lookups += lookups
+			res.Failures += failures
+		}
+
+		banned := now.Before(c.bannedUntil)
+		if !banned && failures < discoverFailuresBeforeDelay && lookups*2 < maxDiscovers(key) {
+			continue
+		}
+
+		report := discoverClientReport{Kind: key.kind, ID: key.id, Lookups: lookups, Failures: failures, Strikes: c.strikes}
+		if banned {
+			bannedUntil := c.bannedUntil
+			report.BannedUntil = &bannedUntil
+		}
+		res.Clients = append(res.Clients, report)
+	}
+
+	sort.Slice(res.Clients, func(i, j int) bool {
+		a, b := res.Clients[i], res.Clients[j]
+		if (a.BannedUntil != nil) != (b.BannedUntil != nil) {
+			return a.BannedUntil != nil
+		} else if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		} else if a.Lookups != b.Lookups {
+			return a.Lookups > b.Lookups
+		}
+		return a.Kind+a.ID < b.Kind+b.ID
+	})
+
+	return res
+}
+
+// setRetryAfter tells a client how long to wait before trying again.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	if w != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+	}
+}
+
+// discoverReport shows admins who is looking up lots of codes.
+func discoverReport(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	return discoverLimits.report(), nil
+}
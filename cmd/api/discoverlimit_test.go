@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiscoverLimiter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := newDiscoverLimiter(func() time.Time { return now })
+	account := discoverKey{kind: "account", id: "1"}
+	ip := discoverKey{kind: "ip", id: "192.0.2.1"}
+
+	// Lookups that resolve only count towards the limit.
+	for i := 0; i < maxAccountDiscovers; i++ {
+		if delay, err := l.allow(account, ip); err != nil || delay != 0 {
+			t.Fatalf("lookup %v: got %v, %v", i, delay, err)
+		}
+	}
+	if _, err := l.allow(account, ip); err != errTooManyDiscovers {
+		t.Errorf("lookup over the limit allowed: %v", err)
+	}
+	// Other accounts behind the same address still get some.
+	if _, err := l.allow(discoverKey{kind: "account", id: "2"}, ip); err != nil {
+		t.Error(err)
+	}
+
+	// Failed lookups slow the account down, then get it banned.
+	now = now.Add(discoverWindow)
+	for i := 0; i < discoverFailuresBeforeDelay; i++ {
+		l.allow(account)
+		l.fail(account)
+	}
+	if wait, err := l.allow(account); err != errTooManyDiscovers || wait != time.Second {
+		t.Errorf("got %v, %v", wait, err)
+	}
+	now = now.Add(time.Second)
+	if _, err := l.allow(account); err != nil {
+		t.Errorf("slowed down account not let through after waiting: %v", err)
+	}
+	l.fail(account)
+	if wait, _ := l.allow(account); wait != 2*time.Second {
+		t.Errorf("got wait %v", wait)
+	}
+	for i := discoverFailuresBeforeDelay + 1; i < discoverFailuresBeforeBan; i++ {
+		l.fail(account)
+	}
+	if wait, err := l.allow(account); err != errTooManyDiscovers || wait != discoverBan {
+		t.Errorf("banned account allowed: %v, %v", wait, err)
+	}
+
+	report := l.report()
+	if len(report.Clients) == 0 || report.Clients[0].Kind != "account" || report.Clients[0].ID != "1" || report.Clients[0].BannedUntil == nil || report.Clients[0].Strikes != 1 {
+		t.Errorf("bad report: %+v", report)
+	}
+
+	// The next ban is twice as long.
+	now = now.Add(discoverBan)
+	if _, err := l.allow(account); err != nil {
+		t.Errorf("ban didn't end: %v", err)
+	}
+	for i := 0; i < discoverFailuresBeforeBan; i++ {
+		l.fail(account)
+	}
+	now = now.Add(discoverBan)
+	if _, err := l.allow(account); err != errTooManyDiscovers {
+		t.Errorf("second ban ended early: %v", err)
+	}
+	now = now.Add(discoverBan)
+	if _, err := l.allow(account); err != nil {
+		t.Errorf("second ban didn't end: %v", err)
+	}
+
+	// Once strikes expire there's nothing left to remember.
+	now = now.Add(discoverStrikeTTL)
+	l.allow(discoverKey{kind: "account", id: "3"})
+	if len(l.clients) != 1 {
+		t.Errorf("remembered %v clients", len(l.clients))
+	}
+
+	// Clients are only pruned once an interval.
+	now = now.Add(discoverWindow - 10*time.Second)
+	l.allow(discoverKey{kind: "account", id: "4"})
+	now = now.Add(20 * time.Second)
+	l.allow(discoverKey{kind: "account", id: "5"})
+	if len(l.clients) != 3 {
+		t.Errorf("pruned within an interval: remembered %v clients", len(l.clients))
+	}
+	now = now.Add(discoverPruneInterval)
+	l.allow(discoverKey{kind: "account", id: "5"})
+	if len(l.clients) != 2 {
+		t.Errorf("not pruned after an interval: remembered %v clients", len(l.clients))
+	}
+}
+
+func TestDiscoverReportAuth(t *testing.T) {
+	os.Setenv("ADMIN_TOKEN", "admintoken")
+	defer os.Unsetenv("ADMIN_TOKEN")
+
+	if _, err := adminAuth(discoverReport)(account{}, nil, makeBearerRequest("wrongtoken")); err != errInvalidCredentials {
+		t.Errorf("report shown with the wrong token: %v", err)
+	}
+	if res, err := adminAuth(discoverReport)(account{}, nil, makeBearerRequest("admintoken")); err != nil {
+		t.Error(err)
+	} else if _, ok := res.(discoverReportResponse); !ok {
+		t.Errorf("bad report: %v", res)
+	}
+}
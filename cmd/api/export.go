@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"server/lib/export"
+)
+
+// exportResponse is everything stored about the account, with its secrets
+// redacted.
+type exportResponse struct {
+	export.Export
+}
+
+// exportAccount answers a data access request from the account itself. The
+// issuer's export subcommand prints the same thing for requests that come in
+// some other way.
+func exportAccount(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	e, err := export.Build(dbGlobal, acc.id)
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	return exportResponse{e}, nil
+}
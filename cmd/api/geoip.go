@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"server/lib/geobalance"
+)
+
+// How often the GeoIP file is checked for changes.
+const geoIPReloadInterval = time.Minute
+
+// loadGeoIP loads the GeoIP table in the CSV file named by GEOIP_FILE, if
+// set, and reloads it whenever the file changes.
+func loadGeoIP() {
+	path := os.Getenv("GEOIP_FILE")
+	if path == "" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	g, err := geobalance.LoadGeoIP(path)
+	if err != nil {
+		log.Panic(err)
+	}
+	geobalance.SetGeoIP(g)
+
+	go func() {
+		modified := info.ModTime()
+		for range time.Tick(geoIPReloadInterval) {
+			info, err := os.Stat(path)
+			if err != nil {
+				log.Printf("Failed to check the GeoIP file: %v", err)
+				continue
+			} else if info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+
+			// Keep the last good table if this one is broken.
+			if g, err := geobalance.LoadGeoIP(path); err != nil {
+				log.Printf("Failed to reload the GeoIP file: %v", err)
+			} else {
+				geobalance.SetGeoIP(g)
+				log.Print("Reloaded the GeoIP file")
+			}
+		}
+	}()
+}
+
+// trustProxy is whether the api runs behind a proxy that appends the address
+// it was connected from to X-Forwarded-For, like Heroku's router. Set
+// TRUST_PROXY to trust it; without, anyone could set the header themselves.
+var trustProxy = os.Getenv("TRUST_PROXY") != ""
+
+// cloudflareNetworks are the addresses Cloudflare connects from, as published
+// at https://www.cloudflare.com/ips/. Set CLOUDFLARE_IPS to a comma-separated
+// list of CIDRs to override them.
+var cloudflareNetworks []*net.IPNet
+
+func init() {
+	cidrs := []string{
+		"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+		"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+		"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+		"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+		"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+		"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+	}
+	if env := os.Getenv("CLOUDFLARE_IPS"); env != "" {
+		cidrs = strings.Split(env, ",")
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Panicf("Invalid Cloudflare network %q", cidr)
+		}
+		cloudflareNetworks = append(cloudflareNetworks, network)
+	}
+}
+
+func isCloudflare(ip net.IP) bool {
+	for _, network := range cloudflareNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address a request came from. Behind a trusted proxy,
+// the last X-Forwarded-For entry is the address the proxy was connected from;
+// anything before it came from the client. Otherwise it's the address of the
+// connection. When that's a Cloudflare edge, the client is in
+// CF-Connecting-IP. Anyone else could have set that header themselves, so
+// it's ignored.
+func clientIP(r *http.Request) net.IP {
+	var peer net.IP
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustProxy && forwarded != "" {
+		entries := strings.Split(forwarded, ",")
+		peer = net.ParseIP(strings.TrimSpace(entries[len(entries)-1]))
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = net.ParseIP(host)
+	}
+
+	if peer != nil && isCloudflare(peer) {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("CF-Connecting-IP"))); ip != nil {
+			return ip
+		}
+	}
+	return peer
+}
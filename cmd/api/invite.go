@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Besides its primary code, an account can hand out invite links of its own,
+// which can expire, run out of uses, or be revoked without touching the
+// others. The primary code can be revoked too, and rotated to a new one.
+// Codes that stop working are never handed out to anyone else.
+
+const (
+	maxInviteLinks       = 20
+	maxInviteLabelLength = 64
+	// maxCodeAttempts bounds how many random codes are tried before giving
+	// up, in case something other than a taken code keeps them from being
+	// used.
+	maxCodeAttempts = 10
+)
+
+type inviteLink struct {
+	ID            int        `json:"linkId"`
+	Code          string     `json:"code"`
+	ShareableLink string     `json:"shareableLink"`
+	Label         string     `json:"label"`
+	MaxUses       *int       `json:"maxUses"`
+	Uses          int        `json:"uses"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	RevokedAt     *time.Time `json:"revokedAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	// Active is whether /account/discover resolves the link.
+	Active bool `json:"active"`
+}
+
+type inviteLinksResponse struct {
+	// ShareableLink is the primary code's link, empty while it's revoked.
+	ShareableLink string       `json:"shareableLink"`
+	Links         []inviteLink `json:"links"`
+}
+
+type inviteLinkResponse struct {
+	inviteLink
+}
+
+type createInviteLinkRequest struct {
+	Label     string     `json:"label"`
+	MaxUses   *int       `json:"maxUses"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// revokeInviteLinkRequest names either a link or the primary code.
+type revokeInviteLinkRequest struct {
+	LinkID  int  `json:"linkId"`
+	Primary bool `json:"primary"`
+}
+
+func (l *inviteLink) setActive(now time.Time) {
+	l.Active = l.RevokedAt == nil &&
+		(l.ExpiresAt == nil || l.ExpiresAt.After(now)) &&
+		(l.MaxUses == nil || l.Uses < *l.MaxUses)
+}
+
+// findInviteLinks returns the account's primary link and every invite link it
+// made, revoked ones included.
+func findInviteLinks(accountID int) (inviteLinksResponse, error) {
+	var code string
+	var revokedAt sql.NullTime
+	if err := dbGlobal.QueryRow(findPrimaryCodeQuery, accountID).Scan(&code, &revokedAt); err != nil {
+		log.Print(err)
+		return inviteLinksResponse{}, errInternal
+	}
+
+	res := inviteLinksResponse{Links: []inviteLink{}}
+	if !revokedAt.Valid {
+		res.ShareableLink = createShareableLink(code)
+	}
+
+	rows, err := dbGlobal.Query(findInviteLinksQuery, accountID)
+	if err != nil {
+		log.Print(err)
+		return inviteLinksResponse{}, errInternal
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var l inviteLink
+		if err := rows.Scan(&l.ID, &l.Code, &l.Label, &l.MaxUses, &l.Uses, &l.ExpiresAt, &l.RevokedAt, &l.CreatedAt); err != nil {
+			log.Print(err)
+			return inviteLinksResponse{}, errInternal
+		}
+		l.ShareableLink = createShareableLink(l.Code)
+		l.setActive(now)
+		res.Links = append(res.Links, l)
+	}
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return inviteLinksResponse{}, errInternal
+	}
+
+	return res, nil
+}
+
+// listInviteLinks lists the account's links.
+func listInviteLinks(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	return findInviteLinks(acc.id)
+}
+
+// createInviteLink makes a new invite link, with a label only the account
+// sees, and optionally a number of uses and an expiry.
+func createInviteLink(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req createInviteLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Label) > maxInviteLabelLength {
+		return nil, errInvalidBody
+	}
+	if (req.MaxUses != nil && *req.MaxUses <= 0) || (req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now())) {
+		return nil, errInvalidBody
+	}
+
+	var count int
+	if err := dbGlobal.QueryRow(countInviteLinksQuery, acc.id).Scan(&count); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if count >= maxInviteLinks {
+		return nil, errInvalidBody
+	}
+
+	l := inviteLink{Label: req.Label, MaxUses: req.MaxUses, ExpiresAt: req.ExpiresAt, CreatedAt: time.Now()}
+	for attempt := 0; ; attempt++ {
+		if attempt == maxCodeAttempts {
+			log.Printf("no free invite code for account %v", acc.id)
+			return nil, errInternal
+		}
+
+		code, err := randString(12)
+		if err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+
+		row := dbGlobal.QueryRow(createInviteLinkQuery, acc.id, code, req.Label, req.MaxUses, req.ExpiresAt)
+		if err := row.Scan(&l.ID); err == nil {
+			l.Code = code
+			break
+		} else if err != sql.ErrNoRows {
+			log.Print(err)
+			return nil, errInternal
+		}
+	}
+
+	l.ShareableLink = createShareableLink(l.Code)
+	l.setActive(time.Now())
+	return inviteLinkResponse{l}, nil
+}
+
+// revokeInviteLink stops a link, or the primary code, from working, and lists
+// the account's links.
+func revokeInviteLink(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req revokeInviteLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.LinkID > 0) == req.Primary {
+		return nil, errInvalidBody
+	}
+
+	var res sql.Result
+	var err error
+	if req.Primary {
+		res, err = dbGlobal.Exec(revokePrimaryCodeQuery, acc.id)
+	} else {
+		res, err = dbGlobal.Exec(revokeInviteLinkQuery, req.LinkID, acc.id)
+	}
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if n, err := res.RowsAffected(); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if n == 0 && !req.Primary {
+		return nil, errInvalidBody
+	}
+
+	return findInviteLinks(acc.id)
+}
+
+// rotatePrimaryCode gives the account a new primary code, which works even if
+// the old one was revoked, and lists the account's links.
+func rotatePrimaryCode(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt == maxCodeAttempts {
+			log.Printf("no free primary code for account %v", acc.id)
+			return nil, errInternal
+		}
+
+		code, err := randString(12)
+		if err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+
+		var oldCode string
+		if err := dbGlobal.QueryRow(rotatePrimaryCodeQuery, acc.id, code).Scan(&oldCode); err == nil {
+			break
+		} else if err != sql.ErrNoRows {
+			log.Print(err)
+			return nil, errInternal
+		}
+	}
+
+	return findInviteLinks(acc.id)
+}
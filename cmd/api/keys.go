@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Accounts encrypt their signaling end to end. Every device registers an
+// X25519 public key, which other accounts look up to seal the offers, answers
+// and candidates they send through the relay.
+
+type publicKey struct {
+	DeviceID  string `json:"deviceId"`
+	PublicKey string `json:"publicKey"`
+}
+
+type registerKeyRequest struct {
+	DeviceID  string `json:"deviceId"`
+	PublicKey string `json:"publicKey"`
+}
+
+type keysResponse struct {
+	ID         int         `json:"accountId"`
+	PublicKeys []publicKey `json:"publicKeys"`
+}
+
+func registerKey(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req registerKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	deviceID := strings.TrimSpace(req.DeviceID)
+	if deviceID == "" || len(deviceID) > 64 {
+		return nil, errInvalidBody
+	}
+
+	// Make sure the key is a valid X25519 public key, and store it in its
+	// canonical encoding.
+	raw, err := base64.StdEncoding.DecodeString(req.PublicKey)
+	if err != nil {
+		return nil, errInvalidPublicKey
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, errInvalidPublicKey
+	}
+	encoded := base64.StdEncoding.EncodeToString(key.Bytes())
+
+	if _, err := dbGlobal.Exec(registerPublicKeyQuery, acc.id, deviceID, encoded); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	keys, err := findPublicKeys(acc.id)
+	if err != nil {
+		return nil, err
+	}
+
+	return keysResponse{
+		ID:         acc.id,
+		PublicKeys: keys,
+	}, nil
+}
+
+// lookupKeys returns the public keys of the account in the accountId query
+// parameter, which must be the account itself or a contact, so accounts can't
+// be enumerated by id.
+func lookupKeys(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	id, err := strconv.Atoi(r.URL.Query().Get("accountId"))
+	if err != nil || (id != acc.id && !areContacts(acc.id, id)) {
+		return nil, errInvalidBody
+	}
+
+	keys, err := findPublicKeys(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return keysResponse{
+		ID:         id,
+		PublicKeys: keys,
+	}, nil
+}
+
+func findPublicKeys(accountID int) ([]publicKey, error) {
+	rows, err := dbGlobal.Query(findPublicKeysQuery, accountID)
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+	defer rows.Close()
+
+	// Perform this allocation so that Go encodes the empty slice as [], not
+	// null.
+	keys := make([]publicKey, 0)
+	for rows.Next() {
+		var key publicKey
+		if err := rows.Scan(&key.DeviceID, &key.PublicKey); err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	return keys, nil
+}
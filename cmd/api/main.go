@@ -10,6 +10,8 @@ import (
 
 	"database/sql"
 
+	"server/lib/geobalance"
+
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
@@ -62,6 +64,32 @@ var (
 		Message:    "invalid credentials",
 		httpStatus: http.StatusUnauthorized,
 	}
+
+	errInvalidPublicKey = apiError{
+		Code:       5,
+		Message:    "invalid public key",
+		httpStatus: http.StatusBadRequest,
+	}
+
+	errTURNQuotaExceeded = apiError{
+		Code:       6,
+		Message:    "TURN quota exceeded",
+		httpStatus: http.StatusForbidden,
+	}
+
+	errTooManyDiscovers = apiError{
+		Code:       7,
+		Message:    "too many account lookups",
+		httpStatus: http.StatusTooManyRequests,
+	}
+
+	// errPollClosed means the long-polling transport closed, after idling or
+	// with its session. Polling again opens a new one.
+	errPollClosed = apiError{
+		Code:       8,
+		Message:    "poll transport closed",
+		httpStatus: http.StatusGone,
+	}
 )
 
 func init() {
@@ -128,7 +156,7 @@ func router(method string, f internalHandler) http.HandlerFunc {
 			log.Printf("non-API error: %s", err)
 		} else if res != nil {
 			switch r := res.(type) {
-			case createResponse, discoverResponse, startResponse:
+			case createResponse, discoverResponse, startResponse, pollResponse, keysResponse, pushTokenResponse, turnResponse, turnRESTResponse, turnHealthResponse, rttResponse, turnUsageResponse, sessionsResponse, loginResponse, accessTokenResponse, wsTicketResponse, profileResponse, deleteAccountResponse, exportResponse, inviteLinksResponse, inviteLinkResponse, discoverReportResponse:
 				json.NewEncoder(w).Encode(r)
 				return
 			default:
@@ -142,12 +170,69 @@ func router(method string, f internalHandler) http.HandlerFunc {
 }
 
 func main() {
-	http.HandleFunc("/ws", router("GET", auth(ws)))
-	http.HandleFunc("/ws/", router("GET", auth(ws)))
+	http.HandleFunc("/ws", router("GET", wsAuth(ws)))
+	http.HandleFunc("/ws/", router("GET", wsAuth(ws)))
+	http.HandleFunc("/ws/ticket", router("POST", auth(issueWSTicket)))
+	http.HandleFunc("/ws/ticket/", router("POST", auth(issueWSTicket)))
+	http.HandleFunc("/poll/send", router("POST", auth(pollSend)))
+	http.HandleFunc("/poll/send/", router("POST", auth(pollSend)))
+	http.HandleFunc("/poll/receive", router("GET", auth(pollReceive)))
+	http.HandleFunc("/poll/receive/", router("GET", auth(pollReceive)))
+	http.HandleFunc("/turn/health", router("GET", turnHealth))
+	http.HandleFunc("/turn/health/", router("GET", turnHealth))
+	http.HandleFunc("/turn/usage", router("POST", turnServerAuth(reportTURNUsage)))
+	http.HandleFunc("/turn/usage/", router("POST", turnServerAuth(reportTURNUsage)))
 	http.HandleFunc("/account/create", router("POST", create))
 	http.HandleFunc("/account/create/", router("POST", create))
 	http.HandleFunc("/account/start", router("GET", auth(start)))
+	http.HandleFunc("/account/delete", router("POST", auth(deleteSelf)))
+	http.HandleFunc("/account/delete/", router("POST", auth(deleteSelf)))
+	http.HandleFunc("/admin/discover", router("GET", adminAuth(discoverReport)))
+	http.HandleFunc("/admin/discover/", router("GET", adminAuth(discoverReport)))
+	http.HandleFunc("/admin/account/delete", router("POST", adminAuth(adminDeleteAccount)))
+	http.HandleFunc("/admin/account/delete/", router("POST", adminAuth(adminDeleteAccount)))
+	http.HandleFunc("/account/export", router("GET", auth(exportAccount)))
+	http.HandleFunc("/account/export/", router("GET", auth(exportAccount)))
+	http.HandleFunc("/account/profile", router("PATCH", auth(updateProfile)))
+	http.HandleFunc("/account/profile/", router("PATCH", auth(updateProfile)))
+	http.HandleFunc("/account/token", router("POST", sessionAuth(issueAccessToken)))
+	http.HandleFunc("/account/token/", router("POST", sessionAuth(issueAccessToken)))
+	http.HandleFunc("/account/login", router("POST", auth(login)))
+	http.HandleFunc("/account/login/", router("POST", auth(login)))
+	http.HandleFunc("/account/sessions", router("GET", auth(listSessions)))
+	http.HandleFunc("/account/sessions/", router("GET", auth(listSessions)))
+	http.HandleFunc("/account/sessions/revoke", router("POST", auth(revokeSession)))
+	http.HandleFunc("/account/sessions/revoke/", router("POST", auth(revokeSession)))
+	http.HandleFunc("/account/turn", router("GET", auth(refreshTURN)))
+	http.HandleFunc("/account/turn/", router("GET", auth(refreshTURN)))
+	http.HandleFunc("/account/turn/pair", router("GET", auth(pairTURN)))
+	http.HandleFunc("/account/turn/pair/", router("GET", auth(pairTURN)))
+	http.HandleFunc("/account/rtt", router("POST", auth(reportRTT)))
+	http.HandleFunc("/account/rtt/", router("POST", auth(reportRTT)))
+	http.HandleFunc("/account/links", router("GET", auth(listInviteLinks)))
+	http.HandleFunc("/account/links/", router("GET", auth(listInviteLinks)))
+	http.HandleFunc("/account/links/create", router("POST", auth(createInviteLink)))
+	http.HandleFunc("/account/links/create/", router("POST", auth(createInviteLink)))
+	http.HandleFunc("/account/links/revoke", router("POST", auth(revokeInviteLink)))
+	http.HandleFunc("/account/links/revoke/", router("POST", auth(revokeInviteLink)))
+	http.HandleFunc("/account/links/rotate", router("POST", auth(rotatePrimaryCode)))
+	http.HandleFunc("/account/links/rotate/", router("POST", auth(rotatePrimaryCode)))
 	http.HandleFunc("/account/discover/", router("GET", auth(discover)))
 	http.HandleFunc("/account/discover", router("GET", auth(discover)))
+	http.HandleFunc("/account/keys", router("GET", auth(lookupKeys)))
+	http.HandleFunc("/account/keys/", router("GET", auth(lookupKeys)))
+	http.HandleFunc("/account/keys/register", router("POST", auth(registerKey)))
+	http.HandleFunc("/account/keys/register/", router("POST", auth(registerKey)))
+	http.HandleFunc("/account/push/register", router("POST", auth(registerPushToken)))
+	http.HandleFunc("/account/push/register/", router("POST", auth(registerPushToken)))
+	http.HandleFunc("/account/push/unregister", router("POST", auth(unregisterPushToken)))
+	http.HandleFunc("/account/push/unregister/", router("POST", auth(unregisterPushToken)))
+	go hashStoredTokens()
+	loadRevokedSessions()
+	loadTURNRegistry()
+	loadGeoIP()
+	loadTURNSecrets()
+	geobalance.StartHealthChecks(&geobalance.Checker{})
+	startEmbeddedTURN()
 	log.Fatal(http.ListenAndServe(":"+os.Getenv("PORT"), nil))
 }
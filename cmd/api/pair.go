@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+
+	"server/lib/geobalance"
+)
+
+// Peers in a call each ask /account/turn/pair for TURN servers, naming the
+// other. Both get the same servers, picked for the two of them, so they meet
+// on the same relay instead of each going through their own.
+
+const (
+	// recentClientTTL is how long where an account was is remembered, for
+	// picking servers for its calls.
+	recentClientTTL = 24 * time.Hour
+	// pairChoiceTTL is how long the servers picked for a pair are kept, so
+	// the second peer to ask gets what the first one got.
+	pairChoiceTTL = 5 * time.Minute
+)
+
+// rememberClient keeps where an account is and the network it's on, for
+// picking servers for its calls. It's kept in the database, so every process
+// picks the same servers for a pair.
+func rememberClient(c geobalance.Client, network string) {
+	var latitude, longitude *float64
+	if c.Located {
+		latitude, longitude = &c.Latitude, &c.Longitude
+	}
+	var ip string
+	if c.IP != nil {
+		ip = c.IP.String()
+	}
+
+	if _, err := dbGlobal.Exec(rememberClientQuery, c.AccountID, c.CountryCode, c.Subdivision, latitude, longitude, ip, network); err != nil {
+		log.Print(err)
+	}
+}
+
+// lastClient returns where an account was last seen, with the round-trip
+// times it measured from there. Accounts that haven't been seen recently are
+// only known by their id.
+func lastClient(accountID int) (geobalance.Client, error) {
+	c := geobalance.Client{AccountID: accountID, CountryCode: "unknown"}
+
+	var latitude, longitude sql.NullFloat64
+	var ip, network string
+	err := dbGlobal.QueryRow(lastClientQuery, accountID, time.Now().Add(-recentClientTTL)).Scan(&c.CountryCode, &c.Subdivision, &latitude, &longitude, &ip, &network, &c.LicenseID)
+	if err == sql.ErrNoRows {
+		return c, nil
+	} else if err != nil {
+		log.Print(err)
+		return c, errInternal
+	}
+
+	if latitude.Valid && longitude.Valid {
+		c.Latitude, c.Longitude, c.Located = latitude.Float64, longitude.Float64, true
+	}
+	c.IP = net.ParseIP(ip)
+	c.RTTs, err = findRTTs(accountID, network)
+	return c, err
+}
+
+// findPairChoice returns the servers picked for a pair recently, and when they
+// were picked.
+func findPairChoice(pair [2]int) ([]string, time.Time, error) {
+	var serverIDs []string
+	var chosen time.Time
+	err := dbGlobal.QueryRow(findPairChoiceQuery, pair[0], pair[1], time.Now().Add(-pairChoiceTTL)).Scan((*pq.StringArray)(&serverIDs), &chosen)
+	if err == sql.ErrNoRows {
+		return nil, time.Time{}, nil
+	}
+	return serverIDs, chosen, err
+}
+
+// pairServers returns the servers for a call between two accounts: the ones
+// picked when either of them last asked, if that was recent and they are
+// still up.
+func pairServers(self, peer geobalance.Client) ([]geobalance.Server, error) {
+	pair := [2]int{self.AccountID, peer.AccountID}
+	if pair[1] < pair[0] {
+		pair[0], pair[1] = pair[1], pair[0]
+	}
+
+	serverIDs, chosen, err := findPairChoice(pair)
+	if err != nil {
+		return nil, err
+	}
+	if servers := healthyServers(serverIDs); len(servers) > 0 && servers[0].ID == serverIDs[0] {
+		return servers, nil
+	}
+
+	servers, err := geobalance.RankPair(self, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	serverIDs = nil
+	for _, server := range servers {
+		serverIDs = append(serverIDs, server.ID)
+	}
+	// Only replace the choice that was found, or an old one, so if the other
+	// peer picked servers in the meantime both get theirs. Old choices of
+	// other pairs are forgotten along the way.
+	err = dbGlobal.QueryRow(choosePairQuery, pair[0], pair[1], pq.StringArray(serverIDs), chosen, time.Now().Add(-pairChoiceTTL)).Scan((*pq.StringArray)(&serverIDs))
+	if err == sql.ErrNoRows {
+		if serverIDs, _, err = findPairChoice(pair); err != nil {
+			return nil, err
+		}
+		if theirs := healthyServers(serverIDs); len(theirs) > 0 {
+			return theirs, nil
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return servers, nil
+}
+
+// healthyServers returns the servers of the current registry by id, skipping
+// the ones that are gone or down.
+func healthyServers(ids []string) []geobalance.Server {
+	var servers []geobalance.Server
+	for _, id := range ids {
+		if server, ok := geobalance.Find(id); ok && geobalance.Healthy(id) {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// pairTURN hands out TURN servers for a call with the account in the
+// accountId query parameter, which must be a contact, so where accounts are
+// isn't given away to strangers.
+func pairTURN(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	peerID, err := strconv.Atoi(r.URL.Query().Get("accountId"))
+	if err != nil || peerID == acc.id || !areContacts(acc.id, peerID) {
+		return nil, errInvalidBody
+	}
+
+	client, err := routeClient(acc, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkTURNQuota(acc.licenseID); err != nil {
+		return nil, err
+	}
+
+	peer, err := lastClient(peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := pairServers(client, peer)
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	ice, expiresAt := iceServers(servers, turnUser(acc.id, ""))
+	return turnResponse{
+		IceServers:      ice,
+		TurnCredentials: legacyTURNCredentials(ice),
+		ExpiresAt:       expiresAt,
+	}, nil
+}
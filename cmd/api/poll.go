@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"server/lib/relay"
+)
+
+// Some corporate proxies block websocket upgrades. Clients behind them can
+// talk to the relay by POSTing frames to /poll/send and long-polling
+// /poll/receive for the frames addressed to them. Once their transport closes,
+// from idling or with their session, both answer with errPollClosed, and the
+// next request opens a new one.
+var pollServer = relay.NewPollServer(pool)
+
+type pollRequest struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
+type pollResponse struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
+func pollSend(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req pollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	frames := make([][]byte, len(req.Messages))
+	for i, msg := range req.Messages {
+		frames[i] = msg
+	}
+
+	transport := pollServer.Transport(acc.id)
+	trackPollTransport(acc.sessionID, transport)
+	if err := transport.Push(frames); err == relay.ErrTransportClosed {
+		return nil, errPollClosed
+	} else if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	return pollResponse{Messages: []json.RawMessage{}}, nil
+}
+
+func pollReceive(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	transport := pollServer.Transport(acc.id)
+	trackPollTransport(acc.sessionID, transport)
+	frames, err := transport.Poll(r.Context().Done())
+	if err == relay.ErrTransportClosed {
+		return nil, errPollClosed
+	} else if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	// Perform this allocation so that Go encodes the empty slice as [], not
+	// null.
+	messages := make([]json.RawMessage, len(frames))
+	for i, p := range frames {
+		messages[i] = p
+	}
+
+	return pollResponse{Messages: messages}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNameLength is the length of accounts.first_name and last_name, in
+// characters.
+const maxNameLength = 30
+
+// profileRequest changes whichever names it has.
+type profileRequest struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+}
+
+type profileResponse struct {
+	ID        int    `json:"accountId"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName,omitempty"`
+}
+
+// normalizeName trims whitespace and invisible formatting characters, such as
+// zero-width spaces, off both ends of a name, and reports whether what's left
+// fits in the accounts table and has no control characters.
+func normalizeName(name string) (string, bool) {
+	name = strings.TrimFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.Is(unicode.Cf, r)
+	})
+
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxNameLength {
+		return "", false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// updateProfile changes the account's names, and tells the peers it's
+// connected to.
+func updateProfile(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req profileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	var firstName, lastName sql.NullString
+	if req.FirstName != nil {
+		name, ok := normalizeName(*req.FirstName)
+		if !ok || name == "" {
+			return nil, errInvalidBody
+		}
+		firstName = sql.NullString{String: name, Valid: true}
+	}
+	if req.LastName != nil {
+		name, ok := normalizeName(*req.LastName)
+		if !ok {
+			return nil, errInvalidBody
+		}
+		lastName = sql.NullString{String: name, Valid: true}
+	}
+
+	res := profileResponse{ID: acc.id}
+	row := dbGlobal.QueryRow(updateProfileQuery, acc.id, firstName, lastName)
+	if err := row.Scan(&res.FirstName, &res.LastName); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	if firstName.Valid || lastName.Valid {
+		pool.SendProfile(acc.id, res.FirstName, res.LastName)
+	}
+
+	return res, nil
+}
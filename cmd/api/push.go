@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"server/lib/push"
+)
+
+// pushInterval is how often the same caller may ring the same offline callee.
+// Clients repeat their offers until they get an answer, which shouldn't turn
+// into a stream of notifications.
+const pushInterval = 30 * time.Second
+
+var (
+	// Notifiers for every platform that is configured, by platform name.
+	notifiers = make(map[string]push.Notifier)
+
+	recentPushes struct {
+		mutex sync.Mutex
+		sent  map[[2]int]time.Time
+	}
+)
+
+func init() {
+	recentPushes.sent = make(map[[2]int]time.Time)
+
+	if p8 := os.Getenv("APNS_KEY"); p8 != "" {
+		if key, err := push.ParseAPNsKey([]byte(p8)); err != nil {
+			log.Printf("APNs disabled: %v", err)
+		} else {
+			endpoint := push.APNSProduction
+			if os.Getenv("APNS_SANDBOX") != "" {
+				endpoint = push.APNSSandbox
+			}
+
+			notifiers[push.PlatformAPNS] = &push.APNs{
+				Endpoint: endpoint,
+				Topic:    os.Getenv("APNS_TOPIC"),
+				KeyID:    os.Getenv("APNS_KEY_ID"),
+				TeamID:   os.Getenv("APNS_TEAM_ID"),
+				Key:      key,
+			}
+		}
+	}
+
+	if serverKey := os.Getenv("FCM_SERVER_KEY"); serverKey != "" {
+		notifiers[push.PlatformFCM] = &push.FCM{
+			Endpoint:  push.FCMEndpoint,
+			ServerKey: serverKey,
+		}
+	}
+
+	pool.OnOffline = func(fromID, toID int, msgType string) {
+		go notifyOffline(fromID, toID, msgType)
+	}
+	pool.AllowInvite = areContacts
+}
+
+type pushTokenRequest struct {
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+}
+
+type pushTokenResponse struct {
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+}
+
+func registerPushToken(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req pushTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	platform := strings.ToLower(req.Platform)
+	if platform != push.PlatformAPNS && platform != push.PlatformFCM {
+		return nil, errInvalidBody
+	} else if req.Token == "" || len(req.Token) > 256 {
+		return nil, errInvalidBody
+	}
+
+	// A device's token belongs to the session that registered it, and goes
+	// when it's revoked. Another account can only take it over after that, so
+	// nobody can take someone else's notifications.
+	if res, err := dbGlobal.Exec(registerPushTokenQuery, req.Token, acc.id, platform, acc.sessionID); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if n, err := res.RowsAffected(); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if n == 0 {
+		return nil, errInvalidBody
+	}
+
+	return pushTokenResponse{
+		Platform: platform,
+		Token:    req.Token,
+	}, nil
+}
+
+func unregisterPushToken(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req pushTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	if _, err := dbGlobal.Exec(unregisterPushTokenQuery, req.Token, acc.id); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	return pushTokenResponse{
+		Platform: strings.ToLower(req.Platform),
+		Token:    req.Token,
+	}, nil
+}
+
+// notifyOffline pushes a relay message to every device of an account that
+// isn't connected to the relay, if the sender is one of its contacts.
+func notifyOffline(fromID, toID int, msgType string) {
+	recentPushes.mutex.Lock()
+	pair := [2]int{fromID, toID}
+	if last, ok := recentPushes.sent[pair]; ok && time.Since(last) < pushInterval {
+		recentPushes.mutex.Unlock()
+		return
+	}
+	recentPushes.sent[pair] = time.Now()
+	// Forget pairs that can push again anyway, so the map doesn't grow.
+	for pair, last := range recentPushes.sent {
+		if time.Since(last) >= pushInterval {
+			delete(recentPushes.sent, pair)
+		}
+	}
+	recentPushes.mutex.Unlock()
+
+	if !areContacts(fromID, toID) {
+		return
+	}
+
+	var firstName, lastName string
+	row := dbGlobal.QueryRow(findAccountNameQuery, fromID)
+	if err := row.Scan(&firstName, &lastName); err != nil {
+		log.Print(err)
+		return
+	}
+
+	rows, err := dbGlobal.Query(findPushTokensQuery, toID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer rows.Close()
+
+	type device struct {
+		token, platform string
+	}
+	var devices []device
+	for rows.Next() {
+		var d device
+		if err := rows.Scan(&d.token, &d.platform); err != nil {
+			log.Print(err)
+			return
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return
+	}
+
+	msg := push.Message{
+		Type:     msgType,
+		FromID:   fromID,
+		FromName: strings.TrimSpace(firstName + " " + lastName),
+	}
+	for _, d := range devices {
+		notifier, ok := notifiers[d.platform]
+		if !ok {
+			continue
+		}
+
+		if err := notifier.Notify(d.token, msg); err == push.ErrUnregistered {
+			if _, err := dbGlobal.Exec(forgetPushTokenQuery, d.token); err != nil {
+				log.Print(err)
+			}
+		} else if err != nil {
+			log.Printf("Failed to push to account %v: %v", toID, err)
+		}
+	}
+}
@@ -4,10 +4,100 @@ const findLicenseQuery = "SELECT id, max_activations, revoked FROM license_keys
 
 const findLicenseUsers = "SELECT COUNT(*) FROM accounts WHERE license_id = $1;"
 
-const createAccountQuery = "INSERT INTO accounts(license_id, code, token, first_name, last_name) VALUES ($1, $2, $3, $4, $5) RETURNING id;"
+const createAccountQuery = "INSERT INTO accounts(license_id, code, first_name, last_name) SELECT $1, $2, $3, $4 WHERE NOT EXISTS (SELECT 1 FROM deleted_codes WHERE code = $2) AND NOT EXISTS (SELECT 1 FROM invite_links WHERE code = $2) RETURNING id;"
 
-const discoverAccountQuery = "SELECT id, first_name, last_name FROM accounts WHERE code = $1;"
+const discoverAccountQuery = "SELECT id, first_name, last_name FROM accounts WHERE code = $1 AND code_revoked_at IS NULL;"
 
-const authenticateQuery = "SELECT first_name, last_name, code FROM accounts WHERE id = $1 AND token = $2;"
+const discoverInviteLinkQuery = "WITH link AS (SELECT id, account_id FROM invite_links WHERE code = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP) AND (max_uses IS NULL OR uses < max_uses OR account_id = $2 OR EXISTS (SELECT 1 FROM contacts WHERE contacts.account_id = $2 AND contacts.contact_id = invite_links.account_id)) FOR UPDATE), contact AS (INSERT INTO contacts(account_id, contact_id) SELECT $2, account_id FROM link WHERE account_id <> $2 ON CONFLICT (account_id, contact_id) DO NOTHING RETURNING contact_id), used AS (UPDATE invite_links SET uses = uses + 1 WHERE id IN (SELECT link.id FROM link JOIN contact ON contact.contact_id = link.account_id)) SELECT accounts.id, accounts.first_name, COALESCE(accounts.last_name, ''), link.id FROM link JOIN accounts ON accounts.id = link.account_id;"
+
+const authenticateQuery = "SELECT accounts.first_name, accounts.last_name, CASE WHEN accounts.code_revoked_at IS NULL THEN accounts.code ELSE '' END, accounts.license_id, COALESCE(accounts.token, ''), COALESCE(sessions.id, 0), COALESCE(sessions.token_hash, '') FROM accounts LEFT JOIN sessions ON sessions.account_id = accounts.id WHERE accounts.id = $1;"
+
+const hashTokenQuery = "WITH hashed AS (UPDATE accounts SET token = NULL WHERE id = $1 AND token = $3 RETURNING id) INSERT INTO sessions(account_id, token_hash) SELECT id, $2 FROM hashed RETURNING id;"
+
+const findHashedSessionQuery = "SELECT id FROM sessions WHERE account_id = $1 AND token_hash = $2;"
+
+const findUnhashedTokensQuery = "SELECT id, token FROM accounts WHERE token IS NOT NULL AND id > $1 ORDER BY id LIMIT $2;"
 
 const issueQuery = "INSERT INTO license_keys(max_activations) VALUES ($1) RETURNING license, max_activations, revoked;"
+
+const registerPublicKeyQuery = "INSERT INTO public_keys(account_id, device_id, public_key) VALUES ($1, $2, $3) ON CONFLICT (account_id, device_id) DO UPDATE SET public_key = EXCLUDED.public_key;"
+
+const findPublicKeysQuery = "SELECT device_id, public_key FROM public_keys WHERE account_id = $1 ORDER BY created_at, device_id;"
+
+const registerPushTokenQuery = "INSERT INTO push_tokens(token, account_id, platform, session_id) VALUES ($1, $2, $3, $4) ON CONFLICT (token) DO UPDATE SET account_id = EXCLUDED.account_id, platform = EXCLUDED.platform, session_id = EXCLUDED.session_id WHERE push_tokens.account_id = EXCLUDED.account_id OR push_tokens.session_id IS NULL;"
+
+const unregisterPushTokenQuery = "DELETE FROM push_tokens WHERE token = $1 AND account_id = $2;"
+
+const forgetPushTokenQuery = "DELETE FROM push_tokens WHERE token = $1;"
+
+const findPushTokensQuery = "SELECT token, platform FROM push_tokens WHERE account_id = $1;"
+
+const findAccountNameQuery = "SELECT first_name, last_name FROM accounts WHERE id = $1;"
+
+const findTURNRegionsQuery = "SELECT id, continents, subdivisions, is_default, latitude, longitude FROM turn_regions ORDER BY id;"
+
+const findTURNServersQuery = "SELECT id, urls, transports, region, secret_env, weight, enabled FROM turn_servers ORDER BY id;"
+
+const findRoutingOverridesQuery = "SELECT COALESCE(country_code, ''), COALESCE(account_id, 0), COALESCE(license_id, 0), region FROM routing_overrides ORDER BY id;"
+
+const reportRTTQuery = "INSERT INTO rtt_measurements(account_id, network, region, rtt_ms) VALUES ($1, $2, $3, $4) ON CONFLICT (account_id, network, region) DO UPDATE SET rtt_ms = EXCLUDED.rtt_ms;"
+
+const findRTTsQuery = "SELECT region, rtt_ms FROM rtt_measurements WHERE account_id = $1 AND network = $2 AND last_updated_at > $3;"
+
+const findTURNSecretsQuery = "SELECT secret_env, version, secret, activates_at, retires_at FROM turn_secrets WHERE retires_at IS NULL OR retires_at > CURRENT_TIMESTAMP;"
+
+const reportTURNUsageQuery = "INSERT INTO turn_usage(account_id, month, bytes, seconds, allocations) SELECT id, date_trunc('month', CURRENT_TIMESTAMP)::date, $2, $3, 1 FROM accounts WHERE id = $1 ON CONFLICT (account_id, month) DO UPDATE SET bytes = turn_usage.bytes + EXCLUDED.bytes, seconds = turn_usage.seconds + EXCLUDED.seconds, allocations = turn_usage.allocations + 1;"
+
+const createTURNUsageReportQuery = "WITH old AS (DELETE FROM turn_usage_reports WHERE created_at < $2) INSERT INTO turn_usage_reports(report_id) VALUES ($1) ON CONFLICT (report_id) DO NOTHING;"
+
+const findTURNUsageReportQuery = "SELECT recorded FROM turn_usage_reports WHERE report_id = $1;"
+
+const recordTURNUsageReportQuery = "UPDATE turn_usage_reports SET recorded = $2 WHERE report_id = $1;"
+
+const findTURNQuotaQuery = "WITH usage AS (SELECT turn_usage.bytes, turn_usage.seconds FROM turn_usage JOIN accounts ON accounts.id = turn_usage.account_id WHERE accounts.license_id = $1 AND turn_usage.month = date_trunc('month', CURRENT_TIMESTAMP)::date UNION ALL SELECT bytes, seconds FROM deleted_turn_usage WHERE license_id = $1 AND month = date_trunc('month', CURRENT_TIMESTAMP)::date) SELECT license_keys.turn_quota_bytes, license_keys.turn_quota_seconds, COALESCE((SELECT SUM(bytes) FROM usage), 0), COALESCE((SELECT SUM(seconds) FROM usage), 0) FROM license_keys WHERE license_keys.id = $1;"
+
+const keepTURNUsageQuery = "INSERT INTO deleted_turn_usage(license_id, month, bytes, seconds, allocations) SELECT accounts.license_id, turn_usage.month, turn_usage.bytes, turn_usage.seconds, turn_usage.allocations FROM turn_usage JOIN accounts ON accounts.id = turn_usage.account_id WHERE turn_usage.account_id = $1 ON CONFLICT (license_id, month) DO UPDATE SET bytes = deleted_turn_usage.bytes + EXCLUDED.bytes, seconds = deleted_turn_usage.seconds + EXCLUDED.seconds, allocations = deleted_turn_usage.allocations + EXCLUDED.allocations;"
+
+const findProfileQuery = "SELECT first_name, COALESCE(last_name, ''), CASE WHEN code_revoked_at IS NULL THEN code ELSE '' END FROM accounts WHERE id = $1;"
+
+const createSessionQuery = "INSERT INTO sessions(account_id, token_hash, device_name, ip) VALUES ($1, $2, $3, $4) RETURNING id;"
+
+const touchSessionQuery = "UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, ip = $2 WHERE id = $1 AND (last_used_at < CURRENT_TIMESTAMP - interval '1 minute' OR ip <> $2);"
+
+const findSessionsQuery = "SELECT id, device_name, ip, created_at, last_used_at FROM sessions WHERE account_id = $1 ORDER BY created_at, id;"
+
+const revokeSessionQuery = "WITH revoked AS (DELETE FROM sessions WHERE id = $1 AND account_id = $2 RETURNING id) INSERT INTO revoked_sessions(session_id) SELECT id FROM revoked;"
+
+const updateProfileQuery = "UPDATE accounts SET first_name = COALESCE($2, first_name), last_name = COALESCE($3, last_name) WHERE id = $1 RETURNING first_name, COALESCE(last_name, '');"
+
+const revokeAccountSessionsQuery = "INSERT INTO revoked_sessions(session_id) SELECT id FROM sessions WHERE account_id = $1 ON CONFLICT (session_id) DO NOTHING RETURNING session_id;"
+
+const findRevokedSessionsQuery = "WITH old AS (DELETE FROM revoked_sessions WHERE revoked_at <= $1) SELECT session_id, revoked_at FROM revoked_sessions WHERE revoked_at > $1;"
+
+const deleteAccountQuery = "WITH deleted AS (DELETE FROM accounts WHERE id = $1 RETURNING id, code), links AS (INSERT INTO deleted_codes(code, account_id, deleted_by) SELECT invite_links.code, deleted.id, $2 FROM invite_links JOIN deleted ON deleted.id = invite_links.account_id) INSERT INTO deleted_codes(code, account_id, deleted_by) SELECT code, id, $2 FROM deleted RETURNING account_id;"
+
+const findPrimaryCodeQuery = "SELECT code, code_revoked_at FROM accounts WHERE id = $1;"
+
+const countInviteLinksQuery = "SELECT COUNT(*) FROM invite_links WHERE account_id = $1 AND revoked_at IS NULL;"
+
+const createInviteLinkQuery = "INSERT INTO invite_links(account_id, code, label, max_uses, expires_at) SELECT $1, $2, $3, $4, $5 WHERE NOT EXISTS (SELECT 1 FROM deleted_codes WHERE code = $2) AND NOT EXISTS (SELECT 1 FROM accounts WHERE code = $2) RETURNING id;"
+
+const findInviteLinksQuery = "SELECT id, code, label, max_uses, uses, expires_at, revoked_at, created_at FROM invite_links WHERE account_id = $1 ORDER BY created_at, id;"
+
+const revokeInviteLinkQuery = "UPDATE invite_links SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND account_id = $2 AND revoked_at IS NULL;"
+
+const revokePrimaryCodeQuery = "UPDATE accounts SET code_revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND code_revoked_at IS NULL;"
+
+const rotatePrimaryCodeQuery = "WITH old AS (SELECT id, code FROM accounts WHERE id = $1 FOR UPDATE), rotated AS (UPDATE accounts SET code = $2, code_revoked_at = NULL FROM old WHERE accounts.id = old.id AND NOT EXISTS (SELECT 1 FROM deleted_codes WHERE code = $2) AND NOT EXISTS (SELECT 1 FROM invite_links WHERE code = $2) RETURNING old.code) INSERT INTO deleted_codes(code, account_id, deleted_by) SELECT code, $1, 'rotated' FROM rotated RETURNING code;"
+
+const addContactQuery = "INSERT INTO contacts(account_id, contact_id) VALUES ($1, $2) ON CONFLICT (account_id, contact_id) DO NOTHING;"
+
+const areContactsQuery = "SELECT EXISTS (SELECT 1 FROM contacts WHERE (account_id = $1 AND contact_id = $2) OR (account_id = $2 AND contact_id = $1));"
+
+const rememberClientQuery = "INSERT INTO client_locations(account_id, country_code, subdivision, latitude, longitude, ip, network) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (account_id) DO UPDATE SET country_code = EXCLUDED.country_code, subdivision = EXCLUDED.subdivision, latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude, ip = EXCLUDED.ip, network = EXCLUDED.network, seen_at = CURRENT_TIMESTAMP WHERE client_locations.seen_at < CURRENT_TIMESTAMP - interval '1 minute' OR (client_locations.country_code, client_locations.subdivision, client_locations.latitude, client_locations.longitude, client_locations.ip, client_locations.network) IS DISTINCT FROM (EXCLUDED.country_code, EXCLUDED.subdivision, EXCLUDED.latitude, EXCLUDED.longitude, EXCLUDED.ip, EXCLUDED.network);"
+
+const lastClientQuery = "SELECT client_locations.country_code, client_locations.subdivision, client_locations.latitude, client_locations.longitude, client_locations.ip, client_locations.network, accounts.license_id FROM client_locations JOIN accounts ON accounts.id = client_locations.account_id WHERE client_locations.account_id = $1 AND client_locations.seen_at > $2;"
+
+const findPairChoiceQuery = "SELECT server_ids, chosen_at FROM pair_choices WHERE account_id = $1 AND peer_id = $2 AND chosen_at > $3;"
+
+const choosePairQuery = "WITH old AS (DELETE FROM pair_choices WHERE chosen_at <= $5 AND (account_id, peer_id) <> ($1, $2)) INSERT INTO pair_choices(account_id, peer_id, server_ids) VALUES ($1, $2, $3) ON CONFLICT (account_id, peer_id) DO UPDATE SET server_ids = EXCLUDED.server_ids, chosen_at = CURRENT_TIMESTAMP WHERE pair_choices.chosen_at <= $4 OR pair_choices.chosen_at <= $5 RETURNING server_ids;"
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"server/lib/geobalance"
+)
+
+// Clients measure round-trip times to a STUN address in every region, the
+// probe targets in /account/start, and report them for the network they are
+// on. Later TURN servers for that account and network come from the fastest
+// regions first.
+
+const (
+	// rttMaxAge is how long a measurement is used for. Networks change.
+	rttMaxAge = 7 * 24 * time.Hour
+	// How many regions a report may cover.
+	maxRTTMeasurements = 32
+)
+
+type probeTarget struct {
+	Region string `json:"region"`
+	URL    string `json:"url"`
+}
+
+type rttMeasurement struct {
+	Region string `json:"region"`
+	RTT    int    `json:"rttMs"`
+}
+
+type rttRequest struct {
+	// Network is whatever the client uses to tell the networks it's on
+	// apart, such as a hash of the Wi-Fi network's name.
+	Network      string           `json:"network"`
+	Measurements []rttMeasurement `json:"measurements"`
+}
+
+type rttResponse struct {
+	Network      string           `json:"network"`
+	Measurements []rttMeasurement `json:"measurements"`
+}
+
+func probeTargets() []probeTarget {
+	targets := []probeTarget{}
+	for _, server := range geobalance.ProbeTargets() {
+		if url := server.STUNURL(); url != "" {
+			targets = append(targets, probeTarget{Region: server.Region, URL: url})
+		}
+	}
+	return targets
+}
+
+func reportRTT(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req rttRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	if len(req.Network) > 64 || len(req.Measurements) == 0 || len(req.Measurements) > maxRTTMeasurements {
+		return nil, errInvalidBody
+	}
+	for _, m := range req.Measurements {
+		if m.Region == "" || len(m.Region) > 32 || m.RTT <= 0 || m.RTT > 10000 {
+			return nil, errInvalidBody
+		}
+	}
+
+	for _, m := range req.Measurements {
+		if _, err := dbGlobal.Exec(reportRTTQuery, acc.id, req.Network, m.Region, m.RTT); err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+	}
+
+	return rttResponse{
+		Network:      req.Network,
+		Measurements: req.Measurements,
+	}, nil
+}
+
+// findRTTs returns the round-trip times an account measured on a network
+// recently, by region.
+func findRTTs(accountID int, network string) (map[string]time.Duration, error) {
+	rows, err := dbGlobal.Query(findRTTsQuery, accountID, network, time.Now().Add(-rttMaxAge))
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+	defer rows.Close()
+
+	rtts := make(map[string]time.Duration)
+	for rows.Next() {
+		var region string
+		var rtt int
+		if err := rows.Scan(&region, &rtt); err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+		rtts[region] = time.Duration(rtt) * time.Millisecond
+	}
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	return rtts, nil
+}
+
+// routeClient gathers what TURN servers are picked by for a request: where
+// the client is and, for the network in the network query parameter, the
+// round-trip times it measured. It's remembered for the account's calls.
+func routeClient(acc account, r *http.Request) (geobalance.Client, error) {
+	c, err := locate(acc, r)
+	if err != nil {
+		return c, err
+	}
+
+	network := r.URL.Query().Get("network")
+	if len(network) > 64 {
+		return c, errInvalidBody
+	}
+
+	if c.RTTs, err = findRTTs(acc.id, network); err != nil {
+		return c, err
+	}
+
+	rememberClient(c, network)
+	return c, nil
+}
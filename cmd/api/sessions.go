@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"server/lib/relay"
+)
+
+// Every device an account is signed in on has a session, with a token of its
+// own. Sessions can be listed and revoked, and a signed in device can sign in
+// another.
+
+const maxDeviceNameLength = 64
+
+type session struct {
+	ID         int       `json:"sessionId"`
+	DeviceName string    `json:"deviceName"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	// Current is whether this is the session the request came from.
+	Current bool `json:"current"`
+}
+
+type sessionsResponse struct {
+	Sessions []session `json:"sessions"`
+}
+
+type loginRequest struct {
+	DeviceName string `json:"deviceName"`
+}
+
+type loginResponse struct {
+	ID        int    `json:"accountId"`
+	SessionID int    `json:"sessionId"`
+	Token     string `json:"token"`
+}
+
+type revokeSessionRequest struct {
+	SessionID int `json:"sessionId"`
+}
+
+// liveSessions are the websockets and long-polling transports open with each
+// session, so revoking it can close them.
+var liveSessions = struct {
+	mutex sync.Mutex
+	conns map[int]map[interface{ Close() error }]bool
+	// pollOwners are the sessions that opened each long-polling transport.
+	// An account has one, which its other sessions may use too.
+	pollOwners map[*relay.PollTransport]int
+}{
+	conns:      make(map[int]map[interface{ Close() error }]bool),
+	pollOwners: make(map[*relay.PollTransport]int),
+}
+
+// trackSession remembers a connection made with a session, until the returned
+// function is called.
+func trackSession(sessionID int, conn interface{ Close() error }) func() {
+	liveSessions.mutex.Lock()
+	defer liveSessions.mutex.Unlock()
+
+	if liveSessions.conns[sessionID] == nil {
+		liveSessions.conns[sessionID] = make(map[interface{ Close() error }]bool)
+	}
+	liveSessions.conns[sessionID][conn] = true
+
+	return func() {
+		liveSessions.mutex.Lock()
+		defer liveSessions.mutex.Unlock()
+
+		delete(liveSessions.conns[sessionID], conn)
+		if len(liveSessions.conns[sessionID]) == 0 {
+			delete(liveSessions.conns, sessionID)
+		}
+	}
+}
+
+// trackPollTransport remembers the session that opened a long-polling
+// transport, until it closes, so only revoking that session closes it. Polls
+// come in one request at a time, so it's only tracked the first time.
+func trackPollTransport(sessionID int, t *relay.PollTransport) {
+	liveSessions.mutex.Lock()
+	_, tracked := liveSessions.pollOwners[t]
+	if !tracked {
+		liveSessions.pollOwners[t] = sessionID
+	}
+	liveSessions.mutex.Unlock()
+	if tracked {
+		return
+	}
+
+	untrack := trackSession(sessionID, t)
+	go func() {
+		<-t.Done()
+		untrack()
+
+		liveSessions.mutex.Lock()
+		delete(liveSessions.pollOwners, t)
+		liveSessions.mutex.Unlock()
+	}()
+}
+
+// closeSession closes the connections made with a session.
+func closeSession(sessionID int) {
+	liveSessions.mutex.Lock()
+	conns := liveSessions.conns[sessionID]
+	delete(liveSessions.conns, sessionID)
+	liveSessions.mutex.Unlock()
+
+	for conn := range conns {
+		if err := conn.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// sessionIP is the address a session is used from, as recorded.
+func sessionIP(r *http.Request) string {
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// createSession signs a device in, and returns its session and token. db is
+// either dbGlobal or a transaction.
+func createSession(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, accountID int, deviceName, ip string) (int, string, error) {
+	token, err := randString(128)
+	if err != nil {
+		log.Print(err)
+		return 0, "", errInternal
+	}
+
+	var sessionID int
+	if err := db.QueryRow(createSessionQuery, accountID, hashToken(token), deviceName, ip).Scan(&sessionID); err != nil {
+		log.Print(err)
+		return 0, "", errInternal
+	}
+
+	return sessionID, token, nil
+}
+
+// touchSession records that a session was used, from where. It's only written
+// down once a minute, unless the address changes.
+func touchSession(sessionID int, r *http.Request) {
+	if _, err := dbGlobal.Exec(touchSessionQuery, sessionID, sessionIP(r)); err != nil {
+		log.Print(err)
+	}
+}
+
+func findSessions(acc account) ([]session, error) {
+	rows, err := dbGlobal.Query(findSessionsQuery, acc.id)
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+	defer rows.Close()
+
+	sessions := []session{}
+	for rows.Next() {
+		var s session
+		if err := rows.Scan(&s.ID, &s.DeviceName, &s.IP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			log.Print(err)
+			return nil, errInternal
+		}
+		s.Current = s.ID == acc.sessionID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+
+	return sessions, nil
+}
+
+// listSessions lists the devices the account is signed in on.
+func listSessions(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	sessions, err := findSessions(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionsResponse{Sessions: sessions}, nil
+}
+
+// revokeSession signs a device out, closing its websockets and forgetting its
+// tickets, and lists the sessions left.
+func revokeSession(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req revokeSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SessionID <= 0 {
+		return nil, errInvalidBody
+	}
+
+	res, err := dbGlobal.Exec(revokeSessionQuery, req.SessionID, acc.id)
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if n, err := res.RowsAffected(); err != nil {
+		log.Print(err)
+		return nil, errInternal
+	} else if n == 0 {
+		return nil, errInvalidBody
+	}
+
+	forgetAccessTokens(req.SessionID)
+	forgetSessionWSTickets(req.SessionID)
+	closeSession(req.SessionID)
+
+	sessions, err := findSessions(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessionsResponse{Sessions: sessions}, nil
+}
+
+// login signs a new device in to the account, from one already signed in.
+func login(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.DeviceName) > maxDeviceNameLength {
+		return nil, errInvalidBody
+	}
+
+	sessionID, token, err := createSession(dbGlobal, acc.id, req.DeviceName, sessionIP(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return loginResponse{ID: acc.id, SessionID: sessionID, Token: token}, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Browsers can't set headers on websockets, so web clients trade their
+// credentials for a ticket first and open /ws with it, either in the ticket
+// query parameter or as a "ticket.<ticket>" subprotocol. Tickets work once,
+// for a few seconds, and only from the origin they were asked for with, if
+// any.
+
+// wsTicketTTL is how long a ticket works for.
+const wsTicketTTL = 10 * time.Second
+
+// wsTicketProtocolPrefix starts the subprotocol carrying a ticket.
+const wsTicketProtocolPrefix = "ticket."
+
+type wsTicket struct {
+	// acc is who the ticket was minted for, with the session it was minted
+	// with, so revoking the session can forget it.
+	acc       account
+	origin    string
+	expiresAt time.Time
+}
+
+type wsTicketRequest struct {
+	// Origin, if set, is the only origin the ticket works from.
+	Origin string `json:"origin,omitempty"`
+}
+
+type wsTicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+var wsTickets = struct {
+	mutex   sync.Mutex
+	tickets map[string]wsTicket
+}{tickets: make(map[string]wsTicket)}
+
+// issueWSTicket mints a ticket for opening /ws.
+func issueWSTicket(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req wsTicketRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			return nil, errInvalidBody
+		}
+	}
+	if len(req.Origin) > 256 {
+		return nil, errInvalidBody
+	}
+
+	ticket, err := randString(32)
+	if err != nil {
+		log.Print(err)
+		return nil, errInternal
+	}
+	expiresAt := time.Now().Add(wsTicketTTL)
+
+	wsTickets.mutex.Lock()
+	wsTickets.tickets[ticket] = wsTicket{acc: acc, origin: req.Origin, expiresAt: expiresAt}
+	// Forget expired tickets, so the map doesn't grow.
+	for t, unused := range wsTickets.tickets {
+		if time.Now().After(unused.expiresAt) {
+			delete(wsTickets.tickets, t)
+		}
+	}
+	wsTickets.mutex.Unlock()
+
+	return wsTicketResponse{Ticket: ticket, ExpiresAt: expiresAt}, nil
+}
+
+// redeemWSTicket uses up a ticket, returning the account it was minted for if
+// it's still good for a request from origin.
+func redeemWSTicket(ticket, origin string) (account, bool) {
+	wsTickets.mutex.Lock()
+	t, ok := wsTickets.tickets[ticket]
+	delete(wsTickets.tickets, ticket)
+	wsTickets.mutex.Unlock()
+
+	if !ok || time.Now().After(t.expiresAt) || (t.origin != "" && t.origin != origin) {
+		return account{}, false
+	}
+	return t.acc, true
+}
+
+// forgetWSTickets makes an account's unused tickets stop working.
+func forgetWSTickets(accountID int) {
+	wsTickets.mutex.Lock()
+	defer wsTickets.mutex.Unlock()
+
+	for ticket, t := range wsTickets.tickets {
+		if t.acc.id == accountID {
+			delete(wsTickets.tickets, ticket)
+		}
+	}
+}
+
+// forgetSessionWSTickets makes the unused tickets minted with a session stop
+// working.
+func forgetSessionWSTickets(sessionID int) {
+	wsTickets.mutex.Lock()
+	defer wsTickets.mutex.Unlock()
+
+	for ticket, t := range wsTickets.tickets {
+		if t.acc.sessionID == sessionID {
+			delete(wsTickets.tickets, ticket)
+		}
+	}
+}
+
+// ticketProtocol returns the subprotocol a request offers a ticket in, if
+// any.
+func ticketProtocol(r *http.Request) string {
+	for _, protocol := range websocketProtocols(r) {
+		if strings.HasPrefix(protocol, wsTicketProtocolPrefix) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header["Sec-Websocket-Protocol"] {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// wsAuth authenticates websocket upgrades with a ticket, if they have one, and
+// like auth otherwise.
+func wsAuth(f internalHandler) internalHandler {
+	withCredentials := auth(f)
+	return func(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+		ticket := r.URL.Query().Get("ticket")
+		if protocol := ticketProtocol(r); ticket == "" && protocol != "" {
+			ticket = strings.TrimPrefix(protocol, wsTicketProtocolPrefix)
+		}
+		if ticket == "" {
+			return withCredentials(acc, w, r)
+		}
+
+		acc, ok := redeemWSTicket(ticket, r.Header.Get("Origin"))
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		return f(acc, w, r)
+	}
+}
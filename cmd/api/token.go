@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"os"
+	"time"
+)
+
+// Session tokens are stored as their HMAC-SHA256, keyed with TOKEN_HASH_KEY,
+// so the database alone doesn't let anyone in. Accounts from before that
+// still have their token in the clear until it's hashed into a session,
+// either in the background after the api starts or when the account next
+// signs in, whichever comes first.
+
+const (
+	// How many tokens hashStoredTokens hashes per query, and how long it
+	// waits between batches to leave the database to requests.
+	tokenHashBatch = 1000
+	tokenHashPause = 100 * time.Millisecond
+)
+
+var tokenHashKey []byte
+
+func init() {
+	if tokenHashKey = []byte(os.Getenv("TOKEN_HASH_KEY")); len(tokenHashKey) == 0 {
+		log.Panic("No TOKEN_HASH_KEY")
+	}
+
+	mac := hmac.New(sha256.New, tokenHashKey)
+	mac.Write([]byte("access tokens"))
+	accessTokenKey = mac.Sum(nil)
+}
+
+// hashToken returns what's stored for a token.
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, tokenHashKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkTokenHash reports, in constant time, whether token hashes to
+// storedHash.
+func checkTokenHash(token, storedHash string) bool {
+	return storedHash != "" && hmac.Equal([]byte(hashToken(token)), []byte(storedHash))
+}
+
+// checkLegacyToken reports, in constant time, whether token is an account's
+// token from before hashing.
+func checkLegacyToken(token, storedToken string) bool {
+	return storedToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(storedToken)) == 1
+}
+
+// hashStoredToken replaces an account's token with a session for its hash,
+// and returns the session.
+func hashStoredToken(id int, token string) (int, error) {
+	var sessionID int
+	err := dbGlobal.QueryRow(hashTokenQuery, id, hashToken(token), token).Scan(&sessionID)
+	return sessionID, err
+}
+
+// hashLegacyToken hashes an account's token from before hashing into a
+// session, as it signs in, and returns the session. If hashStoredTokens got
+// there first, it returns the session that made.
+func hashLegacyToken(id int, token string) (int, error) {
+	sessionID, err := hashStoredToken(id, token)
+	if err != sql.ErrNoRows {
+		return sessionID, err
+	}
+
+	err = dbGlobal.QueryRow(findHashedSessionQuery, id, hashToken(token)).Scan(&sessionID)
+	return sessionID, err
+}
+
+// hashStoredTokens hashes every token still stored in the clear, a batch at a
+// time. It runs in the background, so a failure only leaves tokens for
+// hashing when their accounts sign in.
+func hashStoredTokens() {
+	hashed, failed, lastID := 0, 0, 0
+	for {
+		rows, err := dbGlobal.Query(findUnhashedTokensQuery, lastID, tokenHashBatch)
+		if err != nil {
+			log.Printf("Failed to find account tokens to hash: %v", err)
+			break
+		}
+
+		type unhashed struct {
+			id    int
+			token string
+		}
+		var batch []unhashed
+		for rows.Next() {
+			var u unhashed
+			if err := rows.Scan(&u.id, &u.token); err != nil {
+				log.Printf("Failed to read an account token to hash: %v", err)
+				continue
+			}
+			batch = append(batch, u)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Failed to find account tokens to hash: %v", err)
+		}
+		rows.Close()
+
+		if len(batch) == 0 {
+			break
+		}
+		for _, u := range batch {
+			// No rows means the account signed in and hashed it first.
+			if _, err := hashStoredToken(u.id, u.token); err != nil && err != sql.ErrNoRows {
+				log.Printf("Failed to hash the token of account %v: %v", u.id, err)
+				failed++
+			} else if err == nil {
+				hashed++
+			}
+			lastID = u.id
+		}
+		time.Sleep(tokenHashPause)
+	}
+
+	if hashed > 0 || failed > 0 {
+		log.Printf("Hashed %v account tokens, %v failed", hashed, failed)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/lib/geobalance"
+	"server/lib/turncred"
+	"server/lib/turnserver"
+)
+
+// turnCredentialTTL is how long the TURN credentials handed to clients work
+// for. Set TURN_CREDENTIAL_TTL to a duration such as "1h" to override it.
+var turnCredentialTTL = 12 * time.Hour
+
+func init() {
+	if ttl := os.Getenv("TURN_CREDENTIAL_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Panicf("Invalid TURN_CREDENTIAL_TTL %q", ttl)
+		}
+		turnCredentialTTL = d
+	}
+}
+
+// embeddedTURN is the in-process TURN server, if one is running. When it is,
+// every client is sent to it instead of the TURN fleet.
+var embeddedTURN struct {
+	url string
+	key string
+}
+
+// embeddedTURNSecretEnv names the embedded TURN server's secret, both in the
+// environment and in the turn_secrets table.
+const embeddedTURNSecretEnv = "EMBEDDED_TURN_SECRET"
+
+// startEmbeddedTURN starts an in-process TURN server if EMBEDDED_TURN_URL is
+// set. That URL is what clients are told to connect to.
+func startEmbeddedTURN() {
+	url := os.Getenv("EMBEDDED_TURN_URL")
+	if url == "" {
+		return
+	}
+
+	udpAddrs := os.Getenv("EMBEDDED_TURN_UDP")
+	if udpAddrs == "" {
+		udpAddrs = "0.0.0.0:3478"
+	}
+
+	relayIP := net.ParseIP(os.Getenv("EMBEDDED_TURN_RELAY_IP"))
+	if relayIP == nil {
+		log.Panicf("Invalid EMBEDDED_TURN_RELAY_IP %q", os.Getenv("EMBEDDED_TURN_RELAY_IP"))
+	}
+
+	minPort, maxPort, err := turnserver.ParsePortRange(os.Getenv("EMBEDDED_TURN_RELAY_PORTS"))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	secret := os.Getenv(embeddedTURNSecretEnv)
+	if secret == "" && len(turnKeyring(embeddedTURNSecretEnv)) == 0 {
+		log.Panicf("No %v, in the environment or turn_secrets", embeddedTURNSecretEnv)
+	}
+	if _, err := turnserver.Start(turnserver.Config{
+		UDPAddrs:         turnserver.ParseAddrs(udpAddrs),
+		TCPAddrs:         turnserver.ParseAddrs(os.Getenv("EMBEDDED_TURN_TCP")),
+		RelayIP:          relayIP,
+		RelayBindAddress: os.Getenv("EMBEDDED_TURN_RELAY_BIND"),
+		MinPort:          minPort,
+		MaxPort:          maxPort,
+		Realm:            os.Getenv("EMBEDDED_TURN_REALM"),
+		Secret:           secret,
+		Keys:             func() turncred.Keyring { return turnKeyring(embeddedTURNSecretEnv) },
+		ReportUsage:      reportEmbeddedTURNUsage,
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	embeddedTURN.url = url
+	embeddedTURN.key = secret
+}
+
+type turnCredentials struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// iceServer is WebRTC's RTCIceServer.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+type turnResponse struct {
+	IceServers []iceServer `json:"iceServers"`
+	// TurnCredentials is for clients from before iceServers.
+	TurnCredentials []turnCredentials `json:"turnCredentials"`
+	ExpiresAt       time.Time         `json:"expiresAt"`
+}
+
+// turnRESTResponse is the response format of the TURN REST API, for clients
+// that already speak it.
+type turnRESTResponse struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int      `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+type turnHealthResponse struct {
+	Servers []geobalance.ServerHealth `json:"servers"`
+}
+
+// turnHealth reports which TURN servers health checks found up.
+func turnHealth(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	return turnHealthResponse{Servers: geobalance.Health()}, nil
+}
+
+// locate works out where a client is from Cloudflare's visitor location
+// headers. Clients may send more precise coordinates of their own in the
+// latitude and longitude query parameters. Requests that bypassed Cloudflare
+// are located by their address.
+func locate(acc account, r *http.Request) (geobalance.Client, error) {
+	c := geobalance.Client{
+		CountryCode: r.Header.Get("CF-IPCountry"),
+		IP:          clientIP(r),
+		AccountID:   acc.id,
+		LicenseID:   acc.licenseID,
+	}
+	if c.CountryCode == "" {
+		c.CountryCode = "unknown"
+	}
+	if region := r.Header.Get("CF-Region-Code"); region != "" {
+		c.Subdivision = c.CountryCode + "-" + region
+	}
+
+	latitude, longitude := r.Header.Get("CF-IPLatitude"), r.Header.Get("CF-IPLongitude")
+	if query := r.URL.Query(); query.Get("latitude") != "" || query.Get("longitude") != "" {
+		latitude, longitude = query.Get("latitude"), query.Get("longitude")
+	} else if latitude == "" || longitude == "" {
+		return c, nil
+	}
+
+	var err error
+	if c.Latitude, err = strconv.ParseFloat(latitude, 64); err != nil || math.Abs(c.Latitude) > 90 {
+		return c, errInvalidBody
+	} else if c.Longitude, err = strconv.ParseFloat(longitude, 64); err != nil || math.Abs(c.Longitude) > 180 {
+		return c, errInvalidBody
+	}
+	c.Located = true
+
+	return c, nil
+}
+
+// turn returns the ICE servers for a client, best first, and when their
+// credentials expire. The usernames name the client's account, followed by
+// user if not empty. Once the client's license has used up its TURN quota for
+// the month it returns errTURNQuotaExceeded instead.
+func turn(client geobalance.Client, user string) ([]iceServer, time.Time, error) {
+	if err := checkTURNQuota(client.LicenseID); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	servers, err := geobalance.Rank(client)
+	if err != nil {
+		log.Print(err)
+		return nil, time.Time{}, errInternal
+	}
+
+	ice, expiresAt := iceServers(servers, turnUser(client.AccountID, user))
+	return ice, expiresAt, nil
+}
+
+// iceServers signs credentials for servers, and returns them with when the
+// first of them expires. user is appended to the usernames, if not empty. The
+// embedded TURN server, if running, replaces servers.
+func iceServers(servers []geobalance.Server, user string) ([]iceServer, time.Time) {
+	expiresAt := time.Now().Add(turnCredentialTTL).Truncate(time.Second)
+
+	if embeddedTURN.url != "" {
+		username, password, expiresAt := signTURN(embeddedTURNSecretEnv, embeddedTURN.key, user, expiresAt)
+		return []iceServer{{URLs: []string{embeddedTURN.url}, Username: username, Credential: password}}, expiresAt
+	}
+
+	var ice []iceServer
+	signedUntil := expiresAt
+	for _, server := range servers {
+		username, password, serverExpiresAt := signTURN(server.SecretEnv, server.Secret, user, expiresAt)
+		if serverExpiresAt.Before(signedUntil) {
+			signedUntil = serverExpiresAt
+		}
+		ice = append(ice, iceServer{
+			URLs:       server.ICEURLs(),
+			Username:   username,
+			Credential: password,
+		})
+	}
+
+	return ice, signedUntil
+}
+
+// legacyTURNCredentials converts ICE servers to the format clients used
+// before iceServers: one "turn:" URL per server, leaving the transport to the
+// client.
+func legacyTURNCredentials(servers []iceServer) []turnCredentials {
+	creds := []turnCredentials{}
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			if strings.HasPrefix(url, "turn:") {
+				creds = append(creds, turnCredentials{
+					URL:      strings.SplitN(url, "?", 2)[0],
+					Username: server.Username,
+					Password: server.Credential,
+				})
+				break
+			}
+		}
+	}
+	return creds
+}
+
+// refreshTURN hands out fresh TURN credentials. With ?service=turn it answers
+// like a TURN REST API server, adding the username parameter to the user id.
+func refreshTURN(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	query := r.URL.Query()
+	service := query.Get("service")
+	if service != "" && service != "turn" {
+		return nil, errInvalidBody
+	}
+
+	user := query.Get("username")
+	if len(user) > 64 {
+		return nil, errInvalidBody
+	}
+
+	client, err := routeClient(acc, r)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, expiresAt, err := turn(client, user)
+	if err != nil {
+		return nil, err
+	}
+	if service == "" {
+		return turnResponse{
+			IceServers:      servers,
+			TurnCredentials: legacyTURNCredentials(servers),
+			ExpiresAt:       expiresAt,
+		}, nil
+	}
+
+	// The TURN REST API has one set of credentials, so only the primary
+	// server fits.
+	if len(servers) == 0 {
+		log.Print("No TURN servers to answer a TURN REST API request with")
+		return nil, errInternal
+	}
+	return turnRESTResponse{
+		Username: servers[0].Username,
+		Password: servers[0].Credential,
+		TTL:      int(time.Until(expiresAt) / time.Second),
+		URIs:     servers[0].URLs,
+	}, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"server/lib/turncred"
+)
+
+func TestLocate(t *testing.T) {
+	req := &http.Request{
+		URL: &url.URL{},
+		Header: map[string][]string{
+			"Cf-Ipcountry":   {"US"},
+			"Cf-Region-Code": {"NY"},
+			"Cf-Iplatitude":  {"40.71"},
+			"Cf-Iplongitude": {"-74.01"},
+		},
+	}
+	if c, err := locate(account{}, req); err != nil || c.CountryCode != "US" || c.Subdivision != "US-NY" || !c.Located || c.Latitude != 40.71 || c.Longitude != -74.01 {
+		t.Errorf("got %+v, %v", c, err)
+	}
+
+	// Coordinates from the client win.
+	req.URL, _ = url.Parse("/account/start?latitude=42.36&longitude=-71.06")
+	if c, err := locate(account{}, req); err != nil || c.Latitude != 42.36 || c.Longitude != -71.06 {
+		t.Errorf("got %+v, %v", c, err)
+	}
+
+	req.URL, _ = url.Parse("/account/start?latitude=91&longitude=0")
+	if _, err := locate(account{}, req); err != errInvalidBody {
+		t.Errorf("accepted a latitude out of range: %v", err)
+	}
+
+	if c, err := locate(account{}, &http.Request{URL: &url.URL{}}); err != nil || c.CountryCode != "unknown" || c.Located {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(trusted bool) { trustProxy = trusted }(trustProxy)
+	trustProxy = true
+
+	req := &http.Request{
+		RemoteAddr: "10.0.0.1:54321",
+		Header: map[string][]string{
+			"X-Forwarded-For": {"6.6.6.6, 203.0.113.7"},
+		},
+	}
+	if ip := clientIP(req); !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("got %v", ip)
+	}
+
+	// Only Cloudflare is trusted with CF-Connecting-IP.
+	req.Header.Set("CF-Connecting-IP", "198.51.100.4")
+	if ip := clientIP(req); !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("spoofed CF-Connecting-IP trusted: got %v", ip)
+	}
+
+	// Behind Cloudflare, the router was connected to from an edge.
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 172.70.1.2")
+	if ip := clientIP(req); !ip.Equal(net.ParseIP("198.51.100.4")) {
+		t.Errorf("got %v", ip)
+	}
+	req.Header.Del("CF-Connecting-IP")
+
+	req.Header.Del("X-Forwarded-For")
+	if ip := clientIP(req); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got %v", ip)
+	}
+
+	// Without a trusted proxy, X-Forwarded-For could come from anyone.
+	trustProxy = false
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if ip := clientIP(req); !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("spoofed X-Forwarded-For trusted: got %v", ip)
+	}
+}
+
+func TestSignTURN(t *testing.T) {
+	defer setTURNSecrets(nil)
+	setTURNSecrets(map[string]turncred.Keyring{
+		"TURN_FRA_KEY": {
+			{ID: "v1", Secret: "oldkey", RetiresAt: time.Now().Add(time.Hour)},
+			{ID: "v2", Secret: "newkey", ActivatesAt: time.Now().Add(-time.Minute)},
+		},
+	})
+	expiresAt := time.Now().Add(turnCredentialTTL).Truncate(time.Second)
+
+	username, password, signedUntil := signTURN("TURN_FRA_KEY", "envkey", "alice", expiresAt)
+	if !strings.HasSuffix(username, ":v2:alice") || password != turncred.Password("newkey", username) || !signedUntil.Equal(expiresAt) {
+		t.Errorf("got %q %q %v", username, password, signedUntil)
+	}
+
+	// Secrets without versions are used as they are.
+	username, password, _ = signTURN("TURN_SFO_KEY", "envkey", "alice", expiresAt)
+	if strings.Contains(username, ":v") || password != turncred.Password("envkey", username) {
+		t.Errorf("got %q %q", username, password)
+	}
+}
+
+func TestTurnUserAccount(t *testing.T) {
+	for username, expected := range map[string]int{
+		"1600000000:42":          42,
+		"1600000000:v2:42":       42,
+		"1600000000:v2:42/alice": 42,
+		"1600000000:alice":       0,
+		"1600000000":             0,
+	} {
+		if id, ok := turnUserAccount(username); id != expected || ok != (expected != 0) {
+			t.Errorf("%v: got %v, %v", username, id, ok)
+		}
+	}
+
+	if user := turnUser(42, "alice"); user != "42/alice" {
+		t.Errorf("got %q", user)
+	}
+}
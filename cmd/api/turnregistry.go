@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"server/lib/geobalance"
+
+	"github.com/lib/pq"
+)
+
+// How often the TURN server registry is reloaded, so servers can be added,
+// reweighted and disabled without a redeploy.
+const turnRegistryReloadInterval = time.Minute
+
+// loadTURNRegistry loads the TURN server registry named by TURN_REGISTRY,
+// which is either "postgres" for the turn_regions, turn_servers and
+// routing_overrides tables or the path of a JSON file. Without it,
+// geobalance's built-in registry is used.
+func loadTURNRegistry() {
+	source := os.Getenv("TURN_REGISTRY")
+	if source == "" {
+		return
+	}
+
+	load := func() (*geobalance.Registry, error) {
+		if source == "postgres" {
+			return findTURNRegistry()
+		}
+		return geobalance.LoadFile(source)
+	}
+
+	registry, err := load()
+	if err != nil {
+		log.Panic(err)
+	}
+	geobalance.SetRegistry(registry)
+
+	go func() {
+		for range time.Tick(turnRegistryReloadInterval) {
+			// Keep the last good registry if this one is broken.
+			if registry, err := load(); err != nil {
+				log.Printf("Failed to reload the TURN registry: %v", err)
+			} else {
+				geobalance.SetRegistry(registry)
+			}
+		}
+	}()
+}
+
+func findTURNRegistry() (*geobalance.Registry, error) {
+	var regions []geobalance.Region
+	rows, err := dbGlobal.Query(findTURNRegionsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var region geobalance.Region
+		if err := rows.Scan(&region.ID, (*pq.StringArray)(&region.Continents), (*pq.StringArray)(&region.Subdivisions), &region.Default, &region.Latitude, &region.Longitude); err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var servers []geobalance.Server
+	rows, err = dbGlobal.Query(findTURNServersQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var server geobalance.Server
+		if err := rows.Scan(&server.ID, (*pq.StringArray)(&server.URLs), (*pq.StringArray)(&server.Transports), &server.Region, &server.SecretEnv, &server.Weight, &server.Enabled); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var overrides []geobalance.Override
+	rows, err = dbGlobal.Query(findRoutingOverridesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var override geobalance.Override
+		if err := rows.Scan(&override.CountryCode, &override.AccountID, &override.LicenseID, &override.Region); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, override)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return geobalance.NewRegistry(regions, servers, overrides...)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"server/lib/turncred"
+)
+
+// How often the versions of TURN secrets are reloaded. New versions should
+// activate at least this long after they're added, so every instance knows
+// them before credentials are signed with them.
+const turnSecretsReloadInterval = time.Minute
+
+// turnSecrets are the versions of each TURN secret in the turn_secrets table,
+// by the environment variable servers name their secret with.
+var turnSecrets struct {
+	sync.RWMutex
+	keyrings map[string]turncred.Keyring
+}
+
+// loadTURNSecrets loads the versions of TURN secrets, and reloads them in the
+// background so versions can be added and retired without a redeploy.
+func loadTURNSecrets() {
+	keyrings, err := findTURNSecrets()
+	if err != nil {
+		log.Panic(err)
+	}
+	setTURNSecrets(keyrings)
+
+	go func() {
+		for range time.Tick(turnSecretsReloadInterval) {
+			// Keep the last good versions if the database is unreachable.
+			if keyrings, err := findTURNSecrets(); err != nil {
+				log.Printf("Failed to reload the TURN secrets: %v", err)
+			} else {
+				setTURNSecrets(keyrings)
+			}
+		}
+	}()
+}
+
+func setTURNSecrets(keyrings map[string]turncred.Keyring) {
+	turnSecrets.Lock()
+	turnSecrets.keyrings = keyrings
+	turnSecrets.Unlock()
+}
+
+// turnKeyring returns the versions of a TURN secret.
+func turnKeyring(secretEnv string) turncred.Keyring {
+	turnSecrets.RLock()
+	defer turnSecrets.RUnlock()
+	return turnSecrets.keyrings[secretEnv]
+}
+
+// signTURN returns credentials for a TURN server whose secret is named by
+// secretEnv, and when they expire. They're signed with the secret's current
+// version or, if it has none, with secret itself.
+func signTURN(secretEnv, secret, user string, expiresAt time.Time) (string, string, time.Time) {
+	if key, ok := turnKeyring(secretEnv).Current(time.Now()); ok {
+		return turncred.NewWithKey(key, user, expiresAt)
+	}
+
+	username, password := turncred.New(secret, user, expiresAt)
+	return username, password, expiresAt
+}
+
+func findTURNSecrets() (map[string]turncred.Keyring, error) {
+	rows, err := dbGlobal.Query(findTURNSecretsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keyrings := make(map[string]turncred.Keyring)
+	for rows.Next() {
+		var (
+			secretEnv string
+			version   int
+			key       turncred.Key
+			retiresAt sql.NullTime
+		)
+		if err := rows.Scan(&secretEnv, &version, &key.Secret, &key.ActivatesAt, &retiresAt); err != nil {
+			return nil, err
+		}
+		key.ID = turncred.KeyID(version)
+		if retiresAt.Valid {
+			key.RetiresAt = retiresAt.Time
+		}
+		keyrings[secretEnv] = append(keyrings[secretEnv], key)
+	}
+
+	return keyrings, rows.Err()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/lib/turncred"
+	"server/lib/turnserver"
+)
+
+// TURN credentials name the account they were issued to: the user id in
+// their usernames is the account id, followed by a slash and whatever user id
+// the client asked for, if any. TURN servers report how much each username
+// relayed, which adds up to a monthly total per account that licenses may
+// put a quota on.
+
+// How many allocations a usage report may cover.
+const maxTURNUsageReports = 1000
+
+// How long report ids are remembered, for TURN servers retrying reports.
+const turnUsageReportTTL = 24 * time.Hour
+
+type turnUsage struct {
+	Username string `json:"username"`
+	Bytes    int64  `json:"bytes"`
+	Seconds  int64  `json:"seconds"`
+}
+
+type turnUsageRequest struct {
+	// ReportID, if set, makes sure the report is only counted once, however
+	// many times it's sent.
+	ReportID string      `json:"reportId"`
+	Usage    []turnUsage `json:"usage"`
+}
+
+type turnUsageResponse struct {
+	// Recorded is how many of the reported allocations were counted. The
+	// rest had usernames that don't name an account.
+	Recorded int `json:"recorded"`
+}
+
+// turnUser returns the user id TURN credentials issued to an account carry.
+func turnUser(accountID int, user string) string {
+	if user == "" {
+		return strconv.Itoa(accountID)
+	}
+	return strconv.Itoa(accountID) + "/" + user
+}
+
+// turnUserAccount returns the account a TURN username was issued to.
+func turnUserAccount(username string) (int, bool) {
+	_, user, err := turncred.Parse(username)
+	if err != nil {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(strings.SplitN(user, "/", 2)[0])
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// checkTURNQuota returns errTURNQuotaExceeded if a license's accounts have
+// used up its TURN quota for the month.
+func checkTURNQuota(licenseID int) error {
+	var quotaBytes, quotaSeconds sql.NullInt64
+	var bytes, seconds int64
+	row := dbGlobal.QueryRow(findTURNQuotaQuery, licenseID)
+	if err := row.Scan(&quotaBytes, &quotaSeconds, &bytes, &seconds); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Print(err)
+		return errInternal
+	}
+
+	if (quotaBytes.Valid && bytes >= quotaBytes.Int64) || (quotaSeconds.Valid && seconds >= quotaSeconds.Int64) {
+		return errTURNQuotaExceeded
+	}
+	return nil
+}
+
+// turnServerAuth lets through requests from TURN servers, which carry the
+// TURN_USAGE_TOKEN as a bearer token. Without one set, nothing gets through.
+func turnServerAuth(f internalHandler) internalHandler {
+	return func(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+		expected := os.Getenv("TURN_USAGE_TOKEN")
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			return nil, errInvalidCredentials
+		}
+
+		return f(acc, w, r)
+	}
+}
+
+// reportTURNUsage records what TURN servers relayed, per allocation.
+func reportTURNUsage(acc account, w http.ResponseWriter, r *http.Request) (response, error) {
+	var req turnUsageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errInvalidBody
+	}
+
+	if len(req.ReportID) > 64 || len(req.Usage) == 0 || len(req.Usage) > maxTURNUsageReports {
+		return nil, errInvalidBody
+	}
+	for _, u := range req.Usage {
+		if u.Bytes < 0 || u.Seconds < 0 {
+			return nil, errInvalidBody
+		}
+	}
+
+	recorded, err := recordTURNUsage(req.ReportID, req.Usage)
+	if err != nil {
+		return nil, err
+	}
+	return turnUsageResponse{Recorded: recorded}, nil
+}
+
+// recordTURNUsage adds allocations to their accounts' monthly totals, and
+// returns how many it counted. A report with an id that was recorded before
+// isn't counted again, so TURN servers can retry reports that seemed to fail.
+func recordTURNUsage(reportID string, usage []turnUsage) (int, error) {
+	tx, err := dbGlobal.Begin()
+	if err != nil {
+		log.Print(err)
+		return 0, errInternal
+	}
+	defer tx.Rollback()
+
+	if reportID != "" {
+		// A report being recorded by another request holds this up until
+		// it's done.
+		res, err := tx.Exec(createTURNUsageReportQuery, reportID, time.Now().Add(-turnUsageReportTTL))
+		if err != nil {
+			log.Print(err)
+			return 0, errInternal
+		} else if n, err := res.RowsAffected(); err != nil {
+			log.Print(err)
+			return 0, errInternal
+		} else if n == 0 {
+			var recorded int
+			if err := tx.QueryRow(findTURNUsageReportQuery, reportID).Scan(&recorded); err != nil {
+				log.Print(err)
+				return 0, errInternal
+			}
+			return recorded, nil
+		}
+	}
+
+	recorded := 0
+	for _, u := range usage {
+		id, ok := turnUserAccount(u.Username)
+		if !ok {
+			continue
+		}
+
+		res, err := tx.Exec(reportTURNUsageQuery, id, u.Bytes, u.Seconds)
+		if err != nil {
+			log.Print(err)
+			return 0, errInternal
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			recorded++
+		}
+	}
+
+	if reportID != "" {
+		if _, err := tx.Exec(recordTURNUsageReportQuery, reportID, recorded); err != nil {
+			log.Print(err)
+			return 0, errInternal
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return 0, errInternal
+	}
+
+	return recorded, nil
+}
+
+// reportEmbeddedTURNUsage records what the embedded TURN server relayed.
+func reportEmbeddedTURNUsage(reportID string, usage []turnserver.Usage) error {
+	reports := make([]turnUsage, len(usage))
+	for i, u := range usage {
+		reports[i] = turnUsage(u)
+	}
+	_, err := recordTURNUsage(reportID, reports)
+	return err
+}
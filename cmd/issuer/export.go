@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"server/lib/export"
+)
+
+const exportUsage = `Usage:
+  issuer export -account 42 > account-42.json
+
+Prints everything stored about an account as JSON, with its secrets redacted,
+the same as the account gets from /account/export.`
+
+// exportAccount answers a data access request that didn't come through the
+// app.
+func exportAccount(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	accountID := flags.Int("account", 0, "id of the account to export")
+	flags.Parse(args)
+
+	if *accountID <= 0 {
+		log.Fatal(exportUsage)
+	}
+
+	e, err := export.Build(dbGlobal, *accountID)
+	if err == export.ErrNoAccount {
+		log.Fatalf("No account %v", *accountID)
+	} else if err != nil {
+		log.Panic(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(e); err != nil {
+		log.Panic(err)
+	}
+}
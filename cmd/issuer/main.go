@@ -39,6 +39,19 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "turn-secret" {
+		turnSecret(os.Args[2:])
+	} else if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportAccount(os.Args[2:])
+	} else {
+		issueLicense()
+	}
+
+	dbGlobal.Close()
+}
+
+// issueLicense creates a license.
+func issueLicense() {
 	max := flag.Int("max", 10, "maximum number of activations for this license")
 	flag.Parse()
 
@@ -71,6 +84,4 @@ func main() {
 	if err != nil {
 		log.Panic(err)
 	}
-
-	dbGlobal.Close()
 }
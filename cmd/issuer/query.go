@@ -1,3 +1,11 @@
 package main
 
 const issueQuery = "INSERT INTO license_keys(max_activations) VALUES ($1) RETURNING license, max_activations, revoked;"
+
+const addTURNSecretQuery = "INSERT INTO turn_secrets(secret_env, version, secret, activates_at) SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3 FROM turn_secrets WHERE secret_env = $1 RETURNING version;"
+
+const retireTURNSecretQuery = "UPDATE turn_secrets SET retires_at = $3 WHERE secret_env = $1 AND version = $2;"
+
+const countOtherTURNSecretsQuery = "SELECT COUNT(*) FROM turn_secrets WHERE secret_env = $1 AND version <> $2 AND activates_at <= $3 AND (retires_at IS NULL OR retires_at > $3);"
+
+const listTURNSecretsQuery = "SELECT secret_env, version, activates_at, retires_at FROM turn_secrets WHERE $1 = '' OR secret_env = $1 ORDER BY secret_env, version;"
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+const turnSecretUsage = `Usage:
+  issuer turn-secret add -env TURN_FRA_KEY [-secret secret] [-activate-in 10m]
+  issuer turn-secret retire -env TURN_FRA_KEY -version 1 [-in 12h] [-force]
+  issuer turn-secret list [-env TURN_FRA_KEY]
+
+Rotating a secret takes three steps. Add a version, which is printed so it
+can be put on the TURN servers before it activates. Once it has activated,
+retire the previous version no sooner than TURN_CREDENTIAL_TTL later, so the
+credentials signed with it have expired. To start using versions for a secret
+only set in the environment, add it first with -secret and -activate-in 0.`
+
+// turnSecret adds, retires and lists versions of TURN secrets. The api picks
+// changes up within a minute, so none of this needs a redeploy.
+func turnSecret(args []string) {
+	if len(args) == 0 {
+		log.Fatal(turnSecretUsage)
+	}
+
+	flags := flag.NewFlagSet("turn-secret "+args[0], flag.ExitOnError)
+	secretEnv := flags.String("env", "", "environment variable the TURN servers name the secret with")
+
+	switch args[0] {
+	case "add":
+		secret := flags.String("secret", "", "the new version; random if empty")
+		activateIn := flags.Duration("activate-in", 10*time.Minute, "how long until credentials are signed with the new version")
+		flags.Parse(args[1:])
+		requireSecretEnv(*secretEnv)
+
+		if *secret == "" {
+			*secret = randomSecret()
+		}
+		activatesAt := time.Now().Add(*activateIn)
+
+		var version int
+		if err := dbGlobal.QueryRow(addTURNSecretQuery, *secretEnv, *secret, activatesAt).Scan(&version); err != nil {
+			log.Panic(err)
+		}
+		log.Printf("Added version %v of %v, activating at %v: %v", version, *secretEnv, activatesAt.Format(time.RFC3339), *secret)
+
+	case "retire":
+		version := flags.Int("version", 0, "the version to retire")
+		in := flags.Duration("in", 12*time.Hour, "how long until credentials signed with the version stop working")
+		force := flags.Bool("force", false, "retire the version even if no other is active by then")
+		flags.Parse(args[1:])
+		requireSecretEnv(*secretEnv)
+
+		retiresAt := time.Now().Add(*in)
+
+		// Retiring the only active version would leave the api signing
+		// credentials with the unversioned secret, if there still is one.
+		var others int
+		if err := dbGlobal.QueryRow(countOtherTURNSecretsQuery, *secretEnv, *version, retiresAt).Scan(&others); err != nil {
+			log.Panic(err)
+		} else if others == 0 && !*force {
+			log.Fatalf("No other version of %v is active by %v; add one first or use -force", *secretEnv, retiresAt.Format(time.RFC3339))
+		}
+
+		res, err := dbGlobal.Exec(retireTURNSecretQuery, *secretEnv, *version, retiresAt)
+		if err != nil {
+			log.Panic(err)
+		} else if n, err := res.RowsAffected(); err != nil {
+			log.Panic(err)
+		} else if n == 0 {
+			log.Fatalf("No version %v of %v", *version, *secretEnv)
+		}
+		log.Printf("Retiring version %v of %v at %v", *version, *secretEnv, retiresAt.Format(time.RFC3339))
+
+	case "list":
+		flags.Parse(args[1:])
+
+		rows, err := dbGlobal.Query(listTURNSecretsQuery, *secretEnv)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				env         string
+				version     int
+				activatesAt time.Time
+				retiresAt   sql.NullTime
+			)
+			if err := rows.Scan(&env, &version, &activatesAt, &retiresAt); err != nil {
+				log.Panic(err)
+			}
+
+			retires := "never"
+			if retiresAt.Valid {
+				retires = retiresAt.Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%v\tv%v\tactivates %v\tretires %v\n", env, version, activatesAt.Format(time.RFC3339), retires)
+		}
+		if err := rows.Err(); err != nil {
+			log.Panic(err)
+		}
+
+	default:
+		log.Fatal(turnSecretUsage)
+	}
+}
+
+func requireSecretEnv(secretEnv string) {
+	if secretEnv == "" {
+		log.Fatal(turnSecretUsage)
+	}
+}
+
+// randomSecret returns 32 random bytes, base64 encoded.
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
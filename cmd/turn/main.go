@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"server/lib/turncred"
+	"server/lib/turnserver"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	udp := flag.String("udp", "0.0.0.0:3478", "comma-separated UDP addresses to listen on")
+	tcp := flag.String("tcp", "", "comma-separated TCP addresses to listen on")
+	relayIP := flag.String("relay-ip", "", "public IP address relayed candidates are advertised with")
+	relayBind := flag.String("relay-bind", "0.0.0.0", "local address relays are bound to")
+	relayPorts := flag.String("relay-ports", "", "port range relays are allocated on, such as 49152-65535")
+	realm := flag.String("realm", turnserver.DefaultRealm, "realm of the server")
+	secretEnv := flag.String("secret-env", "TURN_SECRET", "environment variable holding the shared secret")
+	keysFile := flag.String("keys-file", "", "file of versions of the shared secret, such as v1=secret,v2=secret, reread every minute")
+	usageURL := flag.String("usage-url", "", "URL of the api's /turn/usage endpoint to report what allocations relayed to, with TURN_USAGE_TOKEN")
+	flag.Parse()
+
+	ip := net.ParseIP(*relayIP)
+	if ip == nil {
+		log.Fatalf("Invalid relay IP %q", *relayIP)
+	}
+
+	minPort, maxPort, err := turnserver.ParsePortRange(*relayPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := turnserver.Start(turnserver.Config{
+		UDPAddrs:         turnserver.ParseAddrs(*udp),
+		TCPAddrs:         turnserver.ParseAddrs(*tcp),
+		RelayIP:          ip,
+		RelayBindAddress: *relayBind,
+		MinPort:          minPort,
+		MaxPort:          maxPort,
+		Realm:            *realm,
+		Secret:           os.Getenv(*secretEnv),
+		Keys:             loadKeys(*keysFile),
+		ReportUsage:      usageReporter(*usageURL, os.Getenv("TURN_USAGE_TOKEN")),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Serve until told to stop.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if err := server.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// How often the keys file is reread.
+const keysReloadInterval = time.Minute
+
+// loadKeys reads the versions of the shared secret in a file, and rereads it
+// in the background so versions can be added and retired without a restart.
+// It returns nil without a file.
+func loadKeys(path string) func() turncred.Keyring {
+	if path == "" {
+		return nil
+	}
+
+	read := func() (turncred.Keyring, error) {
+		list, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return turncred.ParseKeyring(strings.Replace(string(list), "\n", ",", -1))
+	}
+
+	keys, err := read()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var mutex sync.RWMutex
+	go func() {
+		for range time.Tick(keysReloadInterval) {
+			// Keep the last good keys if the file is broken.
+			if reread, err := read(); err != nil {
+				log.Printf("Failed to reread the keys file: %v", err)
+			} else {
+				mutex.Lock()
+				keys = reread
+				mutex.Unlock()
+			}
+		}
+	}()
+
+	return func() turncred.Keyring {
+		mutex.RLock()
+		defer mutex.RUnlock()
+		return keys
+	}
+}
+
+// usageReportTimeout is how long the api gets to answer a usage report.
+const usageReportTimeout = 10 * time.Second
+
+// usageReporter returns a function that posts usage reports to the api, or nil
+// without a URL.
+func usageReporter(url, token string) func(string, []turnserver.Usage) error {
+	if url == "" {
+		return nil
+	} else if token == "" {
+		log.Fatal("No TURN_USAGE_TOKEN to report usage with")
+	}
+
+	client := &http.Client{Timeout: usageReportTimeout}
+	return func(reportID string, usage []turnserver.Usage) error {
+		body, err := json.Marshal(struct {
+			ReportID string             `json:"reportId"`
+			Usage    []turnserver.Usage `json:"usage"`
+		}{reportID, usage})
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("usage report answered with %v", res.Status)
+		}
+		return nil
+	}
+}
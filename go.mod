@@ -1,13 +1,22 @@
 module server
 
-// +heroku goVersion go1.14
-go 1.14
+// +heroku goVersion go1.20
+go 1.20
 
-// +heroku install ./cmd/issuer ./cmd/api
+// +heroku install ./cmd/issuer ./cmd/api ./cmd/turn
 
 require (
 	github.com/golang-migrate/migrate/v4 v4.14.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/lib/pq v1.9.0
+	github.com/pion/stun v0.3.5
 	github.com/pion/turn/v2 v2.0.5
 )
+
+require (
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.0 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/transport v0.10.1 // indirect
+)
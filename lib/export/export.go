@@ -0,0 +1,309 @@
+// Package export gathers everything stored about an account, for answering
+// data access requests. The api serves it to the account itself and the issuer
+// prints it for an operator, so both give the same answer.
+package export
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Redacted replaces secrets, which are stored about an account but would let
+// whoever holds the export act as it.
+const Redacted = "[redacted]"
+
+// ErrNoAccount is returned when there is no account to export.
+var ErrNoAccount = errors.New("export: no such account")
+
+// Export is everything stored about an account. The server keeps no call
+// history: calls only pass through the relay, and only leave TURN usage totals
+// behind.
+type Export struct {
+	ExportedAt      time.Time        `json:"exportedAt"`
+	Account         Account          `json:"account"`
+	License         License          `json:"license"`
+	InviteLinks     []InviteLink     `json:"inviteLinks"`
+	Contacts        []Contact        `json:"contacts"`
+	Sessions        []Session        `json:"sessions"`
+	PublicKeys      []PublicKey      `json:"publicKeys"`
+	PushTokens      []PushToken      `json:"pushTokens"`
+	RTTMeasurements []RTTMeasurement `json:"rttMeasurements"`
+	// Location is where the account was last seen, for picking TURN servers
+	// for its calls.
+	Location         *Location         `json:"location"`
+	TURNUsage        []TURNUsage       `json:"turnUsage"`
+	RoutingOverrides []RoutingOverride `json:"routingOverrides"`
+}
+
+// Account is the account's profile.
+type Account struct {
+	ID   int    `json:"accountId"`
+	Code string `json:"code"`
+	// CodeRevokedAt is when the account revoked its code, if it did.
+	CodeRevokedAt *time.Time `json:"codeRevokedAt"`
+	FirstName     string     `json:"firstName"`
+	LastName      string     `json:"lastName"`
+	// Token is set, redacted, if the account still has a token from before
+	// sessions that the api hasn't hashed yet.
+	Token         string    `json:"token,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// License is the license the account was created with. Its key is shared by
+// every account on it, so it's redacted.
+type License struct {
+	ID               int       `json:"licenseId"`
+	Key              string    `json:"key"`
+	MaxActivations   int       `json:"maxActivations"`
+	Revoked          bool      `json:"revoked"`
+	TURNQuotaBytes   *int64    `json:"turnQuotaBytes"`
+	TURNQuotaSeconds *int64    `json:"turnQuotaSeconds"`
+	CreatedAt        time.Time `json:"createdAt"`
+	LastUpdatedAt    time.Time `json:"lastUpdatedAt"`
+}
+
+// InviteLink is a link the account made besides its code.
+type InviteLink struct {
+	ID            int        `json:"linkId"`
+	Code          string     `json:"code"`
+	Label         string     `json:"label"`
+	MaxUses       *int       `json:"maxUses"`
+	Uses          int        `json:"uses"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	RevokedAt     *time.Time `json:"revokedAt"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	LastUpdatedAt time.Time  `json:"lastUpdatedAt"`
+}
+
+// Contact is an account this one looked up by code, or that looked it up.
+type Contact struct {
+	AccountID int `json:"accountId"`
+	// LookedUp is whether this account did the looking up.
+	LookedUp  bool      `json:"lookedUp"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Session is a device signed in to the account.
+type Session struct {
+	ID            int       `json:"sessionId"`
+	DeviceName    string    `json:"deviceName"`
+	IP            string    `json:"ip"`
+	TokenHash     string    `json:"tokenHash"`
+	LastUsedAt    time.Time `json:"lastUsedAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// PublicKey is the public key of one of the account's devices.
+type PublicKey struct {
+	DeviceID      string    `json:"deviceId"`
+	PublicKey     string    `json:"publicKey"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// PushToken is a device registered for push notifications.
+type PushToken struct {
+	Platform      string    `json:"platform"`
+	Token         string    `json:"token"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// RTTMeasurement is the round-trip time the account measured to a TURN
+// region from a network.
+type RTTMeasurement struct {
+	Network       string    `json:"network"`
+	Region        string    `json:"region"`
+	RTTMs         int       `json:"rttMs"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// Location is where an account was last seen and the network it was on.
+type Location struct {
+	CountryCode   string    `json:"countryCode"`
+	Subdivision   string    `json:"subdivision"`
+	Latitude      *float64  `json:"latitude"`
+	Longitude     *float64  `json:"longitude"`
+	IP            string    `json:"ip"`
+	Network       string    `json:"network"`
+	SeenAt        time.Time `json:"seenAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// TURNUsage is how much the account relayed through TURN servers in a month.
+type TURNUsage struct {
+	Month         string    `json:"month"`
+	Bytes         int64     `json:"bytes"`
+	Seconds       int64     `json:"seconds"`
+	Allocations   int       `json:"allocations"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// RoutingOverride is a TURN region the account was pinned to by an operator.
+type RoutingOverride struct {
+	Region        string    `json:"region"`
+	Note          string    `json:"note"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastUpdatedAt time.Time `json:"lastUpdatedAt"`
+}
+
+// Build exports an account. It reads everything in one read-only transaction,
+// so the parts agree with each other.
+func Build(db *sql.DB, accountID int) (Export, error) {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Export{}, err
+	}
+	defer tx.Rollback()
+
+	e := Export{
+		ExportedAt:       time.Now().UTC(),
+		InviteLinks:      []InviteLink{},
+		Contacts:         []Contact{},
+		Sessions:         []Session{},
+		PublicKeys:       []PublicKey{},
+		PushTokens:       []PushToken{},
+		RTTMeasurements:  []RTTMeasurement{},
+		TURNUsage:        []TURNUsage{},
+		RoutingOverrides: []RoutingOverride{},
+	}
+
+	var hasToken bool
+	if err := tx.QueryRow(accountQuery, accountID).Scan(&e.Account.ID, &e.Account.Code, &e.Account.CodeRevokedAt, &e.Account.FirstName, &e.Account.LastName, &hasToken, &e.Account.CreatedAt, &e.Account.LastUpdatedAt, &e.License.ID); err == sql.ErrNoRows {
+		return Export{}, ErrNoAccount
+	} else if err != nil {
+		return Export{}, err
+	}
+	if hasToken {
+		e.Account.Token = Redacted
+	}
+
+	e.License.Key = Redacted
+	if err := tx.QueryRow(licenseQuery, e.License.ID).Scan(&e.License.MaxActivations, &e.License.Revoked, &e.License.TURNQuotaBytes, &e.License.TURNQuotaSeconds, &e.License.CreatedAt, &e.License.LastUpdatedAt); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, inviteLinksQuery, accountID, func(rows *sql.Rows) error {
+		var l InviteLink
+		if err := rows.Scan(&l.ID, &l.Code, &l.Label, &l.MaxUses, &l.Uses, &l.ExpiresAt, &l.RevokedAt, &l.CreatedAt, &l.LastUpdatedAt); err != nil {
+			return err
+		}
+		e.InviteLinks = append(e.InviteLinks, l)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, contactsQuery, accountID, func(rows *sql.Rows) error {
+		var c Contact
+		if err := rows.Scan(&c.AccountID, &c.LookedUp, &c.CreatedAt); err != nil {
+			return err
+		}
+		e.Contacts = append(e.Contacts, c)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, sessionsQuery, accountID, func(rows *sql.Rows) error {
+		s := Session{TokenHash: Redacted}
+		if err := rows.Scan(&s.ID, &s.DeviceName, &s.IP, &s.LastUsedAt, &s.CreatedAt, &s.LastUpdatedAt); err != nil {
+			return err
+		}
+		e.Sessions = append(e.Sessions, s)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, publicKeysQuery, accountID, func(rows *sql.Rows) error {
+		var k PublicKey
+		if err := rows.Scan(&k.DeviceID, &k.PublicKey, &k.CreatedAt, &k.LastUpdatedAt); err != nil {
+			return err
+		}
+		e.PublicKeys = append(e.PublicKeys, k)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, pushTokensQuery, accountID, func(rows *sql.Rows) error {
+		p := PushToken{Token: Redacted}
+		if err := rows.Scan(&p.Platform, &p.CreatedAt, &p.LastUpdatedAt); err != nil {
+			return err
+		}
+		e.PushTokens = append(e.PushTokens, p)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, rttMeasurementsQuery, accountID, func(rows *sql.Rows) error {
+		var m RTTMeasurement
+		if err := rows.Scan(&m.Network, &m.Region, &m.RTTMs, &m.CreatedAt, &m.LastUpdatedAt); err != nil {
+			return err
+		}
+		e.RTTMeasurements = append(e.RTTMeasurements, m)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	var l Location
+	if err := tx.QueryRow(locationQuery, accountID).Scan(&l.CountryCode, &l.Subdivision, &l.Latitude, &l.Longitude, &l.IP, &l.Network, &l.SeenAt, &l.CreatedAt, &l.LastUpdatedAt); err == nil {
+		e.Location = &l
+	} else if err != sql.ErrNoRows {
+		return Export{}, err
+	}
+
+	if err := each(tx, turnUsageQuery, accountID, func(rows *sql.Rows) error {
+		var (
+			u     TURNUsage
+			month time.Time
+		)
+		if err := rows.Scan(&month, &u.Bytes, &u.Seconds, &u.Allocations, &u.CreatedAt, &u.LastUpdatedAt); err != nil {
+			return err
+		}
+		u.Month = month.Format("2006-01")
+		e.TURNUsage = append(e.TURNUsage, u)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	if err := each(tx, routingOverridesQuery, accountID, func(rows *sql.Rows) error {
+		var o RoutingOverride
+		if err := rows.Scan(&o.Region, &o.Note, &o.CreatedAt, &o.LastUpdatedAt); err != nil {
+			return err
+		}
+		e.RoutingOverrides = append(e.RoutingOverrides, o)
+		return nil
+	}); err != nil {
+		return Export{}, err
+	}
+
+	return e, nil
+}
+
+// each runs a query about an account and calls scan for every row.
+func each(tx *sql.Tx, query string, accountID int, scan func(rows *sql.Rows) error) error {
+	rows, err := tx.Query(query, accountID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,23 @@
+package export
+
+const accountQuery = "SELECT id, code, code_revoked_at, first_name, COALESCE(last_name, ''), token IS NOT NULL, created_at, last_updated_at, license_id FROM accounts WHERE id = $1;"
+
+const licenseQuery = "SELECT max_activations, revoked, turn_quota_bytes, turn_quota_seconds, created_at, last_updated_at FROM license_keys WHERE id = $1;"
+
+const inviteLinksQuery = "SELECT id, code, label, max_uses, uses, expires_at, revoked_at, created_at, last_updated_at FROM invite_links WHERE account_id = $1 ORDER BY created_at, id;"
+
+const contactsQuery = "SELECT contact_id, true, created_at FROM contacts WHERE account_id = $1 UNION ALL SELECT account_id, false, created_at FROM contacts WHERE contact_id = $1 ORDER BY 3, 1;"
+
+const sessionsQuery = "SELECT id, device_name, ip, last_used_at, created_at, last_updated_at FROM sessions WHERE account_id = $1 ORDER BY created_at, id;"
+
+const publicKeysQuery = "SELECT device_id, public_key, created_at, last_updated_at FROM public_keys WHERE account_id = $1 ORDER BY created_at, device_id;"
+
+const pushTokensQuery = "SELECT platform, created_at, last_updated_at FROM push_tokens WHERE account_id = $1 ORDER BY created_at;"
+
+const rttMeasurementsQuery = "SELECT network, region, rtt_ms, created_at, last_updated_at FROM rtt_measurements WHERE account_id = $1 ORDER BY network, region;"
+
+const locationQuery = "SELECT country_code, subdivision, latitude, longitude, ip, network, seen_at, created_at, last_updated_at FROM client_locations WHERE account_id = $1;"
+
+const turnUsageQuery = "SELECT month, bytes, seconds, allocations, created_at, last_updated_at FROM turn_usage WHERE account_id = $1 ORDER BY month;"
+
+const routingOverridesQuery = "SELECT region, note, created_at, last_updated_at FROM routing_overrides WHERE account_id = $1;"
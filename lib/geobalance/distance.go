@@ -0,0 +1,35 @@
+package geobalance
+
+import "math"
+
+// earthRadius is the mean radius of the Earth in kilometers.
+const earthRadius = 6371.0
+
+// distance returns the great-circle distance in kilometers between two points
+// given in degrees, using the haversine formula.
+func distance(lat1, long1, lat2, long2 float64) float64 {
+	const toRadians = math.Pi / 180
+	dLat := (lat2 - lat1) * toRadians
+	dLong := (long2 - long1) * toRadians
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRadians)*math.Cos(lat2*toRadians)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// midpoint returns the point halfway along the great circle between two
+// points, all in degrees.
+func midpoint(lat1, long1, lat2, long2 float64) (float64, float64) {
+	const toRadians = math.Pi / 180
+	lat1, long1 = lat1*toRadians, long1*toRadians
+	lat2, long2 = lat2*toRadians, long2*toRadians
+
+	bx := math.Cos(lat2) * math.Cos(long2-long1)
+	by := math.Cos(lat2) * math.Sin(long2-long1)
+	lat := math.Atan2(math.Sin(lat1)+math.Sin(lat2), math.Sqrt((math.Cos(lat1)+bx)*(math.Cos(lat1)+bx)+by*by))
+	long := long1 + math.Atan2(by, math.Cos(lat1)+bx)
+
+	// Normalize the longitude to [-180, 180).
+	long = math.Mod(long+3*math.Pi, 2*math.Pi) - math.Pi
+	return lat / toRadians, long / toRadians
+}
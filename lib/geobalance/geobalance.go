@@ -3,46 +3,14 @@ package geobalance
 import (
 	"encoding/json"
 	"log"
-	"os"
+	"net"
 	"strings"
+	"time"
 )
 
-type turnInfo struct {
-	url string
-	key string
-}
-
-const (
-	// FRA
-	fraURL = "turn:prod-turn-fra.airtap.dev:443"
-	fraEnv = "TURN_FRA_KEY"
-
-	// SFO
-	sfoURL = "turn:prod-turn-sfo.airtap.dev:443"
-	sfoEnv = "TURN_SFO_KEY"
-)
-
-// These maps do not need mutexes for access because they are read-only.
-var (
-	// Map country codes to continents.
-	countryMappings = make(map[string]country)
-	// Map continents to the respective TURN servers. Notice that the os.Getenv,
-	// which is a syscall, is only called once during initialization.
-	continentsToURL = map[string]turnInfo{
-		// FRA
-		"AS": {url: fraURL, key: os.Getenv(fraEnv)},
-		"EU": {url: fraURL, key: os.Getenv(fraEnv)},
-		"AF": {url: fraURL, key: os.Getenv(fraEnv)},
-
-		// SFO
-		"NA": {url: sfoURL, key: os.Getenv(sfoEnv)},
-		"SA": {url: sfoURL, key: os.Getenv(sfoEnv)},
-		"OC": {url: sfoURL, key: os.Getenv(sfoEnv)},
-	}
-
-	// Default server.
-	defaultInfo = turnInfo{url: fraURL, key: os.Getenv(fraEnv)}
-)
+// Map country codes to continents. This map does not need a mutex for access
+// because it is read-only.
+var countryMappings = make(map[string]country)
 
 type country struct {
 	ContinentCode    string `json:"Continent_Code,omitempty"`
@@ -66,26 +34,73 @@ func init() {
 	for _, country := range countries.Countries {
 		countryMappings[strings.ToLower(country.CountryCodeShort)] = country
 	}
+
+	SetRegistry(defaultRegistry())
 }
 
-// Balance takes a country code (2 letters as per ISO 3166-1 alpha-2) and
-// returns the URL of the TURN server and the key with which the password for
-// the server should be signed.
-func Balance(countryCode string) (string, string) {
-	// Treat Russia as North America because Ilya is in Russia and wants to test
-	// the US servers. :)
-	if strings.ToLower(countryCode) == "ru" {
-		if info, ok := continentsToURL["NA"]; ok {
-			return info.url, info.key
-		}
-	}
+// Client is what is known about a client: where it is and, for overrides,
+// who.
+type Client struct {
+	// CountryCode has 2 letters, as per ISO 3166-1 alpha-2.
+	CountryCode string
+	// Subdivision is an ISO 3166-2 code such as "US-NY".
+	Subdivision string
+	// Latitude and Longitude are in degrees, if Located.
+	Latitude  float64
+	Longitude float64
+	Located   bool
+	// IP is the client's address. If CountryCode is empty or "unknown", the
+	// client is looked up in the GeoIP table, if there is one.
+	IP net.IP
+
+	AccountID int
+	LicenseID int
+
+	// RTTs are round-trip times the client measured to regions, by region id.
+	RTTs map[string]time.Duration
+}
+
+// Rank is like (*Registry).Rank, over the current registry.
+func Rank(c Client) ([]Server, error) {
+	r := currentRegistry()
+	return r.rank(r.order(currentGeoIP().locate(c)), Healthy)
+}
+
+// Rank returns the TURN server closest to a client, followed by fallbacks
+// from other regions, next-closest first.
+func (r *Registry) Rank(c Client) ([]Server, error) {
+	return r.rank(r.order(c), nil)
+}
+
+// RankPair is like (*Registry).RankPair, over the current registry.
+func RankPair(a, b Client) ([]Server, error) {
+	r, g := currentRegistry(), currentGeoIP()
+	return r.rank(r.pairOrder(g.locate(a), g.locate(b)), Healthy)
+}
+
+// RankPair is like Rank, but for a call between two clients: both get the
+// same servers, whichever of them asks.
+func (r *Registry) RankPair(a, b Client) ([]Server, error) {
+	return r.rank(r.pairOrder(a, b), nil)
+}
+
+// Find returns a server of the current registry by id, if it's enabled.
+func Find(id string) (Server, bool) {
+	return currentRegistry().find(id)
+}
+
+// ProbeTargets returns a healthy server from each region of the current
+// registry, for clients to measure round-trip times to.
+func ProbeTargets() []Server {
+	return currentRegistry().probeTargets(Healthy)
+}
 
+// continent returns the continent code of a country, or "" if unknown.
+func continent(countryCode string) string {
 	if countryInfo, ok := countryMappings[strings.ToLower(countryCode)]; ok {
-		if info, ok := continentsToURL[strings.ToUpper(countryInfo.ContinentCode)]; ok {
-			return info.url, info.key
-		}
+		return countryInfo.ContinentCode
 	}
 
 	log.Printf("Geomapping not found for country code %v", countryCode)
-	return defaultInfo.url, defaultInfo.key
+	return ""
 }
@@ -3,7 +3,7 @@ package geobalance
 import "testing"
 
 func TestBalance(t *testing.T) {
-	if url, key := Balance("US"); len(url) == 0 || len(key) == 0 {
+	if servers, err := Rank(Client{CountryCode: "US"}); err != nil || len(servers) == 0 || len(servers[0].URLs) == 0 || len(servers[0].Secret) == 0 {
 		t.Fail()
 	}
 }
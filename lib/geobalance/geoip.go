@@ -0,0 +1,166 @@
+package geobalance
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GeoIP is a read-only table of IP address ranges and where they are.
+type GeoIP struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	// 16-byte forms, so IPv4 and IPv6 ranges sort together.
+	start, end net.IP
+	client     Client
+}
+
+// LoadGeoIP reads a GeoIP table from a CSV file. See ParseGeoIP.
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g, err := ParseGeoIP(f)
+	if err != nil {
+		return nil, fmt.Errorf("geobalance: %v: %v", path, err)
+	}
+	return g, nil
+}
+
+// ParseGeoIP reads a GeoIP table from CSV rows of the first and last address
+// of a range, its country code and, optionally, its latitude and longitude.
+// Addresses are either written out or, for IPv4, decimal integers. A header
+// row is skipped.
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	g := &GeoIP{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if len(record) < 3 {
+			return nil, fmt.Errorf("line %v: expected at least 3 fields", line)
+		}
+
+		start, end := parseRangeIP(record[0]), parseRangeIP(record[1])
+		if start == nil || end == nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %v: bad range %v-%v", line, record[0], record[1])
+		} else if bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("line %v: inverted range %v-%v", line, record[0], record[1])
+		}
+
+		c := Client{CountryCode: strings.ToUpper(strings.TrimSpace(record[2]))}
+		if c.CountryCode == "" || c.CountryCode == "-" || c.CountryCode == "ZZ" {
+			continue
+		}
+
+		if len(record) >= 5 && record[3] != "" && record[4] != "" {
+			if c.Latitude, err = strconv.ParseFloat(strings.TrimSpace(record[3]), 64); err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			} else if c.Longitude, err = strconv.ParseFloat(strings.TrimSpace(record[4]), 64); err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+			c.Located = true
+		}
+
+		g.ranges = append(g.ranges, ipRange{start: start, end: end, client: c})
+	}
+
+	sort.Slice(g.ranges, func(i, j int) bool {
+		return bytes.Compare(g.ranges[i].start, g.ranges[j].start) < 0
+	})
+
+	return g, nil
+}
+
+// parseRangeIP parses an address in its 16-byte form, or returns nil.
+func parseRangeIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16()
+	}
+
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To16()
+	}
+
+	return nil
+}
+
+// Lookup returns where an address is, if it's in the table.
+func (g *GeoIP) Lookup(ip net.IP) (Client, bool) {
+	if ip = ip.To16(); ip == nil {
+		return Client{}, false
+	}
+
+	// Find the last range starting at or before ip.
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].start, ip) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip, g.ranges[i].end) > 0 {
+		return Client{}, false
+	}
+
+	return g.ranges[i].client, true
+}
+
+// locate looks up where a client whose headers didn't give its country is from
+// its address. Clients whose country is known are left alone, as the table's
+// coordinates could be somewhere else entirely; coordinates the client gave
+// are kept.
+func (g *GeoIP) locate(c Client) Client {
+	if g == nil || c.IP == nil || (c.CountryCode != "" && c.CountryCode != "unknown") {
+		return c
+	}
+
+	found, ok := g.Lookup(c.IP)
+	if !ok {
+		return c
+	}
+
+	c.CountryCode = found.CountryCode
+	if !c.Located && found.Located {
+		c.Latitude, c.Longitude, c.Located = found.Latitude, found.Longitude, true
+	}
+
+	return c
+}
+
+// geoIP is the table Rank locates clients with, if any.
+var geoIP struct {
+	sync.RWMutex
+	current *GeoIP
+}
+
+// SetGeoIP replaces the table Rank and RankPair locate clients with.
+func SetGeoIP(g *GeoIP) {
+	geoIP.Lock()
+	geoIP.current = g
+	geoIP.Unlock()
+}
+
+func currentGeoIP() *GeoIP {
+	geoIP.RLock()
+	defer geoIP.RUnlock()
+	return geoIP.current
+}
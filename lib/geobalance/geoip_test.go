@@ -0,0 +1,73 @@
+package geobalance
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testGeoIP = `start,end,country,latitude,longitude
+1.0.0.0,1.0.0.255,AU,-33.49,143.21
+16777472,16778239,CN,,
+2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP,35.69,139.69
+10.0.0.0,10.255.255.255,-,,
+`
+
+func TestGeoIPLookup(t *testing.T) {
+	g, err := ParseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, expected := range map[string]Client{
+		"1.0.0.1":      {CountryCode: "AU", Latitude: -33.49, Longitude: 143.21, Located: true},
+		"1.0.1.7":      {CountryCode: "CN"},
+		"2001:200::42": {CountryCode: "JP", Latitude: 35.69, Longitude: 139.69, Located: true},
+	} {
+		if c, ok := g.Lookup(net.ParseIP(ip)); !ok || c.CountryCode != expected.CountryCode || c.Located != expected.Located || c.Latitude != expected.Latitude || c.Longitude != expected.Longitude {
+			t.Errorf("%v: got %+v, %v", ip, c, ok)
+		}
+	}
+
+	for _, ip := range []string{"1.0.4.0", "10.1.2.3", "0.0.0.1", "2001:db8::1"} {
+		if c, ok := g.Lookup(net.ParseIP(ip)); ok {
+			t.Errorf("%v: found %+v", ip, c)
+		}
+	}
+}
+
+func TestGeoIPLocate(t *testing.T) {
+	g, err := ParseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := g.locate(Client{CountryCode: "unknown", IP: net.ParseIP("1.0.0.1")})
+	if c.CountryCode != "AU" || !c.Located {
+		t.Errorf("got %+v", c)
+	}
+
+	// Clients whose country is known aren't looked up.
+	c = g.locate(Client{CountryCode: "NZ", IP: net.ParseIP("1.0.0.1")})
+	if c.CountryCode != "NZ" || c.Located {
+		t.Errorf("got %+v", c)
+	}
+
+	// Coordinates the client gave stay.
+	c = g.locate(Client{CountryCode: "unknown", Latitude: -41.29, Longitude: 174.78, Located: true, IP: net.ParseIP("1.0.0.1")})
+	if c.CountryCode != "AU" || c.Latitude != -41.29 || c.Longitude != 174.78 {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestParseGeoIPErrors(t *testing.T) {
+	for _, data := range []string{
+		"1.0.0.255,1.0.0.0,AU\n",
+		"1.0.0.0,1.0.0.255,AU\nnot,an,address\n",
+		"1.0.0.0,1.0.0.255\n",
+	} {
+		if _, err := ParseGeoIP(strings.NewReader(data)); err == nil {
+			t.Errorf("accepted %q", data)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package geobalance
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// Health check defaults.
+const (
+	DefaultCheckInterval = 10 * time.Second
+	DefaultCheckTimeout  = 2 * time.Second
+	// A healthy server is marked down after DefaultFall failed probes in a
+	// row, and a server that is down is marked healthy again after
+	// DefaultRise successful ones, so one lost packet doesn't move clients.
+	DefaultFall = 3
+	DefaultRise = 2
+)
+
+// ServerHealth is what health checks know about a server.
+type ServerHealth struct {
+	ID          string    `json:"id"`
+	Region      string    `json:"region"`
+	Healthy     bool      `json:"healthy"`
+	LastChecked time.Time `json:"lastChecked"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+type serverState struct {
+	ServerHealth
+	// How many probes in a row disagreed with Healthy.
+	streak int
+}
+
+// Checker probes TURN servers and keeps track of which are healthy. Servers
+// it hasn't probed yet count as healthy. Zero fields take the defaults above.
+type Checker struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	Fall     int
+	Rise     int
+	// Probe returns nil if a server is up. Defaults to sending it a STUN
+	// binding request.
+	Probe func(server Server, timeout time.Duration) error
+
+	mutex sync.RWMutex
+	state map[string]*serverState
+}
+
+// Healthy reports whether a server is healthy.
+func (c *Checker) Healthy(id string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if st, ok := c.state[id]; ok {
+		return st.Healthy
+	}
+	return true
+}
+
+// Status returns the health of servers.
+func (c *Checker) Status(servers []Server) []ServerHealth {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	status := make([]ServerHealth, 0, len(servers))
+	for _, server := range servers {
+		if st, ok := c.state[server.ID]; ok {
+			status = append(status, st.ServerHealth)
+		} else {
+			status = append(status, ServerHealth{ID: server.ID, Region: server.Region, Healthy: true})
+		}
+	}
+	return status
+}
+
+// Check probes servers once, concurrently, and forgets any other server.
+func (c *Checker) Check(servers []Server) {
+	probe, timeout := c.Probe, c.Timeout
+	if probe == nil {
+		probe = probeSTUN
+	}
+	if timeout == 0 {
+		timeout = DefaultCheckTimeout
+	}
+
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server Server) {
+			defer wg.Done()
+			errs[i] = probe(server, timeout)
+		}(i, server)
+	}
+	wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state := make(map[string]*serverState, len(servers))
+	for i, server := range servers {
+		st, ok := c.state[server.ID]
+		if !ok {
+			st = &serverState{ServerHealth: ServerHealth{ID: server.ID, Healthy: true}}
+		}
+		state[server.ID] = st
+		c.record(st, server, errs[i])
+	}
+	c.state = state
+}
+
+func (c *Checker) record(st *serverState, server Server, err error) {
+	st.Region = server.Region
+	st.LastChecked = time.Now()
+	if st.LastError = ""; err != nil {
+		st.LastError = err.Error()
+	}
+
+	up := err == nil
+	if up == st.Healthy {
+		st.streak = 0
+		return
+	}
+
+	threshold := c.Fall
+	if threshold == 0 {
+		threshold = DefaultFall
+	}
+	if up {
+		if threshold = c.Rise; threshold == 0 {
+			threshold = DefaultRise
+		}
+	}
+
+	if st.streak++; st.streak >= threshold {
+		st.Healthy, st.streak = up, 0
+		if up {
+			log.Printf("TURN server %v is back up", server.ID)
+		} else {
+			log.Printf("TURN server %v is down: %v", server.ID, err)
+		}
+	}
+}
+
+// Run checks the current registry's servers every Interval, forever.
+func (c *Checker) Run() {
+	interval := c.Interval
+	if interval == 0 {
+		interval = DefaultCheckInterval
+	}
+
+	for {
+		c.Check(currentRegistry().Servers())
+		time.Sleep(interval)
+	}
+}
+
+// checker is the Checker Rank and RankPair consult, if any.
+var checker struct {
+	sync.RWMutex
+	current *Checker
+}
+
+// StartHealthChecks runs c in the background and makes Rank and RankPair skip
+// the servers it finds down.
+func StartHealthChecks(c *Checker) {
+	checker.Lock()
+	checker.current = c
+	checker.Unlock()
+
+	go c.Run()
+}
+
+func currentChecker() *Checker {
+	checker.RLock()
+	defer checker.RUnlock()
+	return checker.current
+}
+
+// Healthy reports whether health checks last found a server up. Without
+// health checks every server is healthy.
+func Healthy(id string) bool {
+	if c := currentChecker(); c != nil {
+		return c.Healthy(id)
+	}
+	return true
+}
+
+// Health returns the health of the current registry's servers. Without
+// health checks every server is reported healthy.
+func Health() []ServerHealth {
+	servers := currentRegistry().Servers()
+	if c := currentChecker(); c != nil {
+		return c.Status(servers)
+	}
+	return (&Checker{}).Status(servers)
+}
+
+// stunAddr returns the network and address to probe a server on: that of its
+// first URL not over TLS.
+func stunAddr(server Server) (string, string, error) {
+	for _, url := range server.URLs {
+		var rest string
+		if strings.HasPrefix(url, "turn:") {
+			rest = strings.TrimPrefix(url, "turn:")
+		} else if strings.HasPrefix(url, "stun:") {
+			rest = strings.TrimPrefix(url, "stun:")
+		} else {
+			continue
+		}
+
+		network := "udp"
+		if i := strings.Index(rest, "?"); i >= 0 {
+			if strings.Contains(rest[i:], "transport=tcp") {
+				network = "tcp"
+			}
+			rest = rest[:i]
+		}
+
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			rest = net.JoinHostPort(strings.Trim(rest, "[]"), "3478")
+		}
+		return network, rest, nil
+	}
+
+	return "", "", fmt.Errorf("geobalance: no URL of %v to probe", server.ID)
+}
+
+// probeSTUN sends a server a STUN binding request and waits for the response.
+func probeSTUN(server Server, timeout time.Duration) error {
+	network, addr, err := stunAddr(server)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	client, err := stun.NewClient(conn, stun.WithRTO(timeout), stun.WithNoRetransmit)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	var result error
+	if err := client.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(e stun.Event) {
+		if e.Error != nil {
+			result = e.Error
+		} else if e.Message.Type != stun.BindingSuccess {
+			result = errors.New("geobalance: unexpected STUN response " + e.Message.Type.String())
+		}
+	}); err != nil {
+		return err
+	}
+
+	return result
+}
@@ -0,0 +1,125 @@
+package geobalance
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"server/lib/turnserver"
+)
+
+func TestCheckerHysteresis(t *testing.T) {
+	down := make(map[string]bool)
+	c := &Checker{
+		Fall: 2,
+		Rise: 3,
+		Probe: func(server Server, timeout time.Duration) error {
+			if down[server.ID] {
+				return errors.New("no response")
+			}
+			return nil
+		},
+	}
+	servers := []Server{{ID: "fra-1", Region: "fra"}}
+
+	if !c.Healthy("fra-1") {
+		t.Error("unprobed server isn't healthy")
+	}
+
+	down["fra-1"] = true
+	c.Check(servers)
+	if !c.Healthy("fra-1") {
+		t.Error("server marked down after one failed probe")
+	}
+	c.Check(servers)
+	if c.Healthy("fra-1") {
+		t.Error("server still healthy after two failed probes")
+	}
+
+	down["fra-1"] = false
+	c.Check(servers)
+	c.Check(servers)
+	if c.Healthy("fra-1") {
+		t.Error("server marked up after two successful probes")
+	}
+	c.Check(servers)
+	if !c.Healthy("fra-1") {
+		t.Error("server still down after three successful probes")
+	}
+
+	if status := c.Status(servers); len(status) != 1 || !status[0].Healthy || status[0].Region != "fra" || status[0].LastChecked.IsZero() {
+		t.Errorf("bad status: %+v", status)
+	}
+}
+
+func TestBalanceFailover(t *testing.T) {
+	r, err := NewRegistry([]Region{
+		{ID: "fra", Continents: []string{"EU"}, Default: true, Latitude: 50.11, Longitude: 8.68},
+		{ID: "sfo", Continents: []string{"NA"}, Latitude: 37.77, Longitude: -122.42},
+		{ID: "ams", Continents: []string{"AF"}, Latitude: 52.37, Longitude: 4.90},
+	}, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "ams-1", URLs: []string{"turn:ams-1"}, Region: "ams", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Frankfurt is down, and Amsterdam is closer to it than San Francisco.
+	up := func(id string) bool { return id != "fra-1" }
+	if server, err := r.route(r.order(Client{CountryCode: "DE"}), up); err != nil || server.ID != "ams-1" {
+		t.Errorf("got %v, %v", server.ID, err)
+	}
+
+	// With everything down, clients still get their own region's server.
+	down := func(id string) bool { return false }
+	if server, err := r.route(r.order(Client{CountryCode: "DE"}), down); err != nil || server.ID != "fra-1" {
+		t.Errorf("got %v, %v", server.ID, err)
+	}
+}
+
+func TestProbeSTUN(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	server, err := turnserver.Start(turnserver.Config{
+		UDPAddrs: []string{addr},
+		RelayIP:  net.ParseIP("127.0.0.1"),
+		Secret:   "secretkey",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := probeSTUN(Server{ID: "local", URLs: []string{"turn:" + addr}}, time.Second); err != nil {
+		t.Errorf("probe of a running server failed: %v", err)
+	}
+
+	server.Close()
+	if err := probeSTUN(Server{ID: "local", URLs: []string{"turn:" + addr + "?transport=udp"}}, 100*time.Millisecond); err == nil {
+		t.Error("probe of a stopped server succeeded")
+	}
+}
+
+func TestStunAddr(t *testing.T) {
+	for url, expected := range map[string][2]string{
+		"turn:prod-turn-fra.airtap.dev:443":               {"udp", "prod-turn-fra.airtap.dev:443"},
+		"turn:prod-turn-fra.airtap.dev:443?transport=tcp": {"tcp", "prod-turn-fra.airtap.dev:443"},
+		"stun:stun.airtap.dev":                            {"udp", "stun.airtap.dev:3478"},
+	} {
+		network, addr, err := stunAddr(Server{URLs: []string{url}})
+		if err != nil || network != expected[0] || addr != expected[1] {
+			t.Errorf("%v: got %v %v, %v", url, network, addr, err)
+		}
+	}
+
+	if _, _, err := stunAddr(Server{URLs: []string{"turns:prod-turn-fra.airtap.dev:443"}}); err == nil {
+		t.Error("accepted a TLS-only server")
+	}
+}
@@ -0,0 +1,556 @@
+package geobalance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoServers is returned when the registry has no enabled server at all.
+var ErrNoServers = errors.New("geobalance: no TURN servers enabled")
+
+// maxFallbacks is how many servers from other regions Rank adds.
+const maxFallbacks = 2
+
+// Region is a group of TURN servers serving the same continents or
+// subdivisions.
+type Region struct {
+	ID         string   `json:"id"`
+	Continents []string `json:"continents"`
+	// Subdivisions are ISO 3166-2 codes such as "US-NY". They take
+	// precedence over Continents.
+	Subdivisions []string `json:"subdivisions"`
+	// Default marks the region clients are sent to when their continent isn't
+	// served by any region.
+	Default bool `json:"default"`
+	// Where the region's servers are, in degrees. Clients fail over to the
+	// closest other region first. Regions at 0, 0 are taken to have no
+	// location and are tried last.
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (r Region) located() bool {
+	return r.Latitude != 0 || r.Longitude != 0
+}
+
+// Server is a TURN server in the registry.
+type Server struct {
+	ID string `json:"id"`
+	// URLs clients are given, such as "turn:prod-turn-fra.airtap.dev:443".
+	URLs []string `json:"urls"`
+	// Transports the server accepts connections over: "udp", "tcp" and "tls".
+	Transports []string `json:"transports"`
+	Region     string   `json:"region"`
+	// SecretEnv names the environment variable holding the secret passwords
+	// for this server are signed with.
+	SecretEnv string `json:"secretEnv"`
+	// Weight is the share of its region's clients the server gets, relative
+	// to the region's other servers. Zero counts as one.
+	Weight  int  `json:"weight"`
+	Enabled bool `json:"enabled"`
+
+	// Secret is read from SecretEnv when the registry is built.
+	Secret string `json:"-"`
+}
+
+// Override pins the clients it matches to a region, whatever their location.
+// It matches by exactly one of a country code, an account id or a license id.
+// Account overrides win over license overrides, which win over country ones.
+type Override struct {
+	CountryCode string `json:"countryCode,omitempty"`
+	AccountID   int    `json:"accountId,omitempty"`
+	LicenseID   int    `json:"licenseId,omitempty"`
+	Region      string `json:"region"`
+}
+
+// Registry is a read-only set of TURN servers by region.
+type Registry struct {
+	regions       []string
+	located       []Region
+	continents    map[string]string
+	subdivisions  map[string]string
+	servers       map[string][]Server
+	defaultRegion string
+	// The other regions of each region, closest first.
+	fallbacks map[string][]string
+	// Regions clients are pinned to.
+	countryOverrides map[string]string
+	accountOverrides map[int]string
+	licenseOverrides map[int]string
+}
+
+type registryFile struct {
+	Regions   []Region   `json:"regions"`
+	Servers   []Server   `json:"servers"`
+	Overrides []Override `json:"overrides"`
+}
+
+// NewRegistry checks and indexes regions, servers and overrides.
+func NewRegistry(regions []Region, servers []Server, overrides ...Override) (*Registry, error) {
+	r := &Registry{
+		continents:       make(map[string]string),
+		subdivisions:     make(map[string]string),
+		servers:          make(map[string][]Server),
+		fallbacks:        make(map[string][]string),
+		countryOverrides: make(map[string]string),
+		accountOverrides: make(map[int]string),
+		licenseOverrides: make(map[int]string),
+	}
+
+	for _, region := range regions {
+		if region.ID == "" {
+			return nil, errors.New("geobalance: region without an id")
+		} else if _, ok := r.servers[region.ID]; ok {
+			return nil, fmt.Errorf("geobalance: duplicate region %q", region.ID)
+		}
+		r.servers[region.ID] = nil
+		r.regions = append(r.regions, region.ID)
+
+		for _, continent := range region.Continents {
+			continent = strings.ToUpper(continent)
+			if other, ok := r.continents[continent]; ok {
+				return nil, fmt.Errorf("geobalance: continent %v in both %q and %q", continent, other, region.ID)
+			}
+			r.continents[continent] = region.ID
+		}
+
+		for _, subdivision := range region.Subdivisions {
+			subdivision = strings.ToUpper(subdivision)
+			if other, ok := r.subdivisions[subdivision]; ok {
+				return nil, fmt.Errorf("geobalance: subdivision %v in both %q and %q", subdivision, other, region.ID)
+			}
+			r.subdivisions[subdivision] = region.ID
+		}
+
+		if region.located() {
+			r.located = append(r.located, region)
+		}
+
+		if region.Default {
+			if r.defaultRegion != "" {
+				return nil, fmt.Errorf("geobalance: both %q and %q are default", r.defaultRegion, region.ID)
+			}
+			r.defaultRegion = region.ID
+		}
+	}
+
+	if r.defaultRegion == "" && len(r.regions) > 0 {
+		r.defaultRegion = r.regions[0]
+	}
+
+	for _, region := range regions {
+		var others []Region
+		for _, other := range regions {
+			if other.ID != region.ID {
+				others = append(others, other)
+			}
+		}
+
+		sort.SliceStable(others, func(i, j int) bool {
+			if !region.located() || !others[i].located() || !others[j].located() {
+				return others[i].located() && !others[j].located()
+			}
+			return distance(region.Latitude, region.Longitude, others[i].Latitude, others[i].Longitude) <
+				distance(region.Latitude, region.Longitude, others[j].Latitude, others[j].Longitude)
+		})
+
+		for _, other := range others {
+			r.fallbacks[region.ID] = append(r.fallbacks[region.ID], other.ID)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		if server.ID == "" {
+			return nil, errors.New("geobalance: server without an id")
+		} else if seen[server.ID] {
+			return nil, fmt.Errorf("geobalance: duplicate server %q", server.ID)
+		} else if len(server.URLs) == 0 {
+			return nil, fmt.Errorf("geobalance: server %q has no URLs", server.ID)
+		} else if _, ok := r.servers[server.Region]; !ok {
+			return nil, fmt.Errorf("geobalance: server %q is in unknown region %q", server.ID, server.Region)
+		} else if server.Weight < 0 {
+			return nil, fmt.Errorf("geobalance: server %q has a negative weight", server.ID)
+		}
+		seen[server.ID] = true
+
+		if !server.Enabled {
+			continue
+		}
+		if server.Weight == 0 {
+			server.Weight = 1
+		}
+		server.Secret = os.Getenv(server.SecretEnv)
+		r.servers[server.Region] = append(r.servers[server.Region], server)
+	}
+
+	for _, override := range overrides {
+		if err := r.addOverride(override); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Registry) addOverride(o Override) error {
+	if _, ok := r.servers[o.Region]; !ok {
+		return fmt.Errorf("geobalance: override %+v is to unknown region %q", o, o.Region)
+	}
+
+	var duplicate bool
+	switch {
+	case o.CountryCode != "" && o.AccountID == 0 && o.LicenseID == 0:
+		countryCode := strings.ToUpper(o.CountryCode)
+		_, duplicate = r.countryOverrides[countryCode]
+		r.countryOverrides[countryCode] = o.Region
+	case o.CountryCode == "" && o.AccountID != 0 && o.LicenseID == 0:
+		_, duplicate = r.accountOverrides[o.AccountID]
+		r.accountOverrides[o.AccountID] = o.Region
+	case o.CountryCode == "" && o.AccountID == 0 && o.LicenseID != 0:
+		_, duplicate = r.licenseOverrides[o.LicenseID]
+		r.licenseOverrides[o.LicenseID] = o.Region
+	default:
+		return fmt.Errorf("geobalance: override %+v must match by exactly one of country, account and license", o)
+	}
+
+	if duplicate {
+		return fmt.Errorf("geobalance: duplicate override %+v", o)
+	}
+	return nil
+}
+
+// override returns the region a client is pinned to, if any.
+func (r *Registry) override(c Client) (string, bool) {
+	if region, ok := r.accountOverrides[c.AccountID]; ok && c.AccountID != 0 {
+		return region, true
+	} else if region, ok := r.licenseOverrides[c.LicenseID]; ok && c.LicenseID != 0 {
+		return region, true
+	}
+
+	region, ok := r.countryOverrides[strings.ToUpper(c.CountryCode)]
+	return region, ok
+}
+
+// LoadFile reads a registry from a JSON file with "regions" and "servers"
+// arrays.
+func LoadFile(path string) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file registryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("geobalance: %v: %v", path, err)
+	}
+
+	return NewRegistry(file.Regions, file.Servers, file.Overrides...)
+}
+
+// Servers returns the enabled servers, by region.
+func (r *Registry) Servers() []Server {
+	var servers []Server
+	for _, region := range r.regions {
+		servers = append(servers, r.servers[region]...)
+	}
+	return servers
+}
+
+// pick chooses one of a region's servers that healthy accepts at random, by
+// weight. A nil healthy accepts every server.
+func (r *Registry) pick(region string, healthy func(id string) bool) (Server, bool) {
+	var servers []Server
+	total := 0
+	for _, server := range r.servers[region] {
+		if healthy == nil || healthy(server.ID) {
+			servers = append(servers, server)
+			total += server.Weight
+		}
+	}
+	if total == 0 {
+		return Server{}, false
+	}
+
+	n := rand.Intn(total)
+	for _, server := range servers {
+		if n < server.Weight {
+			return server, true
+		}
+		n -= server.Weight
+	}
+
+	return Server{}, false
+}
+
+// order returns the regions to try for a client, best first. Clients an
+// override matches are sent to its region, with the regions closest to it
+// next. Otherwise regions the client measured round-trip times to come first,
+// fastest first, then the rest by location; see locationOrder.
+func (r *Registry) order(c Client) []string {
+	if region, ok := r.override(c); ok {
+		return append([]string{region}, r.fallbacks[region]...)
+	}
+
+	order := r.locationOrder(c)
+	if len(c.RTTs) > 0 {
+		sort.SliceStable(order, func(i, j int) bool {
+			rttI, measuredI := c.RTTs[order[i]]
+			rttJ, measuredJ := c.RTTs[order[j]]
+			if measuredI && measuredJ {
+				return rttI < rttJ
+			}
+			return measuredI && !measuredJ
+		})
+	}
+
+	return order
+}
+
+// locationOrder returns every region by how close it is to a client. Clients
+// with coordinates are sent to the closest region, then the next-closest, and
+// so on. Others are sent to the region serving their subdivision, their
+// continent or, failing both, the default region, followed by the regions
+// closest to it.
+func (r *Registry) locationOrder(c Client) []string {
+	if c.Located && len(r.located) > 0 {
+		located := make([]Region, len(r.located))
+		copy(located, r.located)
+		sort.SliceStable(located, func(i, j int) bool {
+			return distance(c.Latitude, c.Longitude, located[i].Latitude, located[i].Longitude) <
+				distance(c.Latitude, c.Longitude, located[j].Latitude, located[j].Longitude)
+		})
+
+		order := make([]string, 0, len(r.regions))
+		for _, region := range located {
+			order = append(order, region.ID)
+		}
+		for _, id := range r.regions {
+			if !r.isLocated(id) {
+				order = append(order, id)
+			}
+		}
+		return order
+	}
+
+	region, ok := r.subdivisions[strings.ToUpper(c.Subdivision)]
+	if !ok {
+		if region, ok = r.continents[strings.ToUpper(continent(c.CountryCode))]; !ok {
+			region = r.defaultRegion
+		}
+	}
+
+	return append([]string{region}, r.fallbacks[region]...)
+}
+
+// pairOrder returns the regions to try for a call between two clients, best
+// first. It doesn't depend on which client is a and which is b. An override
+// matching either client wins, the one of the client with the lower account
+// id first. Otherwise, if both clients are located, regions go by how close
+// they are to the midpoint between them; if one is, by how close they are to
+// it. Regions both clients measured round-trip times to come first, by the
+// sum of the two.
+func (r *Registry) pairOrder(a, b Client) []string {
+	if b.AccountID < a.AccountID {
+		a, b = b, a
+	}
+
+	for _, c := range []Client{a, b} {
+		if region, ok := r.override(c); ok {
+			return append([]string{region}, r.fallbacks[region]...)
+		}
+	}
+
+	var order []string
+	switch {
+	case a.Located && b.Located:
+		lat, long := midpoint(a.Latitude, a.Longitude, b.Latitude, b.Longitude)
+		order = r.locationOrder(Client{Latitude: lat, Longitude: long, Located: true})
+	case b.Located:
+		order = r.locationOrder(b)
+	default:
+		order = r.locationOrder(a)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		rttI, measuredI := pairRTT(a, b, order[i])
+		rttJ, measuredJ := pairRTT(a, b, order[j])
+		if measuredI && measuredJ {
+			return rttI < rttJ
+		}
+		return measuredI && !measuredJ
+	})
+
+	return order
+}
+
+// pairRTT returns the round-trip time between two clients through a region,
+// if both measured theirs.
+func pairRTT(a, b Client, region string) (time.Duration, bool) {
+	rttA, okA := a.RTTs[region]
+	rttB, okB := b.RTTs[region]
+	return rttA + rttB, okA && okB
+}
+
+func (r *Registry) find(id string) (Server, bool) {
+	for _, server := range r.Servers() {
+		if server.ID == id {
+			return server, true
+		}
+	}
+	return Server{}, false
+}
+
+func (r *Registry) isLocated(id string) bool {
+	for _, region := range r.located {
+		if region.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns a healthy server from the first region in order that has
+// one. If no server is healthy, health is ignored rather than turning every
+// client away.
+func (r *Registry) route(order []string, healthy func(id string) bool) (Server, error) {
+	for _, healthy := range []func(id string) bool{healthy, nil} {
+		for _, region := range order {
+			if server, ok := r.pick(region, healthy); ok {
+				return server, nil
+			}
+		}
+	}
+
+	return Server{}, ErrNoServers
+}
+
+// rank returns the server route picks, followed by a healthy server from each
+// of up to maxFallbacks other regions, in order.
+func (r *Registry) rank(order []string, healthy func(id string) bool) ([]Server, error) {
+	primary, err := r.route(order, healthy)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := []Server{primary}
+	for _, region := range order {
+		if len(servers) > maxFallbacks {
+			break
+		} else if region == primary.Region {
+			continue
+		}
+
+		if server, ok := r.pick(region, healthy); ok {
+			servers = append(servers, server)
+		}
+	}
+
+	return servers, nil
+}
+
+// probeTargets returns a healthy server from each region, for clients to
+// measure round-trip times to. A nil healthy accepts every server.
+func (r *Registry) probeTargets(healthy func(id string) bool) []Server {
+	var servers []Server
+	for _, region := range r.regions {
+		if server, ok := r.pick(region, healthy); ok {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// STUNURL returns a "stun:" URL for the server, or "" if it has no address
+// STUN can be sent to.
+func (s Server) STUNURL() string {
+	if _, addr, err := stunAddr(s); err == nil {
+		return "stun:" + addr
+	}
+	return ""
+}
+
+// ICEURLs returns the URLs WebRTC should use for the server: for each of its
+// "turn:" URLs, STUN on the same address and then TURN over each of its
+// transports. Other URLs, and URLs that already pick a transport, are
+// returned as they are.
+func (s Server) ICEURLs() []string {
+	var urls []string
+	for _, url := range s.URLs {
+		if !strings.HasPrefix(url, "turn:") || strings.Contains(url, "?") || len(s.Transports) == 0 {
+			urls = append(urls, url)
+			continue
+		}
+
+		addr := strings.TrimPrefix(url, "turn:")
+		urls = append(urls, "stun:"+addr)
+		for _, transport := range s.Transports {
+			switch transport {
+			case "udp", "tcp":
+				urls = append(urls, "turn:"+addr+"?transport="+transport)
+			case "tls":
+				urls = append(urls, "turns:"+addr+"?transport=tcp")
+			}
+		}
+	}
+
+	return urls
+}
+
+// registry is what the package-level functions route over.
+var registry struct {
+	sync.RWMutex
+	current *Registry
+}
+
+// SetRegistry replaces the registry Rank and RankPair route over.
+func SetRegistry(r *Registry) {
+	registry.Lock()
+	registry.current = r
+	registry.Unlock()
+}
+
+func currentRegistry() *Registry {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.current
+}
+
+// defaultRegistry is used until SetRegistry is called: Frankfurt for Europe,
+// Asia and Africa, San Francisco for the rest.
+func defaultRegistry() *Registry {
+	r, err := NewRegistry([]Region{
+		{ID: "fra", Continents: []string{"AS", "EU", "AF"}, Default: true, Latitude: 50.11, Longitude: 8.68},
+		{ID: "sfo", Continents: []string{"NA", "SA", "OC"}, Latitude: 37.77, Longitude: -122.42},
+	}, []Server{
+		{
+			ID:         "prod-turn-fra",
+			URLs:       []string{"turn:prod-turn-fra.airtap.dev:443"},
+			Transports: []string{"udp", "tcp"},
+			Region:     "fra",
+			SecretEnv:  "TURN_FRA_KEY",
+			Enabled:    true,
+		},
+		{
+			ID:         "prod-turn-sfo",
+			URLs:       []string{"turn:prod-turn-sfo.airtap.dev:443"},
+			Transports: []string{"udp", "tcp"},
+			Region:     "sfo",
+			SecretEnv:  "TURN_SFO_KEY",
+			Enabled:    true,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return r
+}
@@ -0,0 +1,345 @@
+package geobalance
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testRegions = []Region{
+	{ID: "fra", Continents: []string{"EU", "AF"}, Default: true},
+	{ID: "sfo", Continents: []string{"NA"}},
+	{ID: "sin", Continents: []string{"AS"}},
+}
+
+func TestRegistryBalance(t *testing.T) {
+	r, err := NewRegistry(testRegions, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "sfo-2", URLs: []string{"turn:sfo-2"}, Region: "sfo", Weight: 3, Enabled: true},
+		{ID: "sin-1", URLs: []string{"turn:sin-1"}, Region: "sin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server, err := r.route(r.order(Client{CountryCode: "DE"}), nil); err != nil || server.ID != "fra-1" {
+		t.Errorf("got %v, %v for DE", server.ID, err)
+	}
+
+	// Singapore's only server is disabled, so Asia goes to the default region.
+	if server, err := r.route(r.order(Client{CountryCode: "JP"}), nil); err != nil || server.ID != "fra-1" {
+		t.Errorf("got %v, %v for JP", server.ID, err)
+	}
+
+	// Unknown countries go to the default region too.
+	if server, err := r.route(r.order(Client{CountryCode: "unknown"}), nil); err != nil || server.ID != "fra-1" {
+		t.Errorf("got %v, %v for an unknown country", server.ID, err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		server, err := r.route(r.order(Client{CountryCode: "US"}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[server.ID]++
+	}
+	if len(counts) != 2 || counts["sfo-2"] < 2*counts["sfo-1"] {
+		t.Errorf("servers not picked by weight: %v", counts)
+	}
+}
+
+func TestRegistryNoServers(t *testing.T) {
+	r, err := NewRegistry(testRegions, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.route(r.order(Client{CountryCode: "DE"}), nil); err != ErrNoServers {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNewRegistryErrors(t *testing.T) {
+	for name, servers := range map[string][]Server{
+		"no id":          {{URLs: []string{"turn:a"}, Region: "fra"}},
+		"no URLs":        {{ID: "a", Region: "fra"}},
+		"unknown region": {{ID: "a", URLs: []string{"turn:a"}, Region: "ams"}},
+		"duplicate id":   {{ID: "a", URLs: []string{"turn:a"}, Region: "fra"}, {ID: "a", URLs: []string{"turn:b"}, Region: "sfo"}},
+	} {
+		if _, err := NewRegistry(testRegions, servers); err == nil {
+			t.Errorf("%v: accepted", name)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geobalance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("TEST_TURN_KEY", "secretkey")
+	defer os.Unsetenv("TEST_TURN_KEY")
+
+	path := filepath.Join(dir, "turn.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+		"regions": [{"id": "ams", "continents": ["EU"]}],
+		"servers": [{"id": "ams-1", "urls": ["turn:ams-1:443"], "transports": ["udp"], "region": "ams", "secretEnv": "TEST_TURN_KEY", "enabled": true}]
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only region is the default.
+	if server, err := r.route(r.order(Client{CountryCode: "US"}), nil); err != nil || server.ID != "ams-1" || server.Secret != "secretkey" || server.Weight != 1 {
+		t.Errorf("got %+v, %v", server, err)
+	}
+}
+
+func TestRegistryRank(t *testing.T) {
+	r, err := NewRegistry([]Region{
+		{ID: "fra", Continents: []string{"EU"}, Default: true, Latitude: 50.11, Longitude: 8.68},
+		{ID: "sfo", Continents: []string{"NA"}, Latitude: 37.77, Longitude: -122.42},
+		{ID: "ams", Latitude: 52.37, Longitude: 4.90},
+		{ID: "sin", Continents: []string{"AS"}, Latitude: 1.35, Longitude: 103.82},
+	}, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "ams-1", URLs: []string{"turn:ams-1"}, Region: "ams", Enabled: true},
+		{ID: "sin-1", URLs: []string{"turn:sin-1"}, Region: "sin", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := r.Rank(Client{CountryCode: "DE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, server := range servers {
+		ids = append(ids, server.ID)
+	}
+	if len(ids) != 3 || ids[0] != "fra-1" || ids[1] != "ams-1" || ids[2] != "sfo-1" {
+		t.Errorf("got %v", ids)
+	}
+}
+
+func TestICEURLs(t *testing.T) {
+	server := Server{
+		URLs:       []string{"turn:fra-1:443", "turn:fra-1:3478?transport=udp"},
+		Transports: []string{"udp", "tcp", "tls"},
+	}
+	expected := []string{
+		"stun:fra-1:443",
+		"turn:fra-1:443?transport=udp",
+		"turn:fra-1:443?transport=tcp",
+		"turns:fra-1:443?transport=tcp",
+		"turn:fra-1:3478?transport=udp",
+	}
+
+	urls := server.ICEURLs()
+	if len(urls) != len(expected) {
+		t.Fatalf("got %v", urls)
+	}
+	for i := range urls {
+		if urls[i] != expected[i] {
+			t.Errorf("got %v, expected %v", urls[i], expected[i])
+		}
+	}
+}
+
+func TestRegistryRankLocated(t *testing.T) {
+	r, err := NewRegistry([]Region{
+		{ID: "fra", Continents: []string{"EU"}, Default: true, Latitude: 50.11, Longitude: 8.68},
+		{ID: "sfo", Continents: []string{"NA"}, Latitude: 37.77, Longitude: -122.42},
+		{ID: "nyc", Subdivisions: []string{"US-NY"}, Latitude: 40.71, Longitude: -74.01},
+	}, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "nyc-1", URLs: []string{"turn:nyc-1"}, Region: "nyc", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		client   Client
+		expected []string
+	}{
+		"Boston":         {Client{CountryCode: "US", Latitude: 42.36, Longitude: -71.06, Located: true}, []string{"nyc-1", "sfo-1", "fra-1"}},
+		"Lisbon":         {Client{CountryCode: "PT", Latitude: 38.72, Longitude: -9.14, Located: true}, []string{"fra-1", "nyc-1", "sfo-1"}},
+		"New York state": {Client{CountryCode: "US", Subdivision: "US-NY"}, []string{"nyc-1", "sfo-1", "fra-1"}},
+		"United States":  {Client{CountryCode: "US"}, []string{"sfo-1", "nyc-1", "fra-1"}},
+	} {
+		servers, err := r.Rank(test.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(servers) != len(test.expected) {
+			t.Errorf("%v: got %v servers", name, len(servers))
+			continue
+		}
+		for i := range servers {
+			if servers[i].ID != test.expected[i] {
+				t.Errorf("%v: got %v at %v, expected %v", name, servers[i].ID, i, test.expected[i])
+			}
+		}
+	}
+}
+
+func TestRegistryOverrides(t *testing.T) {
+	r, err := NewRegistry(testRegions, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "sin-1", URLs: []string{"turn:sin-1"}, Region: "sin", Enabled: true},
+	},
+		Override{CountryCode: "ru", Region: "sfo"},
+		Override{LicenseID: 7, Region: "sin"},
+		Override{AccountID: 42, Region: "fra"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, test := range map[string]struct {
+		client   Client
+		expected string
+	}{
+		"country":             {Client{CountryCode: "RU"}, "sfo-1"},
+		"license":             {Client{CountryCode: "RU", LicenseID: 7}, "sin-1"},
+		"account":             {Client{CountryCode: "RU", LicenseID: 7, AccountID: 42}, "fra-1"},
+		"located":             {Client{CountryCode: "RU", Latitude: 55.76, Longitude: 37.62, Located: true}, "sfo-1"},
+		"other license":       {Client{CountryCode: "DE", LicenseID: 8}, "fra-1"},
+		"no override matches": {Client{CountryCode: "US"}, "sfo-1"},
+	} {
+		if servers, err := r.Rank(test.client); err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if servers[0].ID != test.expected {
+			t.Errorf("%v: got %v", name, servers[0].ID)
+		}
+	}
+
+	for name, override := range map[string]Override{
+		"no match":       {Region: "fra"},
+		"two matches":    {CountryCode: "DE", AccountID: 1, Region: "fra"},
+		"unknown region": {CountryCode: "DE", Region: "ams"},
+	} {
+		if _, err := NewRegistry(testRegions, nil, override); err == nil {
+			t.Errorf("%v: accepted", name)
+		}
+	}
+
+	if _, err := NewRegistry(testRegions, nil, Override{AccountID: 1, Region: "fra"}, Override{AccountID: 1, Region: "sfo"}); err == nil {
+		t.Error("accepted duplicate overrides")
+	}
+}
+
+func TestRegistryRankRTTs(t *testing.T) {
+	r, err := NewRegistry(testRegions, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "sin-1", URLs: []string{"turn:sin-1"}, Region: "sin", Enabled: true},
+	}, Override{AccountID: 42, Region: "sin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A German client that measured San Francisco faster than Frankfurt, and
+	// didn't measure Singapore.
+	rtts := map[string]time.Duration{"fra": 120 * time.Millisecond, "sfo": 40 * time.Millisecond}
+	servers, err := r.Rank(Client{CountryCode: "DE", RTTs: rtts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 3 || servers[0].ID != "sfo-1" || servers[1].ID != "fra-1" || servers[2].ID != "sin-1" {
+		t.Errorf("got %v", servers)
+	}
+
+	// Overrides still win.
+	if servers, err := r.Rank(Client{CountryCode: "DE", AccountID: 42, RTTs: rtts}); err != nil || servers[0].ID != "sin-1" {
+		t.Errorf("got %v, %v", servers, err)
+	}
+}
+
+func TestProbeTargets(t *testing.T) {
+	r, err := NewRegistry(testRegions, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1:443"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1:443?transport=udp"}, Region: "sfo", Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := r.probeTargets(nil)
+	if len(targets) != 2 || targets[0].STUNURL() != "stun:fra-1:443" || targets[1].STUNURL() != "stun:sfo-1:443" {
+		t.Errorf("got %v", targets)
+	}
+}
+
+func TestRegistryRankPair(t *testing.T) {
+	r, err := NewRegistry([]Region{
+		{ID: "fra", Continents: []string{"EU"}, Default: true, Latitude: 50.11, Longitude: 8.68},
+		{ID: "sfo", Continents: []string{"NA"}, Latitude: 37.77, Longitude: -122.42},
+		{ID: "nyc", Latitude: 40.71, Longitude: -74.01},
+	}, []Server{
+		{ID: "fra-1", URLs: []string{"turn:fra-1"}, Region: "fra", Enabled: true},
+		{ID: "sfo-1", URLs: []string{"turn:sfo-1"}, Region: "sfo", Enabled: true},
+		{ID: "nyc-1", URLs: []string{"turn:nyc-1"}, Region: "nyc", Enabled: true},
+	}, Override{AccountID: 7, Region: "sfo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	berlin := Client{AccountID: 1, CountryCode: "DE", Latitude: 52.52, Longitude: 13.40, Located: true}
+	sanFrancisco := Client{AccountID: 2, CountryCode: "US", Latitude: 37.77, Longitude: -122.42, Located: true}
+
+	// The midpoint between Berlin and San Francisco is over Greenland, closer
+	// to New York than to either end.
+	for _, pair := range [][2]Client{{berlin, sanFrancisco}, {sanFrancisco, berlin}} {
+		if servers, err := r.RankPair(pair[0], pair[1]); err != nil {
+			t.Error(err)
+		} else if servers[0].ID != "nyc-1" {
+			t.Errorf("got %v for %v and %v", servers[0].ID, pair[0].AccountID, pair[1].AccountID)
+		}
+	}
+
+	// Both measured round-trip times: Frankfurt is fastest in total.
+	berlin.RTTs = map[string]time.Duration{"fra": 10 * time.Millisecond, "nyc": 90 * time.Millisecond}
+	sanFrancisco.RTTs = map[string]time.Duration{"fra": 150 * time.Millisecond, "nyc": 80 * time.Millisecond}
+	if servers, err := r.RankPair(sanFrancisco, berlin); err != nil || servers[0].ID != "fra-1" {
+		t.Errorf("got %v, %v", servers, err)
+	}
+
+	// An override for either side wins.
+	tester := Client{AccountID: 7, CountryCode: "DE"}
+	if servers, err := r.RankPair(berlin, tester); err != nil || servers[0].ID != "sfo-1" {
+		t.Errorf("got %v, %v", servers, err)
+	}
+}
+
+func TestMidpoint(t *testing.T) {
+	lat, long := midpoint(0, 170, 0, -170)
+	if math.Abs(lat) > 1e-9 || math.Abs(math.Abs(long)-180) > 1e-9 {
+		t.Errorf("got %v, %v", lat, long)
+	}
+
+	lat, long = midpoint(10, 20, 10, 20)
+	if math.Abs(lat-10) > 1e-9 || math.Abs(long-20) > 1e-9 {
+		t.Errorf("got %v, %v", lat, long)
+	}
+}
@@ -0,0 +1,178 @@
+package push
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// APNSProduction is the endpoint of the production APNs environment.
+	APNSProduction = "https://api.push.apple.com"
+	// APNSSandbox is the endpoint of the development APNs environment.
+	APNSSandbox = "https://api.sandbox.push.apple.com"
+
+	// Apple rejects provider tokens older than an hour, and throttles those
+	// refreshed more often than every 20 minutes.
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// APNs sends pushes through the Apple Push Notification service, using
+// token-based authentication.
+type APNs struct {
+	// Endpoint is APNSProduction or APNSSandbox.
+	Endpoint string
+	// Topic is the bundle ID of the app.
+	Topic  string
+	KeyID  string
+	TeamID string
+	Key    *ecdsa.PrivateKey
+	Client *http.Client
+
+	mutex    sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// ParseAPNsKey parses the PEM-encoded .p8 signing key downloaded from Apple.
+func ParseAPNsKey(p8 []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(p8)
+	if block == nil {
+		return nil, errors.New("push: no PEM block in APNs key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+		return ecKey, nil
+	}
+	return nil, errors.New("push: APNs key is not an ECDSA key")
+}
+
+type apnsAlert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type apnsAps struct {
+	Alert apnsAlert `json:"alert"`
+	Sound string    `json:"sound"`
+}
+
+type apnsPayload struct {
+	Aps    apnsAps `json:"aps"`
+	Type   string  `json:"type"`
+	FromID int     `json:"fromAccountId"`
+}
+
+type apnsError struct {
+	Reason string `json:"reason"`
+}
+
+// Notify sends an alert push to a device.
+func (a *APNs) Notify(token string, msg Message) error {
+	bearer, err := a.bearer()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(apnsPayload{
+		Aps: apnsAps{
+			Alert: apnsAlert{
+				Title: "Airtap",
+				Body:  fmt.Sprintf("%v wants to talk", msg.FromName),
+			},
+			Sound: "default",
+		},
+		Type:   msg.Type,
+		FromID: msg.FromID,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", a.Endpoint+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+bearer)
+	req.Header.Set("apns-topic", a.Topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	// Calls are only worth ringing for a short while.
+	req.Header.Set("apns-expiration", fmt.Sprint(time.Now().Add(1*time.Minute).Unix()))
+
+	res, err := a.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var apnsErr apnsError
+	json.NewDecoder(res.Body).Decode(&apnsErr)
+	if res.StatusCode == http.StatusGone || apnsErr.Reason == "BadDeviceToken" || apnsErr.Reason == "Unregistered" {
+		return ErrUnregistered
+	}
+
+	return fmt.Errorf("push: APNs responded with %v: %v", res.StatusCode, apnsErr.Reason)
+}
+
+func (a *APNs) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return http.DefaultClient
+}
+
+// bearer returns a provider token, signing a new one when the last has aged.
+func (a *APNs) bearer() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.token != "" && time.Since(a.issuedAt) < apnsTokenLifetime {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": a.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": a.TeamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, a.Key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// ES256 signatures are the two 32-byte integers back to back.
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	a.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	a.issuedAt = now
+	return a.token, nil
+}
@@ -0,0 +1,96 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// FCMEndpoint is the endpoint of the FCM HTTP API.
+const FCMEndpoint = "https://fcm.googleapis.com/fcm/send"
+
+// FCM sends pushes through Firebase Cloud Messaging, authenticating with the
+// server key of the project.
+type FCM struct {
+	// Endpoint is FCMEndpoint unless testing.
+	Endpoint  string
+	ServerKey string
+	Client    *http.Client
+}
+
+type fcmRequest struct {
+	To       string            `json:"to"`
+	Priority string            `json:"priority"`
+	TTL      int               `json:"time_to_live"`
+	Data     map[string]string `json:"data"`
+}
+
+type fcmResponse struct {
+	Failure int `json:"failure"`
+	Results []struct {
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+// Notify sends a high-priority data push to a device, leaving it to the app
+// to present.
+func (f *FCM) Notify(token string, msg Message) error {
+	body, err := json.Marshal(fcmRequest{
+		To:       token,
+		Priority: "high",
+		// Calls are only worth ringing for a short while.
+		TTL: 60,
+		Data: map[string]string{
+			"type":          msg.Type,
+			"fromAccountId": strconv.Itoa(msg.FromID),
+			"fromName":      msg.FromName,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", f.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "key="+f.ServerKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("push: FCM responded with %v", res.StatusCode)
+	}
+
+	var fcmRes fcmResponse
+	if err := json.NewDecoder(res.Body).Decode(&fcmRes); err != nil {
+		return err
+	}
+
+	if fcmRes.Failure == 0 {
+		return nil
+	}
+	for _, result := range fcmRes.Results {
+		switch result.Error {
+		case "":
+		case "NotRegistered", "InvalidRegistration":
+			return ErrUnregistered
+		default:
+			return fmt.Errorf("push: FCM failed with %v", result.Error)
+		}
+	}
+
+	return fmt.Errorf("push: FCM failed")
+}
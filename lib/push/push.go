@@ -0,0 +1,65 @@
+// Package push sends push notifications to devices, so that accounts without
+// an open relay connection can still be told about incoming calls.
+package push
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	// PlatformAPNS is the platform name of Apple devices.
+	PlatformAPNS = "apns"
+	// PlatformFCM is the platform name of devices using Firebase Cloud
+	// Messaging.
+	PlatformFCM = "fcm"
+)
+
+// ErrUnregistered is returned when the push service no longer recognizes a
+// device token. The token should be forgotten.
+var ErrUnregistered = errors.New("push: device token is no longer registered")
+
+// Message is what a push tells a device.
+type Message struct {
+	// Type is the type of the relay message that triggered the push.
+	Type     string
+	FromID   int
+	FromName string
+}
+
+// Notifier delivers pushes to the devices of one platform.
+type Notifier interface {
+	Notify(token string, msg Message) error
+}
+
+// Sent is a push recorded by Fake.
+type Sent struct {
+	Token   string
+	Message Message
+}
+
+// Fake is a Notifier that records pushes instead of sending them.
+type Fake struct {
+	mutex sync.Mutex
+	sent  []Sent
+	// Err, if set, is returned by Notify instead of recording the push.
+	Err error
+}
+
+// Notify records a push.
+func (f *Fake) Notify(token string, msg Message) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.sent = append(f.sent, Sent{Token: token, Message: msg})
+	return nil
+}
+
+// Sent returns every push recorded so far, in order.
+func (f *Fake) Sent() []Sent {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Sent(nil), f.sent...)
+}
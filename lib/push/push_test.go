@@ -0,0 +1,92 @@
+package push
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPNs(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPath, gotTopic string
+	var gotPayload apnsPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Check the provider token is signed with our key.
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("authorization"), "bearer "), ".")
+		if len(parts) != 3 {
+			t.Errorf("bad provider token: %v", parts)
+		} else {
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+				t.Error("provider token signature does not verify")
+			}
+		}
+
+		gotPath = r.URL.Path
+		gotTopic = r.Header.Get("apns-topic")
+		json.NewDecoder(r.Body).Decode(&gotPayload)
+
+		if strings.HasSuffix(r.URL.Path, "/gone") {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+		}
+	}))
+	defer server.Close()
+
+	apns := &APNs{Endpoint: server.URL, Topic: "dev.airtap.app", KeyID: "KEY", TeamID: "TEAM", Key: key}
+	if err := apns.Notify("token", Message{Type: "offer", FromID: 7, FromName: "Alexander"}); err != nil {
+		t.Error(err)
+	}
+	if gotPath != "/3/device/token" || gotTopic != "dev.airtap.app" {
+		t.Errorf("bad request: %v %v", gotPath, gotTopic)
+	}
+	if gotPayload.Type != "offer" || gotPayload.FromID != 7 || !strings.Contains(gotPayload.Aps.Alert.Body, "Alexander") {
+		t.Errorf("bad payload: %+v", gotPayload)
+	}
+
+	if err := apns.Notify("gone", Message{Type: "offer", FromID: 7}); err != ErrUnregistered {
+		t.Errorf("got %v for an unregistered token", err)
+	}
+}
+
+func TestFCM(t *testing.T) {
+	var gotAuthorization string
+	var gotRequest fcmRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&gotRequest)
+
+		if gotRequest.To == "gone" {
+			w.Write([]byte(`{"failure":1,"results":[{"error":"NotRegistered"}]}`))
+		} else {
+			w.Write([]byte(`{"success":1,"failure":0,"results":[{"message_id":"1"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	fcm := &FCM{Endpoint: server.URL, ServerKey: "secret"}
+	if err := fcm.Notify("token", Message{Type: "offer", FromID: 7, FromName: "Alexander"}); err != nil {
+		t.Error(err)
+	}
+	if gotAuthorization != "key=secret" || gotRequest.To != "token" || gotRequest.Data["fromAccountId"] != "7" {
+		t.Errorf("bad request: %v %+v", gotAuthorization, gotRequest)
+	}
+
+	if err := fcm.Notify("gone", Message{Type: "offer", FromID: 7}); err != ErrUnregistered {
+		t.Errorf("got %v for an unregistered token", err)
+	}
+}
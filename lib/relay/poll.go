@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// PollWait is how long a long-poll waits for frames before returning
+	// empty-handed. Heroku gives up on requests after 30 seconds.
+	PollWait = 25 * time.Second
+	// PollIdleTimeout is how long a long-polling client may go without
+	// polling before its transport is closed.
+	PollIdleTimeout = 30 * time.Second
+)
+
+// ErrTransportClosed is returned when using a transport that has been closed.
+var ErrTransportClosed = errors.New("transport closed")
+
+// PollTransport is a Transport for clients that can't hold a websocket open.
+// Frames from the client are pushed in one request at a time, and frames to
+// the client queue up until it polls for them.
+type PollTransport struct {
+	clock    Clock
+	incoming chan []byte
+	closed   chan struct{}
+	closer   sync.Once
+
+	mutex sync.Mutex
+	// outgoing holds frames the client hasn't polled for yet.
+	outgoing [][]byte
+	// ready is closed, and replaced, whenever a frame is queued.
+	ready chan struct{}
+	// polling counts the polls in progress. The transport is only idle when
+	// there are none.
+	polling   int
+	idleTimer Timer
+}
+
+// NewPollTransport creates a transport that closes itself if the client does
+// not poll for PollIdleTimeout.
+func NewPollTransport(clock Clock) *PollTransport {
+	t := &PollTransport{
+		clock:    clock,
+		incoming: make(chan []byte),
+		closed:   make(chan struct{}),
+		ready:    make(chan struct{}),
+	}
+	t.idleTimer = clock.AfterFunc(PollIdleTimeout, func() { t.Close() })
+	return t
+}
+
+// ReadMessage blocks until the client pushes a frame.
+func (t *PollTransport) ReadMessage() ([]byte, error) {
+	select {
+	case p := <-t.incoming:
+		return p, nil
+	case <-t.closed:
+		return []byte{}, ErrTransportClosed
+	}
+}
+
+// WriteMessage queues a frame for the next poll.
+func (t *PollTransport) WriteMessage(p []byte) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	select {
+	case <-t.closed:
+		return ErrTransportClosed
+	default:
+	}
+
+	t.outgoing = append(t.outgoing, p)
+	close(t.ready)
+	t.ready = make(chan struct{})
+	return nil
+}
+
+// Close closes the transport. Closing it more than once does nothing.
+func (t *PollTransport) Close() error {
+	t.closer.Do(func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.idleTimer.Stop()
+		close(t.closed)
+	})
+	return nil
+}
+
+// Done returns a channel that's closed when the transport is.
+func (t *PollTransport) Done() <-chan struct{} {
+	return t.closed
+}
+
+// Closed returns whether the transport has been closed.
+func (t *PollTransport) Closed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Push hands frames sent by the client to the relay, in order. It returns once
+// the relay has taken all of them.
+func (t *PollTransport) Push(frames [][]byte) error {
+	for _, p := range frames {
+		select {
+		case t.incoming <- p:
+		case <-t.closed:
+			return ErrTransportClosed
+		}
+	}
+	return nil
+}
+
+// Poll waits up to PollWait for frames to the client and returns all of them.
+// It returns early, with nothing, if cancel is closed.
+func (t *PollTransport) Poll(cancel <-chan struct{}) ([][]byte, error) {
+	t.mutex.Lock()
+	if t.polling == 0 {
+		t.idleTimer.Stop()
+	}
+	t.polling++
+	t.mutex.Unlock()
+
+	defer func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.polling--
+		if t.polling == 0 && !t.Closed() {
+			t.idleTimer = t.clock.AfterFunc(PollIdleTimeout, func() { t.Close() })
+		}
+	}()
+
+	expired := make(chan struct{})
+	timer := t.clock.AfterFunc(PollWait, func() { close(expired) })
+	defer timer.Stop()
+
+	for {
+		t.mutex.Lock()
+		if len(t.outgoing) != 0 {
+			frames := t.outgoing
+			t.outgoing = nil
+			t.mutex.Unlock()
+			return frames, nil
+		}
+		ready := t.ready
+		t.mutex.Unlock()
+
+		select {
+		case <-ready:
+		case <-expired:
+			return nil, nil
+		case <-cancel:
+			return nil, nil
+		case <-t.closed:
+			return nil, ErrTransportClosed
+		}
+	}
+}
+
+// PollServer serves long-polling clients through a pool, keeping one
+// transport per account.
+type PollServer struct {
+	pool       *Pool
+	mutex      sync.Mutex
+	transports map[int]*PollTransport
+}
+
+// NewPollServer creates a PollServer relaying through pool.
+func NewPollServer(pool *Pool) *PollServer {
+	return &PollServer{
+		pool:       pool,
+		transports: make(map[int]*PollTransport),
+	}
+}
+
+// Transport returns the open transport of an account, connecting a new one to
+// the pool if there isn't one.
+func (s *PollServer) Transport(id int) *PollTransport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if t, ok := s.transports[id]; ok && !t.Closed() {
+		return t
+	}
+
+	t := NewPollTransport(s.pool.clock)
+	s.transports[id] = t
+	go func() {
+		s.pool.Serve(id, t)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.transports[id] == t {
+			delete(s.transports, id)
+		}
+	}()
+
+	return t
+}
+
+// Send passes frames from an account to the relay.
+func (s *PollServer) Send(id int, frames [][]byte) error {
+	return s.Transport(id).Push(frames)
+}
+
+// Receive long-polls for frames to an account.
+func (s *PollServer) Receive(id int, cancel <-chan struct{}) ([][]byte, error) {
+	return s.Transport(id).Poll(cancel)
+}
+
+// Disconnect closes the transport of an account, if it has one open.
+func (s *PollServer) Disconnect(id int) {
+	s.mutex.Lock()
+	t, ok := s.transports[id]
+	s.mutex.Unlock()
+
+	if ok {
+		t.Close()
+	}
+}
@@ -0,0 +1,286 @@
+package relay
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PresenceInterval is how often a connection is sent the list of its online
+// peers.
+const PresenceInterval = 15 * time.Second
+
+// Pool keeps track of the relay connections of all online accounts and routes
+// messages between them.
+type Pool struct {
+	rwMutex     sync.RWMutex
+	connections map[int]*Conn
+	clock       Clock
+
+	// OnAckTimeout, if set, is called whenever a message sent to an account
+	// is never acknowledged.
+	OnAckTimeout func(accountID, nonce int)
+	// OnOffline, if set, is called whenever an account sends an offer or an
+	// invite to an account that isn't connected. It is called from the read loop of the
+	// sender, so it must not block.
+	OnOffline func(fromID, toID int, msgType string)
+	// AllowInvite, if set, decides whether an account may invite another.
+	// It is called from the read loop of the sender.
+	AllowInvite func(fromID, toID int) bool
+}
+
+// NewPool creates an empty pool that measures time with clock.
+func NewPool(clock Clock) *Pool {
+	return &Pool{
+		connections: make(map[int]*Conn),
+		clock:       clock,
+	}
+}
+
+// Conn returns the live connection of an account, if there is one.
+func (p *Pool) Conn(id int) (*Conn, bool) {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+	conn, ok := p.connections[id]
+	return conn, ok
+}
+
+// Serve registers the connection of an account with the pool and relays its
+// messages until the transport fails.
+func (p *Pool) Serve(id int, transport Transport) error {
+	relayConn := NewConn(id, transport, p.clock)
+	relayConn.onAckTimeout = func(nonce int) {
+		if p.OnAckTimeout != nil {
+			p.OnAckTimeout(id, nonce)
+		}
+	}
+
+	p.rwMutex.Lock()
+	p.connections[id] = relayConn
+	p.rwMutex.Unlock()
+
+	// Need to send ping messages every 30 seconds down the connection so that
+	// Heroku doesn't reap it. In our case we are going to send messages with a
+	// list of online peers every 15 seconds instead of pings.
+	ticker := p.clock.NewTicker(PresenceInterval)
+	stopPing := make(chan bool)
+	// Start a goroutine for pings.
+	go func() {
+		for {
+			select {
+			case <-ticker.C():
+				relayConn.SendOnlinePeers(p.buildOnlinePeers(relayConn))
+			case <-stopPing:
+				return
+			}
+		}
+	}()
+
+	// Deallocate connection resources upon return.
+	defer func() {
+		// Remove the connection from the pool, unless the account has already
+		// reconnected and replaced it.
+		p.rwMutex.Lock()
+		if p.connections[id] == relayConn {
+			delete(p.connections, id)
+		}
+		p.rwMutex.Unlock()
+		// Deallocate the pinger goroutine.
+		ticker.Stop()
+		close(stopPing)
+		// Close the connection.
+		relayConn.Close()
+	}()
+
+	for {
+		msg, err := relayConn.Read()
+		if err != nil {
+			return err
+		} else if len(msg) == 0 {
+			continue
+		}
+
+		// Assume the message is ACK. Try to parse as such.
+		ackMessage := IncomingACKMessage{}
+		err = json.Unmarshal(msg, &ackMessage)
+		if err == nil && strings.ToLower(ackMessage.Type) == ACK {
+			relayConn.MarkAcked(ackMessage.Nonce)
+			continue
+		} else if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			// Since we don't know the message type and are trying to parse it
+			// sequentially, an error of type UnmarshalTypeError simply means we
+			// should carry on. Any other error, however, is problematic.
+			log.Print(err)
+			continue
+		}
+
+		// Assume the message is OFFER. Try to parse as such.
+		offerMessage := IncomingOfferMessage{}
+		err = json.Unmarshal(msg, &offerMessage)
+		if err == nil && strings.ToLower(offerMessage.Type) == OFFER {
+			p.handleOffer(relayConn, offerMessage.Payload.Offer, offerMessage.Payload.Sealed, id, offerMessage.Payload.ToID)
+			relayConn.SendAck(offerMessage.Nonce)
+			continue
+		} else if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			// Since we don't know the message type and are trying to parse it
+			// sequentially, an error of type UnmarshalTypeError simply means we
+			// should carry on. Any other error, however, is problematic.
+			log.Print(err)
+			continue
+		}
+
+		// Assume the message is INVITE. Try to parse as such.
+		inviteMessage := IncomingInviteMessage{}
+		err = json.Unmarshal(msg, &inviteMessage)
+		if err == nil && strings.ToLower(inviteMessage.Type) == INVITE {
+			p.handleInvite(relayConn, inviteMessage.Payload.Invite, inviteMessage.Payload.Sealed, id, inviteMessage.Payload.ToID)
+			relayConn.SendAck(inviteMessage.Nonce)
+			continue
+		} else if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			// Since we don't know the message type and are trying to parse it
+			// sequentially, an error of type UnmarshalTypeError simply means we
+			// should carry on. Any other error, however, is problematic.
+			log.Print(err)
+			continue
+		}
+
+		// Assume the message is ANSWER. Try to parse as such.
+		answerMessage := IncomingAnswerMessage{}
+		err = json.Unmarshal(msg, &answerMessage)
+		if err == nil && strings.ToLower(answerMessage.Type) == ANSWER {
+			p.handleAnswer(relayConn, answerMessage.Payload.Answer, answerMessage.Payload.Sealed, id, answerMessage.Payload.ToID)
+			relayConn.SendAck(answerMessage.Nonce)
+			continue
+		} else if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			// Since we don't know the message type and are trying to parse it
+			// sequentially, an error of type UnmarshalTypeError simply means we
+			// should carry on. Any other error, however, is problematic.
+			log.Print(err)
+			continue
+		}
+
+		// Assume the message is INFO. Try to parse as such.
+		infoMessage := IncomingInfoMessage{}
+		err = json.Unmarshal(msg, &infoMessage)
+		if err == nil && strings.ToLower(infoMessage.Type) == INFO {
+			p.handleInfo(relayConn, infoMessage.Payload.Info, infoMessage.Payload.Sealed, id, infoMessage.Payload.ToID)
+			relayConn.SendAck(infoMessage.Nonce)
+			continue
+		} else if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			// Since we don't know the message type and are trying to parse
+			// it sequentially, an error of type UnmarshalTypeError simply
+			// means we should carry on. Any other error, however, is
+			// problematic.
+			log.Print(err)
+			continue
+		}
+
+		// Assume the message is CANDIDATE. Try to parse as such.
+		candidateMessage := IncomingCandidateMessage{}
+		err = json.Unmarshal(msg, &candidateMessage)
+		if err == nil && strings.ToLower(candidateMessage.Type) == CANDIDATE {
+			p.handleCandidate(relayConn, candidateMessage.Payload.Candidate, candidateMessage.Payload.Sealed, id, candidateMessage.Payload.ToID)
+			relayConn.SendAck(candidateMessage.Nonce)
+			continue
+		} else {
+			// At this point the message has to parse as CANDIDATE. The entire
+			// else clause is indicative of a problem.
+			log.Printf("Unknown message type: %v, %v", err, string(msg))
+			continue
+		}
+	}
+}
+
+func (p *Pool) handleOffer(conn *Conn, offer interface{}, sealed Sealed, selfID, peerID int) {
+	conn.StoreOffer(peerID, offer)
+
+	if peer, ok := p.Conn(peerID); ok {
+		if peer.IsExpectingOfferFrom(selfID) {
+			conn.RelayOffer(peer, offer, sealed)
+		}
+	} else if p.OnOffline != nil {
+		p.OnOffline(selfID, peerID, OFFER)
+	}
+}
+
+func (p *Pool) handleInvite(conn *Conn, invite interface{}, sealed Sealed, selfID, peerID int) {
+	if p.AllowInvite != nil && !p.AllowInvite(selfID, peerID) {
+		return
+	}
+
+	if peer, ok := p.Conn(peerID); ok {
+		conn.RelayInvite(peer, invite, sealed)
+	} else if p.OnOffline != nil {
+		p.OnOffline(selfID, peerID, INVITE)
+	}
+}
+
+func (p *Pool) handleAnswer(conn *Conn, answer interface{}, sealed Sealed, selfID, peerID int) {
+	if peer, ok := p.Conn(peerID); ok {
+		if peer.IsExpectingAnswerFrom(selfID) {
+			conn.RelayAnswer(peer, answer, sealed)
+		}
+	}
+}
+
+func (p *Pool) handleInfo(conn *Conn, info interface{}, sealed Sealed, selfID, peerID int) {
+	if peer, ok := p.Conn(peerID); ok {
+		if peer.IsEstablishedWith(selfID) {
+			conn.RelayInfo(peer, info, sealed)
+		}
+	}
+}
+
+func (p *Pool) handleCandidate(conn *Conn, candidate interface{}, sealed Sealed, selfID, peerID int) {
+	if peer, ok := p.Conn(peerID); ok {
+		conn.RelayCandidate(peer, candidate, sealed)
+	}
+}
+
+// SendProfile sends an account's new profile to every connected peer it has
+// exchanged signaling with, whichever of them started it.
+func (p *Pool) SendProfile(id int, firstName, lastName string) {
+	for _, peer := range p.peersOf(id) {
+		peer.SendProfile(id, firstName, lastName)
+	}
+}
+
+// peersOf returns the connections of the peers an account has exchanged
+// signaling with.
+func (p *Pool) peersOf(id int) []*Conn {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+
+	known := make(map[int]bool)
+	if conn, ok := p.connections[id]; ok {
+		for _, peerID := range conn.GetPeers() {
+			known[peerID] = true
+		}
+	}
+
+	var peers []*Conn
+	for peerID, conn := range p.connections {
+		if peerID != id && (known[peerID] || conn.hasPeer(id)) {
+			peers = append(peers, conn)
+		}
+	}
+	return peers
+}
+
+// This function takes a connection, builds a set of all peers it might be in
+// communication with, and then returns a subset of that set with only those
+// peers that are online.
+func (p *Pool) buildOnlinePeers(conn *Conn) (onlinePeers []int) {
+	peers := conn.GetPeers()
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+	for _, peerID := range peers {
+		if c, ok := p.connections[peerID]; ok && c.IsOnline() {
+			onlinePeers = append(onlinePeers, peerID)
+		}
+	}
+
+	return onlinePeers
+}
@@ -5,8 +5,6 @@ import (
 	"log"
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -22,8 +20,18 @@ const (
 	INFO = "info"
 	// ONLINEPEERS lists peers that are online.
 	ONLINEPEERS = "onlinePeers"
+	// PROFILE tells peers an account's profile changed.
+	PROFILE = "profile"
+	// INVITE asks a peer to call back, such as to join a call.
+	INVITE = "invite"
 )
 
+// Sealed is a payload encrypted end to end between two accounts with their
+// registered public keys. Offers, answers, candidates and infos can all carry
+// one instead of their cleartext counterpart. The relay forwards it as is and
+// never looks inside; only the routing metadata stays in the clear.
+type Sealed = json.RawMessage
+
 // IncomingACKMessage represents a received informational message.
 type IncomingInfoMessage struct {
 	Type    string              `json:"type"`
@@ -33,14 +41,16 @@ type IncomingInfoMessage struct {
 
 // IncomingInfoPayload represents a received informational payload.
 type IncomingInfoPayload struct {
-	ToID int         `json:"toAccountId"`
-	Info interface{} `json:"info"`
+	ToID   int         `json:"toAccountId"`
+	Info   interface{} `json:"info"`
+	Sealed Sealed      `json:"sealed,omitempty"`
 }
 
 // OutgoingInfoPayload represents an outgoing candidate payload.
 type OutgoingInfoPayload struct {
 	FromID int         `json:"fromAccountId"`
 	Info   interface{} `json:"info"`
+	Sealed Sealed      `json:"sealed,omitempty"`
 }
 
 type outgoingInfoMessage struct {
@@ -71,10 +81,51 @@ type OutgoingOnlinePeersPayload struct {
 	OnlinePeers []int `json:"onlinePeers"`
 }
 
+type outgoingProfileMessage struct {
+	Type    string                 `json:"type"`
+	Nonce   int                    `json:"nonce"`
+	Payload OutgoingProfilePayload `json:"payload"`
+}
+
+// OutgoingProfilePayload represents an account's new profile.
+type OutgoingProfilePayload struct {
+	AccountID int    `json:"accountId"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName,omitempty"`
+}
+
+// IncomingInvitePayload represents a received invite payload.
+type IncomingInvitePayload struct {
+	ToID   int         `json:"toAccountId"`
+	Invite interface{} `json:"invite"`
+	Sealed Sealed      `json:"sealed,omitempty"`
+}
+
+// IncomingInviteMessage represents a received invite message.
+type IncomingInviteMessage struct {
+	Type    string                `json:"type"`
+	Nonce   int                   `json:"nonce"`
+	Payload IncomingInvitePayload `json:"payload"`
+}
+
+// OutgoingInvitePayload represents an outgoing invite payload.
+type OutgoingInvitePayload struct {
+	FromID int         `json:"fromAccountId"`
+	Invite interface{} `json:"invite"`
+	Sealed Sealed      `json:"sealed,omitempty"`
+}
+
+type outgoingInviteMessage struct {
+	Type    string                `json:"type"`
+	Nonce   int                   `json:"nonce"`
+	Payload OutgoingInvitePayload `json:"payload"`
+}
+
 // IncomingOfferPayload represents a received offer payload.
 type IncomingOfferPayload struct {
-	ToID  int         `json:"toAccountId"`
-	Offer interface{} `json:"offer"`
+	ToID   int         `json:"toAccountId"`
+	Offer  interface{} `json:"offer"`
+	Sealed Sealed      `json:"sealed,omitempty"`
 }
 
 // IncomingOfferMessage represents a received offer message.
@@ -88,6 +139,7 @@ type IncomingOfferMessage struct {
 type OutgoingOfferPayload struct {
 	FromID int         `json:"fromAccountId"`
 	Offer  interface{} `json:"offer"`
+	Sealed Sealed      `json:"sealed,omitempty"`
 }
 
 type outgoingOfferMessage struct {
@@ -100,6 +152,7 @@ type outgoingOfferMessage struct {
 type IncomingAnswerPaylaod struct {
 	ToID   int         `json:"toAccountId"`
 	Answer interface{} `json:"answer"`
+	Sealed Sealed      `json:"sealed,omitempty"`
 }
 
 // IncomingAnswerMessage represents a received answer message.
@@ -113,6 +166,7 @@ type IncomingAnswerMessage struct {
 type OutgoingAnswerPayload struct {
 	FromID int         `json:"fromAccountId"`
 	Answer interface{} `json:"answer"`
+	Sealed Sealed      `json:"sealed,omitempty"`
 }
 
 type outgoingAnswerMessage struct {
@@ -125,6 +179,7 @@ type outgoingAnswerMessage struct {
 type IncomingCandidatePayload struct {
 	ToID      int         `json:"toAccountId"`
 	Candidate interface{} `json:"candidate"`
+	Sealed    Sealed      `json:"sealed,omitempty"`
 }
 
 // IncomingCandidateMessage represents an outgoing candidate message.
@@ -138,6 +193,7 @@ type IncomingCandidateMessage struct {
 type OutgoingCandidatePayload struct {
 	FromID    int         `json:"fromAccountId"`
 	Candidate interface{} `json:"candidate"`
+	Sealed    Sealed      `json:"sealed,omitempty"`
 }
 
 type outgoingCandidateMessage struct {
@@ -146,18 +202,30 @@ type outgoingCandidateMessage struct {
 	Payload OutgoingCandidatePayload `json:"payload"`
 }
 
+// AckTimeout is how long a message may go unacknowledged before it is
+// considered lost.
+const AckTimeout = 1 * time.Minute
+
+// PresenceTimeout is how long a connection may stay silent before it is
+// considered offline.
+const PresenceTimeout = 20 * time.Second
+
 // Conn represents a relay connection.
 type Conn struct {
-	// Lock for the underlying websocket connection reader.
+	// Lock for the underlying transport reader.
 	rLock sync.Mutex
-	// Lock for the underlying websocket connection writer.
+	// Lock for the underlying transport writer. It is held for the whole of
+	// an outgoing delivery so that nonces go out in order.
 	wLock sync.Mutex
 	// Lock for the Conn struct itself.
 	rwMutex           sync.RWMutex
-	conn              *websocket.Conn
+	transport         Transport
+	clock             Clock
 	id                int
 	lastOutgoingNonce int
-	unackedNonces     map[int]*time.Timer
+	unackedNonces     map[int]Timer
+	// onAckTimeout is called when an outgoing message is never acknowledged.
+	onAckTimeout func(nonce int)
 	// offersFor lists for whom the connection has offers.
 	offersFor map[int]bool
 	// expectingAnswersFrom lists from whom the connection is expecting answers,
@@ -169,10 +237,16 @@ type Conn struct {
 	mostRecentMessage time.Time
 }
 
+// ID returns the account ID the connection belongs to.
+func (c *Conn) ID() int {
+	return c.id
+}
+
+// IsOnline returns whether the connection has sent anything recently.
 func (c *Conn) IsOnline() bool {
 	c.rwMutex.RLock()
 	defer c.rwMutex.RUnlock()
-	return time.Since(c.mostRecentMessage) < 20*time.Second
+	return c.clock.Now().Sub(c.mostRecentMessage) < PresenceTimeout
 }
 
 // Close closes the connection.
@@ -189,8 +263,7 @@ func (c *Conn) Close() {
 	c.wLock.Lock()
 	defer c.wLock.Unlock()
 
-	c.conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(1*time.Second))
-	c.conn.Close()
+	c.transport.Close()
 }
 
 // Read reads from the connection.
@@ -198,23 +271,27 @@ func (c *Conn) Read() ([]byte, error) {
 	c.rLock.Lock()
 	defer c.rLock.Unlock()
 
-	messageType, p, err := c.conn.ReadMessage()
+	p, err := c.transport.ReadMessage()
 	if err != nil {
 		return []byte{}, err
-	} else if messageType != websocket.TextMessage {
-		return []byte{}, nil
 	}
 
 	// If we read a message of non-zero length, update the most recent
 	// timestamp.
 	if len(p) != 0 {
-		c.mostRecentMessage = time.Now()
+		c.rwMutex.Lock()
+		c.mostRecentMessage = c.clock.Now()
+		c.rwMutex.Unlock()
 	}
 
 	return p, nil
 }
 
+// GetPeers returns every peer the connection has exchanged signaling with.
 func (c *Conn) GetPeers() []int {
+	c.rwMutex.RLock()
+	defer c.rwMutex.RUnlock()
+
 	uniquePeers := make(map[int]bool)
 	for id := range c.offersFor {
 		uniquePeers[id] = true
@@ -233,24 +310,34 @@ func (c *Conn) GetPeers() []int {
 	return peers
 }
 
+// hasPeer returns whether the connection has exchanged signaling with a
+// particular peer.
+func (c *Conn) hasPeer(peerID int) bool {
+	c.rwMutex.RLock()
+	defer c.rwMutex.RUnlock()
+	return c.offersFor[peerID] || c.expectingAnswersFrom[peerID] || c.establishedWith[peerID]
+}
+
 // NewConn creates a connection.
-func NewConn(id int, wsConn *websocket.Conn) *Conn {
+func NewConn(id int, transport Transport, clock Clock) *Conn {
 	c := Conn{
-		conn:                 wsConn,
+		transport:            transport,
+		clock:                clock,
 		id:                   id,
 		lastOutgoingNonce:    0,
-		unackedNonces:        make(map[int]*time.Timer),
+		unackedNonces:        make(map[int]Timer),
 		offersFor:            make(map[int]bool),
 		expectingAnswersFrom: make(map[int]bool),
 		establishedWith:      make(map[int]bool),
 	}
 
-	wsConn.SetPongHandler(func(appData string) error {
-		c.rwMutex.Lock()
-		defer c.rwMutex.Unlock()
-		c.mostRecentMessage = time.Now()
-		return nil
-	})
+	if t, ok := transport.(heartbeatTransport); ok {
+		t.OnHeartbeat(func() {
+			c.rwMutex.Lock()
+			defer c.rwMutex.Unlock()
+			c.mostRecentMessage = c.clock.Now()
+		})
+	}
 
 	return &c
 }
@@ -296,30 +383,63 @@ func (c *Conn) IsExpectingAnswerFrom(peerID int) bool {
 	return c.expectingAnswersFrom[peerID]
 }
 
-// RelayAnswer relays an answer to a peer connection.
-func (c *Conn) RelayAnswer(peer *Conn, answer interface{}) {
-	msg := outgoingAnswerMessage{
-		Type:  ANSWER,
-		Nonce: peer.lastOutgoingNonce + 1,
-		Payload: OutgoingAnswerPayload{
-			FromID: c.id,
-			Answer: answer,
-		},
-	}
+// deliver writes the message built for the next outgoing nonce and starts
+// waiting for its acknowledgement.
+func (c *Conn) deliver(build func(nonce int) interface{}) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	// Nonces only ever change under wLock, so reading it here is safe.
+	c.rwMutex.RLock()
+	nonce := c.lastOutgoingNonce + 1
+	c.rwMutex.RUnlock()
 
+	msg := build(nonce)
 	json, err := json.Marshal(msg)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	peer.wLock.Lock()
-	if err := peer.conn.WriteMessage(websocket.TextMessage, json); err != nil {
+	if err := c.transport.WriteMessage(json); err != nil {
+		return err
+	}
+
+	c.rwMutex.Lock()
+	defer c.rwMutex.Unlock()
+	c.lastOutgoingNonce = nonce
+	c.unackedNonces[nonce] = c.clock.AfterFunc(AckTimeout, func() {
+		log.Printf("Never received ACK to message %v from account %v", msg, c.id)
+
+		c.rwMutex.Lock()
+		delete(c.unackedNonces, nonce)
+		onAckTimeout := c.onAckTimeout
+		c.rwMutex.Unlock()
+
+		if onAckTimeout != nil {
+			onAckTimeout(nonce)
+		}
+	})
+
+	return nil
+}
+
+// RelayAnswer relays an answer to a peer connection.
+func (c *Conn) RelayAnswer(peer *Conn, answer interface{}, sealed Sealed) {
+	err := peer.deliver(func(nonce int) interface{} {
+		return outgoingAnswerMessage{
+			Type:  ANSWER,
+			Nonce: nonce,
+			Payload: OutgoingAnswerPayload{
+				FromID: c.id,
+				Answer: answer,
+				Sealed: sealed,
+			},
+		}
+	})
+	if err != nil {
 		log.Print(err)
-		peer.wLock.Unlock()
 		return
 	}
-	peer.wLock.Unlock()
 
 	c.rwMutex.Lock()
 	c.establishedWith[peer.id] = true
@@ -329,123 +449,100 @@ func (c *Conn) RelayAnswer(peer *Conn, answer interface{}) {
 	defer peer.rwMutex.Unlock()
 	peer.establishedWith[c.id] = true
 	delete(peer.expectingAnswersFrom, c.id)
-	peer.lastOutgoingNonce++
-	peer.unackedNonces[peer.lastOutgoingNonce] = time.AfterFunc(1*time.Minute, func() {
-		log.Printf("Never received ACK to message %v from account %v", msg, peer.id)
-	})
 }
 
 // RelayInfo relays an airbitrary message to a peer connection.
-func (c *Conn) RelayInfo(peer *Conn, info interface{}) {
-	msg := outgoingInfoMessage{
-		Type:  INFO,
-		Nonce: peer.lastOutgoingNonce + 1,
-		Payload: OutgoingInfoPayload{
-			FromID: c.id,
-			Info:   info,
-		},
-	}
-
-	json, err := json.Marshal(msg)
+func (c *Conn) RelayInfo(peer *Conn, info interface{}, sealed Sealed) {
+	err := peer.deliver(func(nonce int) interface{} {
+		return outgoingInfoMessage{
+			Type:  INFO,
+			Nonce: nonce,
+			Payload: OutgoingInfoPayload{
+				FromID: c.id,
+				Info:   info,
+				Sealed: sealed,
+			},
+		}
+	})
 	if err != nil {
 		log.Print(err)
-		return
-	}
-
-	peer.wLock.Lock()
-	if err := peer.conn.WriteMessage(websocket.TextMessage, json); err != nil {
-		log.Print(err)
-		peer.wLock.Unlock()
-		return
 	}
-	peer.wLock.Unlock()
-
-	peer.rwMutex.Lock()
-	defer peer.rwMutex.Unlock()
-	peer.lastOutgoingNonce++
-	peer.unackedNonces[peer.lastOutgoingNonce] = time.AfterFunc(1*time.Minute, func() {
-		log.Printf("Never received ACK to message %v from account %v", msg, peer.id)
-	})
 }
 
 // RelayCandidate relays a candidate to a peer connection.
-func (c *Conn) RelayCandidate(peer *Conn, candidate interface{}) {
-	msg := outgoingCandidateMessage{
-		Type:  CANDIDATE,
-		Nonce: peer.lastOutgoingNonce + 1,
-		Payload: OutgoingCandidatePayload{
-			FromID:    c.id,
-			Candidate: candidate,
-		},
-	}
-
-	json, err := json.Marshal(msg)
+func (c *Conn) RelayCandidate(peer *Conn, candidate interface{}, sealed Sealed) {
+	err := peer.deliver(func(nonce int) interface{} {
+		return outgoingCandidateMessage{
+			Type:  CANDIDATE,
+			Nonce: nonce,
+			Payload: OutgoingCandidatePayload{
+				FromID:    c.id,
+				Candidate: candidate,
+				Sealed:    sealed,
+			},
+		}
+	})
 	if err != nil {
 		log.Print(err)
-		return
-	}
-
-	peer.wLock.Lock()
-	if err := peer.conn.WriteMessage(websocket.TextMessage, json); err != nil {
-		log.Print(err)
-		peer.wLock.Unlock()
-		return
 	}
-	peer.wLock.Unlock()
-
-	peer.rwMutex.Lock()
-	defer peer.rwMutex.Unlock()
-	peer.lastOutgoingNonce++
-	peer.unackedNonces[peer.lastOutgoingNonce] = time.AfterFunc(1*time.Minute, func() {
-		log.Printf("Never received ACK to message %v from account %v", msg, peer.id)
-	})
 }
 
 // RelayOffer relays an offer to a peer connection.
-func (c *Conn) RelayOffer(peer *Conn, offer interface{}) {
-	msg := outgoingOfferMessage{
-		Type:  OFFER,
-		Nonce: peer.lastOutgoingNonce + 1,
-		Payload: OutgoingOfferPayload{
-			FromID: c.id,
-			Offer:  offer,
-		},
-	}
-
-	json, err := json.Marshal(msg)
+func (c *Conn) RelayOffer(peer *Conn, offer interface{}, sealed Sealed) {
+	err := peer.deliver(func(nonce int) interface{} {
+		return outgoingOfferMessage{
+			Type:  OFFER,
+			Nonce: nonce,
+			Payload: OutgoingOfferPayload{
+				FromID: c.id,
+				Offer:  offer,
+				Sealed: sealed,
+			},
+		}
+	})
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	peer.wLock.Lock()
-	if err := peer.conn.WriteMessage(websocket.TextMessage, json); err != nil {
-		log.Print(err)
-		peer.wLock.Unlock()
-		return
-	}
-	peer.wLock.Unlock()
-
-	peer.rwMutex.Lock()
-	peer.lastOutgoingNonce++
-	peer.unackedNonces[peer.lastOutgoingNonce] = time.AfterFunc(1*time.Minute, func() {
-		log.Printf("Never received ACK to message %v from account %v", msg, peer.id)
-	})
-	peer.rwMutex.Unlock()
-
 	c.rwMutex.Lock()
 	c.expectingAnswersFrom[peer.id] = true
 	c.rwMutex.Unlock()
 }
 
-// Ping sends a ping down the underlying connection.
+// RelayInvite relays an invite to a peer connection. Unlike offers, invites
+// need no signaling to have happened first.
+func (c *Conn) RelayInvite(peer *Conn, invite interface{}, sealed Sealed) {
+	err := peer.deliver(func(nonce int) interface{} {
+		return outgoingInviteMessage{
+			Type:  INVITE,
+			Nonce: nonce,
+			Payload: OutgoingInvitePayload{
+				FromID: c.id,
+				Invite: invite,
+				Sealed: sealed,
+			},
+		}
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// Ping sends a ping down the underlying connection, if its transport has such
+// a thing.
 func (c *Conn) Ping() {
+	t, ok := c.transport.(pingTransport)
+	if !ok {
+		return
+	}
+
 	c.wLock.Lock()
-	if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+	defer c.wLock.Unlock()
+	if err := t.Ping(); err != nil {
 		log.Print(err)
 		return
 	}
-	c.wLock.Unlock()
 }
 
 // SendAck sends an acknowledgement message.
@@ -462,7 +559,7 @@ func (c *Conn) SendAck(nonce int) {
 
 	c.wLock.Lock()
 	defer c.wLock.Unlock()
-	if err := c.conn.WriteMessage(websocket.TextMessage, json); err != nil {
+	if err := c.transport.WriteMessage(json); err != nil {
 		log.Print(err)
 		return
 	}
@@ -475,32 +572,34 @@ func (c *Conn) SendOnlinePeers(onlinePeers []int) {
 		onlinePeers = make([]int, 0)
 	}
 
-	msg := outgoingOnlinePeersMessage{
-		Type:  ONLINEPEERS,
-		Nonce: c.lastOutgoingNonce + 1,
-		Payload: OutgoingOnlinePeersPayload{
-			OnlinePeers: onlinePeers,
-		},
-	}
-
-	json, err := json.Marshal(msg)
+	err := c.deliver(func(nonce int) interface{} {
+		return outgoingOnlinePeersMessage{
+			Type:  ONLINEPEERS,
+			Nonce: nonce,
+			Payload: OutgoingOnlinePeersPayload{
+				OnlinePeers: onlinePeers,
+			},
+		}
+	})
 	if err != nil {
 		log.Print(err)
-		return
 	}
+}
 
-	c.wLock.Lock()
-	if err := c.conn.WriteMessage(websocket.TextMessage, json); err != nil {
+// SendProfile sends an account's new profile.
+func (c *Conn) SendProfile(accountID int, firstName, lastName string) {
+	err := c.deliver(func(nonce int) interface{} {
+		return outgoingProfileMessage{
+			Type:  PROFILE,
+			Nonce: nonce,
+			Payload: OutgoingProfilePayload{
+				AccountID: accountID,
+				FirstName: firstName,
+				LastName:  lastName,
+			},
+		}
+	})
+	if err != nil {
 		log.Print(err)
-		c.wLock.Unlock()
-		return
 	}
-	c.wLock.Unlock()
-
-	c.rwMutex.Lock()
-	c.lastOutgoingNonce++
-	c.unackedNonces[c.lastOutgoingNonce] = time.AfterFunc(1*time.Minute, func() {
-		log.Printf("Never received ACK to message %v from account %v", msg, c.id)
-	})
-	c.rwMutex.Unlock()
 }
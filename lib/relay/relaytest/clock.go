@@ -0,0 +1,131 @@
+package relaytest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"server/lib/relay"
+)
+
+// FakeClock is a relay.Clock that only moves when told to.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	tickers []*fakeTicker
+}
+
+// NewFakeClock creates a clock stopped at an arbitrary fixed time.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// Now returns the current fake time.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock has been advanced by at least d.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) relay.Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// NewTicker returns a ticker that ticks whenever the clock is advanced past
+// another multiple of d.
+func (c *FakeClock) NewTicker(d time.Duration) relay.Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTicker{
+		clock:    c,
+		period:   d,
+		deadline: c.now.Add(d),
+		// Like time.Ticker, keep one tick around and drop the rest for slow
+		// receivers.
+		c: make(chan time.Time, 1),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward, firing every timer and ticker that falls
+// due. Timer functions run synchronously, in deadline order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+
+	var due, pending []*fakeTimer
+	for _, t := range c.timers {
+		if !t.deadline.After(now) {
+			due = append(due, t)
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+
+	for _, t := range c.tickers {
+		for !t.deadline.After(now) {
+			select {
+			case t.c <- t.deadline:
+			default:
+			}
+			t.deadline = t.deadline.Add(t.period)
+		}
+	}
+	c.mutex.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].deadline.Before(due[j].deadline)
+	})
+	for _, t := range due {
+		t.f()
+	}
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	f        func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTicker struct {
+	clock    *FakeClock
+	period   time.Duration
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
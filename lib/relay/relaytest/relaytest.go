@@ -0,0 +1,460 @@
+// Package relaytest runs the relay in-process and drives it with scripted fake
+// peers, so that message routing can be tested without a database or a real
+// network. Peers connect over websockets or by long-polling.
+package relaytest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/lib/relay"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timeout is how long, in real time, a peer waits for a message before giving
+// up.
+var Timeout = 2 * time.Second
+
+// AckTimeout records a message the relay never saw acknowledged.
+type AckTimeout struct {
+	AccountID int
+	Nonce     int
+}
+
+// Server runs a relay pool with a fake clock behind an in-process HTTP server.
+type Server struct {
+	Pool       *relay.Pool
+	PollServer *relay.PollServer
+	Clock      *FakeClock
+
+	httpServer  *httptest.Server
+	mutex       sync.Mutex
+	ackTimeouts []AckTimeout
+}
+
+// NewServer starts a relay server. Peers identify themselves with the "id"
+// query parameter; there is no authentication.
+func NewServer() *Server {
+	s := &Server{Clock: NewFakeClock()}
+	s.Pool = relay.NewPool(s.Clock)
+	s.Pool.OnAckTimeout = func(accountID, nonce int) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.ackTimeouts = append(s.ackTimeouts, AckTimeout{AccountID: accountID, Nonce: nonce})
+	}
+
+	s.PollServer = relay.NewPollServer(s.Pool)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+
+		wsConn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		s.Pool.Serve(id, relay.NewWebsocketTransport(wsConn))
+	})
+	mux.HandleFunc("/poll/send", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+
+		var req pollMessages
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		frames := make([][]byte, len(req.Messages))
+		for i, msg := range req.Messages {
+			frames[i] = msg
+		}
+		if err := s.PollServer.Send(id, frames); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/poll/receive", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+
+		frames, err := s.PollServer.Receive(id, r.Context().Done())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res := pollMessages{Messages: make([]json.RawMessage, len(frames))}
+		for i, p := range frames {
+			res.Messages[i] = p
+		}
+		json.NewEncoder(w).Encode(res)
+	})
+	s.httpServer = httptest.NewServer(mux)
+
+	return s
+}
+
+type pollMessages struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// Close disconnects every peer and shuts the server down.
+func (s *Server) Close() {
+	s.httpServer.CloseClientConnections()
+	s.httpServer.Close()
+}
+
+// AckTimeouts returns every acknowledgement timeout so far, in order.
+func (s *Server) AckTimeouts() []AckTimeout {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]AckTimeout(nil), s.ackTimeouts...)
+}
+
+// Connect connects a websocket peer for an account and waits until the relay
+// has registered it.
+func (s *Server) Connect(id int) (*Peer, error) {
+	previous, _ := s.Pool.Conn(id)
+
+	url := "ws" + strings.TrimPrefix(s.httpServer.URL, "http") + "/ws?id=" + strconv.Itoa(id)
+	wsConn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.register(id, previous, websocketConn{wsConn})
+}
+
+// ConnectPolling connects a long-polling peer for an account and waits until
+// the relay has registered it.
+func (s *Server) ConnectPolling(id int) (*Peer, error) {
+	previous, _ := s.Pool.Conn(id)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return s.register(id, previous, &pollConn{
+		url:    s.httpServer.URL,
+		id:     id,
+		ctx:    ctx,
+		cancel: cancel,
+	})
+}
+
+func (s *Server) register(id int, previous *relay.Conn, conn peerConn) (*Peer, error) {
+	p := &Peer{
+		ID:       id,
+		conn:     conn,
+		autoAck:  true,
+		messages: make(chan Message, 256),
+	}
+	go p.readLoop()
+
+	deadline := time.Now().Add(Timeout)
+	for {
+		if relayConn, ok := s.Pool.Conn(id); ok && relayConn != previous {
+			p.relayConn = relayConn
+			return p, nil
+		} else if time.Now().After(deadline) {
+			conn.close()
+			return nil, fmt.Errorf("account %v never registered with the relay", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Disconnect closes the connection of a peer and waits until the relay has
+// dropped it. The relay only notices that a long-polling peer is gone once it
+// has been idle for relay.PollIdleTimeout, so advance the clock past that
+// first.
+func (s *Server) Disconnect(p *Peer) error {
+	if err := p.conn.close(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(Timeout)
+	for {
+		if conn, ok := s.Pool.Conn(p.ID); !ok || conn != p.relayConn {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("account %v was never dropped by the relay", p.ID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Message is a message received by a peer.
+type Message struct {
+	Type    string          `json:"type"`
+	Nonce   int             `json:"nonce"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Decode decodes the payload of the message into v.
+func (m Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// FromID returns the account the message was relayed from.
+func (m Message) FromID() int {
+	var payload struct {
+		FromID int `json:"fromAccountId"`
+	}
+	m.Decode(&payload)
+	return payload.FromID
+}
+
+// Peer is a fake client connected to the relay.
+type Peer struct {
+	ID int
+
+	conn      peerConn
+	relayConn *relay.Conn
+	wLock     sync.Mutex
+	nonce     int
+	mutex     sync.Mutex
+	autoAck   bool
+	messages  chan Message
+}
+
+// SetAutoAck sets whether the peer acknowledges relayed messages as soon as
+// they arrive. It does by default.
+func (p *Peer) SetAutoAck(autoAck bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.autoAck = autoAck
+}
+
+func (p *Peer) readLoop() {
+	defer close(p.messages)
+	for {
+		data, err := p.conn.read()
+		if err != nil {
+			return
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Print(err)
+			continue
+		}
+
+		p.mutex.Lock()
+		autoAck := p.autoAck
+		p.mutex.Unlock()
+		if autoAck && msg.Type != relay.ACK {
+			p.Ack(msg.Nonce)
+		}
+
+		p.messages <- msg
+	}
+}
+
+// Send sends a message of the given type, returning the nonce it used.
+func (p *Peer) Send(msgType string, payload interface{}) (int, error) {
+	p.wLock.Lock()
+	defer p.wLock.Unlock()
+	p.nonce++
+	msg := map[string]interface{}{
+		"type":    msgType,
+		"nonce":   p.nonce,
+		"payload": payload,
+	}
+	return p.nonce, p.conn.write(msg)
+}
+
+// Ack acknowledges a relayed message.
+func (p *Peer) Ack(nonce int) error {
+	p.wLock.Lock()
+	defer p.wLock.Unlock()
+	return p.conn.write(relay.IncomingACKMessage{Type: relay.ACK, Nonce: nonce})
+}
+
+// Offer sends an offer to another account.
+func (p *Peer) Offer(toID int, offer interface{}) (int, error) {
+	return p.Send(relay.OFFER, relay.IncomingOfferPayload{ToID: toID, Offer: offer})
+}
+
+// Invite sends an invite to another account.
+func (p *Peer) Invite(toID int, invite interface{}) (int, error) {
+	return p.Send(relay.INVITE, relay.IncomingInvitePayload{ToID: toID, Invite: invite})
+}
+
+// Answer sends an answer to another account.
+func (p *Peer) Answer(toID int, answer interface{}) (int, error) {
+	return p.Send(relay.ANSWER, relay.IncomingAnswerPaylaod{ToID: toID, Answer: answer})
+}
+
+// Candidate sends a candidate to another account.
+func (p *Peer) Candidate(toID int, candidate interface{}) (int, error) {
+	return p.Send(relay.CANDIDATE, relay.IncomingCandidatePayload{ToID: toID, Candidate: candidate})
+}
+
+// Info sends an informational message to another account.
+func (p *Peer) Info(toID int, info interface{}) (int, error) {
+	return p.Send(relay.INFO, relay.IncomingInfoPayload{ToID: toID, Info: info})
+}
+
+// Sync waits until the relay has processed everything the peer has sent so
+// far, including acknowledgements. It does so by sending a candidate to nobody
+// and waiting for its acknowledgement, which must be the next message.
+func (p *Peer) Sync() error {
+	if _, err := p.Candidate(0, nil); err != nil {
+		return err
+	}
+	_, err := p.Expect(relay.ACK)
+	return err
+}
+
+// Next waits for the next message the peer receives.
+func (p *Peer) Next() (Message, error) {
+	select {
+	case msg, ok := <-p.messages:
+		if !ok {
+			return Message{}, errors.New("connection closed")
+		}
+		return msg, nil
+	case <-time.After(Timeout):
+		return Message{}, fmt.Errorf("account %v received nothing in %v", p.ID, Timeout)
+	}
+}
+
+// Expect waits for the next message and checks that it has the given type.
+func (p *Peer) Expect(msgType string) (Message, error) {
+	msg, err := p.Next()
+	if err != nil {
+		return msg, err
+	} else if msg.Type != msgType {
+		return msg, fmt.Errorf("account %v expected %q, got %q with nonce %v", p.ID, msgType, msg.Type, msg.Nonce)
+	}
+	return msg, nil
+}
+
+// ExpectNothing checks that the peer receives nothing for a while.
+func (p *Peer) ExpectNothing(d time.Duration) error {
+	select {
+	case msg, ok := <-p.messages:
+		if !ok {
+			return errors.New("connection closed")
+		}
+		return fmt.Errorf("account %v expected nothing, got %q with nonce %v", p.ID, msg.Type, msg.Nonce)
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// peerConn is the client side of a transport.
+type peerConn interface {
+	read() ([]byte, error)
+	write(v interface{}) error
+	close() error
+}
+
+type websocketConn struct {
+	conn *websocket.Conn
+}
+
+func (c websocketConn) read() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+	return data, err
+}
+
+func (c websocketConn) write(v interface{}) error {
+	return c.conn.WriteJSON(v)
+}
+
+func (c websocketConn) close() error {
+	return c.conn.Close()
+}
+
+type pollConn struct {
+	url     string
+	id      int
+	ctx     context.Context
+	cancel  context.CancelFunc
+	pending []json.RawMessage
+}
+
+func (c *pollConn) endpoint(path string) string {
+	return c.url + path + "?id=" + strconv.Itoa(c.id)
+}
+
+func (c *pollConn) read() ([]byte, error) {
+	for len(c.pending) == 0 {
+		req, err := http.NewRequest("GET", c.endpoint("/poll/receive"), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := http.DefaultClient.Do(req.WithContext(c.ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		var msgs pollMessages
+		err = json.NewDecoder(res.Body).Decode(&msgs)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		c.pending = msgs.Messages
+	}
+
+	data := c.pending[0]
+	c.pending = c.pending[1:]
+	return data, nil
+}
+
+func (c *pollConn) write(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(pollMessages{Messages: []json.RawMessage{msg}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.endpoint("/poll/send"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultClient.Do(req.WithContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("sending failed with status %v", res.StatusCode)
+	}
+	return nil
+}
+
+func (c *pollConn) close() error {
+	c.cancel()
+	return nil
+}
@@ -0,0 +1,462 @@
+package relaytest
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"server/lib/relay"
+)
+
+func connect(t *testing.T, s *Server, id int) *Peer {
+	p, err := s.Connect(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func expect(t *testing.T, p *Peer, msgType string) Message {
+	msg, err := p.Expect(msgType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// establish runs the offer-answer exchange between two peers, with a offering
+// first.
+func establish(t *testing.T, a, b *Peer) {
+	if _, err := a.Offer(b.ID, "offer from a"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+
+	if _, err := b.Offer(a.ID, "offer from b"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, b, relay.ACK)
+	if msg := expect(t, a, relay.OFFER); msg.FromID() != b.ID {
+		t.Errorf("offer relayed from %v, expected %v", msg.FromID(), b.ID)
+	}
+
+	if _, err := a.Answer(b.ID, "answer from a"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	if msg := expect(t, b, relay.ANSWER); msg.FromID() != a.ID {
+		t.Errorf("answer relayed from %v, expected %v", msg.FromID(), a.ID)
+	}
+}
+
+func TestOfferAnswerInfo(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, b := connect(t, s, 1), connect(t, s, 2)
+
+	// Info is only relayed once the peers are established.
+	if _, err := a.Info(b.ID, "too early"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	if err := b.ExpectNothing(50 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	establish(t, a, b)
+
+	if _, err := a.Info(b.ID, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	msg := expect(t, b, relay.INFO)
+	var payload relay.OutgoingInfoPayload
+	if err := msg.Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if payload.FromID != a.ID || payload.Info != "hello" {
+		t.Errorf("bad info relayed: %+v", payload)
+	}
+}
+
+func TestSealedPayloads(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, b := connect(t, s, 1), connect(t, s, 2)
+
+	sealed := `"c2VhbGVkIGNhbmRpZGF0ZQ=="`
+	if _, err := a.Send(relay.CANDIDATE, map[string]interface{}{
+		"toAccountId": b.ID,
+		"sealed":      json.RawMessage(sealed),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+
+	var payload relay.OutgoingCandidatePayload
+	if err := expect(t, b, relay.CANDIDATE).Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if payload.FromID != a.ID || payload.Candidate != nil || string(payload.Sealed) != sealed {
+		t.Errorf("bad sealed candidate relayed: %v %v %s", payload.FromID, payload.Candidate, payload.Sealed)
+	}
+}
+
+func TestOfflineOffer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	type offline struct{ from, to int }
+	notified := make(chan offline, 1)
+	s.Pool.OnOffline = func(fromID, toID int, msgType string) {
+		if msgType == relay.OFFER {
+			notified <- offline{fromID, toID}
+		}
+	}
+
+	a := connect(t, s, 1)
+	if _, err := a.Offer(2, "offer to nobody"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+
+	select {
+	case n := <-notified:
+		if n.from != a.ID || n.to != 2 {
+			t.Errorf("got offline offer from %v to %v", n.from, n.to)
+		}
+	default:
+		t.Error("offline offer was not reported")
+	}
+
+	// Once the callee is online the offer is relayed instead.
+	b := connect(t, s, 2)
+	if _, err := a.Offer(b.ID, "offer to b"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	select {
+	case n := <-notified:
+		t.Errorf("got offline offer from %v to %v while online", n.from, n.to)
+	default:
+	}
+}
+
+func TestInvite(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	notified := make(chan string, 1)
+	s.Pool.OnOffline = func(fromID, toID int, msgType string) {
+		notified <- msgType
+	}
+
+	a := connect(t, s, 1)
+	if _, err := a.Invite(2, "join me"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	select {
+	case msgType := <-notified:
+		if msgType != relay.INVITE {
+			t.Errorf("got offline %v", msgType)
+		}
+	default:
+		t.Error("offline invite was not reported")
+	}
+
+	// Invites reach online peers without any signaling first.
+	b := connect(t, s, 2)
+	if _, err := a.Invite(b.ID, "join me"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	var payload relay.OutgoingInvitePayload
+	if err := expect(t, b, relay.INVITE).Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if payload.FromID != a.ID || payload.Invite != "join me" {
+		t.Errorf("bad invite relayed: %+v", payload)
+	}
+
+	// Invites the pool doesn't allow go nowhere.
+	s.Pool.AllowInvite = func(fromID, toID int) bool { return false }
+	if _, err := a.Invite(b.ID, "join me again"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	if err := b.ExpectNothing(50 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOrderingAcrossPeers(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	target := connect(t, s, 1)
+	senders := []*Peer{connect(t, s, 2), connect(t, s, 3), connect(t, s, 4)}
+
+	const count = 50
+	var wg sync.WaitGroup
+	for _, sender := range senders {
+		wg.Add(1)
+		go func(sender *Peer) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				if _, err := sender.Candidate(target.ID, i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(sender)
+	}
+	wg.Wait()
+
+	next := make(map[int]int)
+	for i := 0; i < count*len(senders); i++ {
+		msg := expect(t, target, relay.CANDIDATE)
+		if msg.Nonce != i+1 {
+			t.Errorf("got nonce %v, expected %v", msg.Nonce, i+1)
+		}
+
+		var payload relay.OutgoingCandidatePayload
+		if err := msg.Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+		if int(payload.Candidate.(float64)) != next[payload.FromID] {
+			t.Errorf("candidate %v from %v arrived out of order", payload.Candidate, payload.FromID)
+		}
+		next[payload.FromID]++
+	}
+
+	for _, sender := range senders {
+		if next[sender.ID] != count {
+			t.Errorf("got %v candidates from %v, expected %v", next[sender.ID], sender.ID, count)
+		}
+		for i := 0; i < count; i++ {
+			expect(t, sender, relay.ACK)
+		}
+	}
+}
+
+func TestDisconnectAndReconnect(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, b := connect(t, s, 1), connect(t, s, 2)
+
+	if _, err := a.Candidate(b.ID, "first"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	if msg := expect(t, b, relay.CANDIDATE); msg.Nonce != 1 {
+		t.Errorf("got nonce %v, expected 1", msg.Nonce)
+	}
+
+	if err := s.Disconnect(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages to an offline peer are still acknowledged, but go nowhere.
+	if _, err := a.Candidate(b.ID, "lost"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+
+	b = connect(t, s, 2)
+	if _, err := a.Candidate(b.ID, "second"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+
+	// A new connection starts counting nonces afresh.
+	msg := expect(t, b, relay.CANDIDATE)
+	var payload relay.OutgoingCandidatePayload
+	if err := msg.Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if msg.Nonce != 1 || payload.Candidate != "second" {
+		t.Errorf("got %v with nonce %v after reconnecting", payload.Candidate, msg.Nonce)
+	}
+}
+
+func TestReconnectReplacesConnection(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, stale := connect(t, s, 1), connect(t, s, 2)
+	fresh := connect(t, s, 2)
+
+	// Dropping the stale connection must not unregister the fresh one.
+	if err := s.Disconnect(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Candidate(fresh.ID, "still here"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	expect(t, fresh, relay.CANDIDATE)
+}
+
+func TestPresence(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, b := connect(t, s, 1), connect(t, s, 2)
+	establish(t, a, b)
+	// Acknowledgements count as activity, so keep b completely silent from
+	// here on.
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	b.SetAutoAck(false)
+
+	var payload relay.OutgoingOnlinePeersPayload
+	s.Clock.Advance(relay.PresenceInterval)
+	if err := expect(t, a, relay.ONLINEPEERS).Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if len(payload.OnlinePeers) != 1 || payload.OnlinePeers[0] != b.ID {
+		t.Errorf("got online peers %v, expected [%v]", payload.OnlinePeers, b.ID)
+	}
+	expect(t, b, relay.ONLINEPEERS)
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// By the next round b has been silent for longer than the presence
+	// timeout, while a has not.
+	s.Clock.Advance(relay.PresenceInterval)
+	if err := expect(t, a, relay.ONLINEPEERS).Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if len(payload.OnlinePeers) != 0 {
+		t.Errorf("got online peers %v, expected none", payload.OnlinePeers)
+	}
+	if err := expect(t, b, relay.ONLINEPEERS).Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if len(payload.OnlinePeers) != 1 || payload.OnlinePeers[0] != a.ID {
+		t.Errorf("got online peers %v, expected [%v]", payload.OnlinePeers, a.ID)
+	}
+}
+
+func TestAckTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, b := connect(t, s, 1), connect(t, s, 2)
+	b.SetAutoAck(false)
+
+	if _, err := a.Candidate(b.ID, "unacked"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	unacked := expect(t, b, relay.CANDIDATE)
+
+	if _, err := a.Candidate(b.ID, "acked"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, a, relay.ACK)
+	acked := expect(t, b, relay.CANDIDATE)
+	if err := b.Ack(acked.Nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Clock.Advance(relay.AckTimeout - time.Second)
+	if timeouts := s.AckTimeouts(); len(timeouts) != 0 {
+		t.Errorf("got early timeouts %v", timeouts)
+	}
+
+	s.Clock.Advance(time.Second)
+	timeouts := s.AckTimeouts()
+	if len(timeouts) == 0 || timeouts[0] != (AckTimeout{AccountID: b.ID, Nonce: unacked.Nonce}) {
+		t.Errorf("got timeouts %v, expected nonce %v of account %v first", timeouts, unacked.Nonce, b.ID)
+	}
+	for _, timeout := range timeouts {
+		if timeout.AccountID == b.ID && timeout.Nonce == acked.Nonce {
+			t.Errorf("acknowledged nonce %v timed out", acked.Nonce)
+		}
+	}
+}
+
+func TestPollingPeers(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a := connect(t, s, 1)
+	b, err := s.ConnectPolling(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.ConnectPolling(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	establish(t, a, b)
+	establish(t, c, b)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		if _, err := a.Candidate(c.ID, i); err != nil {
+			t.Fatal(err)
+		}
+		expect(t, a, relay.ACK)
+	}
+	for i := 0; i < count; i++ {
+		var payload relay.OutgoingCandidatePayload
+		if err := expect(t, c, relay.CANDIDATE).Decode(&payload); err != nil {
+			t.Fatal(err)
+		} else if payload.FromID != a.ID || int(payload.Candidate.(float64)) != i {
+			t.Errorf("got candidate %v from %v, expected %v from %v", payload.Candidate, payload.FromID, i, a.ID)
+		}
+	}
+
+	if _, err := b.Info(a.ID, "over polling"); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, b, relay.ACK)
+	if msg := expect(t, a, relay.INFO); msg.FromID() != b.ID {
+		t.Errorf("info relayed from %v, expected %v", msg.FromID(), b.ID)
+	}
+}
+
+func TestPollingIdleTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	b, err := s.ConnectPolling(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop polling, and keep advancing the clock until the relay notices. The
+	// idle timer is only armed once the last poll has unwound.
+	b.conn.close()
+	if _, ok := s.Pool.Conn(b.ID); !ok {
+		t.Error("relay dropped a polling peer before it went idle")
+	}
+	deadline := time.Now().Add(Timeout)
+	for {
+		if _, ok := s.Pool.Conn(b.ID); !ok {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("relay never dropped an idle polling peer")
+		}
+		s.Clock.Advance(relay.PollIdleTimeout)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	a, b, c := connect(t, s, 1), connect(t, s, 2), connect(t, s, 3)
+
+	establish(t, a, b)
+
+	s.Pool.SendProfile(a.ID, "Alexander", "the Great")
+	var payload relay.OutgoingProfilePayload
+	if err := expect(t, b, relay.PROFILE).Decode(&payload); err != nil {
+		t.Fatal(err)
+	} else if payload.AccountID != a.ID || payload.FirstName != "Alexander" || payload.LastName != "the Great" {
+		t.Errorf("bad profile sent: %+v", payload)
+	}
+
+	// Peers that never talked to a don't hear about it.
+	if err := c.ExpectNothing(50 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries text frames between the relay and a client, whatever the
+// client is connected with.
+type Transport interface {
+	// ReadMessage blocks until the next frame from the client arrives. An
+	// empty frame carries nothing and should be skipped.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends a frame to the client.
+	WriteMessage(p []byte) error
+	// Close closes the transport, unblocking any pending ReadMessage.
+	Close() error
+}
+
+// heartbeatTransport is implemented by transports that see keepalives which
+// never surface as frames.
+type heartbeatTransport interface {
+	OnHeartbeat(f func())
+}
+
+// pingTransport is implemented by transports with a native ping.
+type pingTransport interface {
+	Ping() error
+}
+
+// WebsocketTransport is a Transport over a websocket connection.
+type WebsocketTransport struct {
+	conn *websocket.Conn
+}
+
+// NewWebsocketTransport wraps a websocket connection.
+func NewWebsocketTransport(wsConn *websocket.Conn) *WebsocketTransport {
+	return &WebsocketTransport{conn: wsConn}
+}
+
+// ReadMessage reads the next text frame. Frames of any other kind come back
+// empty.
+func (t *WebsocketTransport) ReadMessage() ([]byte, error) {
+	messageType, p, err := t.conn.ReadMessage()
+	if err != nil {
+		return []byte{}, err
+	} else if messageType != websocket.TextMessage {
+		return []byte{}, nil
+	}
+
+	return p, nil
+}
+
+// WriteMessage writes a text frame.
+func (t *WebsocketTransport) WriteMessage(p []byte) error {
+	return t.conn.WriteMessage(websocket.TextMessage, p)
+}
+
+// Close sends a close frame and closes the connection.
+func (t *WebsocketTransport) Close() error {
+	t.conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(1*time.Second))
+	return t.conn.Close()
+}
+
+// OnHeartbeat calls f whenever the client answers a ping.
+func (t *WebsocketTransport) OnHeartbeat(f func()) {
+	t.conn.SetPongHandler(func(appData string) error {
+		f()
+		return nil
+	})
+}
+
+// Ping sends a websocket ping.
+func (t *WebsocketTransport) Ping() error {
+	return t.conn.WriteMessage(websocket.PingMessage, []byte{})
+}
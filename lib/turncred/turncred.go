@@ -0,0 +1,163 @@
+// Package turncred mints and checks time-limited TURN credentials, as
+// understood by coturn's use-auth-secret and the TURN REST API: the username
+// is the expiry as a Unix timestamp, optionally followed by a colon and a user
+// id, and the password is the base64 HMAC-SHA1 of the username keyed with a
+// secret shared with the TURN server.
+//
+// Secrets can be rotated: each version has a key id, such as "v2", which
+// credentials signed with it carry between the expiry and the user id so the
+// TURN server knows which version to check them against. A version is put on
+// the TURN servers before credentials are signed with it, and taken off once
+// the credentials signed with it have expired.
+package turncred
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadUsername is returned for usernames that don't start with an expiry.
+var ErrBadUsername = errors.New("turncred: bad username")
+
+// Key is a version of a shared secret.
+type Key struct {
+	// ID names the version in usernames, such as "v2".
+	ID     string
+	Secret string
+	// ActivatesAt is when credentials start being signed with the key, giving
+	// the TURN servers time to learn it first.
+	ActivatesAt time.Time
+	// RetiresAt, if set, is when credentials signed with the key stop
+	// working.
+	RetiresAt time.Time
+}
+
+// Valid reports whether credentials signed with the key work at now.
+func (k Key) Valid(now time.Time) bool {
+	return k.RetiresAt.IsZero() || now.Before(k.RetiresAt)
+}
+
+// Keyring is every version of a shared secret.
+type Keyring []Key
+
+// Current returns the key to sign new credentials with at now: the last
+// activated of the valid keys.
+func (k Keyring) Current(now time.Time) (Key, bool) {
+	var current Key
+	var ok bool
+	for _, key := range k {
+		if key.Valid(now) && !now.Before(key.ActivatesAt) && (!ok || key.ActivatesAt.After(current.ActivatesAt)) {
+			current, ok = key, true
+		}
+	}
+	return current, ok
+}
+
+// Find returns the key with an id, if it's valid at now.
+func (k Keyring) Find(id string, now time.Time) (Key, bool) {
+	for _, key := range k {
+		if key.ID == id && key.Valid(now) {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// ParseKeyring parses a comma-separated list of key ids and secrets, such as
+// "v1=secret,v2=secret", into keys that are active and never retire.
+func ParseKeyring(list string) (Keyring, error) {
+	var keys Keyring
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !IsKeyID(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("turncred: bad key %q", parts[0])
+		}
+		keys = append(keys, Key{ID: parts[0], Secret: parts[1]})
+	}
+	return keys, nil
+}
+
+// KeyID returns the id of a version.
+func KeyID(version int) string {
+	return "v" + strconv.Itoa(version)
+}
+
+// IsKeyID reports whether s is shaped like a key id: "v" and a number.
+func IsKeyID(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	_, err := strconv.ParseUint(s[1:], 10, 32)
+	return err == nil
+}
+
+// New returns a username and password valid until expiresAt. user may be
+// empty.
+func New(secret, user string, expiresAt time.Time) (string, string) {
+	username := strconv.FormatInt(expiresAt.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+
+	return username, Password(secret, username)
+}
+
+// NewWithKey is New, with the key's id put in the username. The credentials
+// expire when the key retires, if that's before expiresAt.
+func NewWithKey(key Key, user string, expiresAt time.Time) (string, string, time.Time) {
+	if !key.RetiresAt.IsZero() && key.RetiresAt.Before(expiresAt) {
+		expiresAt = key.RetiresAt
+	}
+
+	id := key.ID
+	if user != "" {
+		id += ":" + user
+	}
+
+	username, password := New(key.Secret, id, expiresAt)
+	return username, password, expiresAt
+}
+
+// Password returns the password for username.
+func Password(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Parse splits a username into its expiry and user id, leaving out the key
+// id, if any.
+func Parse(username string) (time.Time, string, error) {
+	expiry, _, user, err := ParseWithKey(username)
+	return expiry, user, err
+}
+
+// ParseWithKey splits a username into its expiry, key id and user id. The key
+// id is empty for credentials signed with an unversioned secret.
+func ParseWithKey(username string) (time.Time, string, string, error) {
+	parts := strings.SplitN(username, ":", 3)
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", "", ErrBadUsername
+	}
+
+	var id, user string
+	if len(parts) > 1 && IsKeyID(parts[1]) {
+		id, parts = parts[1], parts[1:]
+	}
+	if len(parts) > 1 {
+		user = strings.Join(parts[1:], ":")
+	}
+
+	return time.Unix(expiry, 0), id, user, nil
+}
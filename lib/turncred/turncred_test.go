@@ -0,0 +1,126 @@
+package turncred
+
+import (
+	"testing"
+	"time"
+
+	pTurn "github.com/pion/turn/v2"
+)
+
+func TestNew(t *testing.T) {
+	expiresAt := time.Unix(1600000000, 0)
+
+	username, password := New("secretkey", "", expiresAt)
+	if username != "1600000000" {
+		t.Errorf("got username %q", username)
+	}
+	// Must match what pion and coturn compute for the same username.
+	pionUsername, pionPassword, err := pTurn.GenerateLongTermCredentials("secretkey", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Password("secretkey", pionUsername) != pionPassword {
+		t.Error("password differs from pion's")
+	}
+	if password != Password("secretkey", username) {
+		t.Errorf("got password %q", password)
+	}
+
+	username, _ = New("secretkey", "42", expiresAt)
+	if username != "1600000000:42" {
+		t.Errorf("got username %q", username)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if expiry, user, err := Parse("1600000000:42"); err != nil || expiry.Unix() != 1600000000 || user != "42" {
+		t.Errorf("got %v %q %v", expiry, user, err)
+	}
+	if expiry, user, err := Parse("1600000000"); err != nil || expiry.Unix() != 1600000000 || user != "" {
+		t.Errorf("got %v %q %v", expiry, user, err)
+	}
+	if _, _, err := Parse("alice"); err != ErrBadUsername {
+		t.Errorf("accepted a username without an expiry: %v", err)
+	}
+}
+
+func TestParseWithKey(t *testing.T) {
+	for username, expected := range map[string][2]string{
+		"1600000000:v2:42":   {"v2", "42"},
+		"1600000000:v2":      {"v2", ""},
+		"1600000000:42":      {"", "42"},
+		"1600000000:v2:a:b":  {"v2", "a:b"},
+		"1600000000:alice:b": {"", "alice:b"},
+	} {
+		expiry, id, user, err := ParseWithKey(username)
+		if err != nil || expiry.Unix() != 1600000000 || id != expected[0] || user != expected[1] {
+			t.Errorf("%v: got %v %q %q %v", username, expiry, id, user, err)
+		}
+	}
+
+	if _, user, err := Parse("1600000000:v2:42"); err != nil || user != "42" {
+		t.Errorf("got %q %v", user, err)
+	}
+}
+
+func TestNewWithKey(t *testing.T) {
+	key := Key{ID: "v2", Secret: "secretkey", RetiresAt: time.Unix(1600000000, 0)}
+
+	username, password, expiresAt := NewWithKey(key, "42", time.Unix(1500000000, 0))
+	if username != "1500000000:v2:42" || password != Password("secretkey", username) || expiresAt.Unix() != 1500000000 {
+		t.Errorf("got %q %q %v", username, password, expiresAt)
+	}
+
+	// Credentials don't outlive their key.
+	username, _, expiresAt = NewWithKey(key, "", time.Unix(1700000000, 0))
+	if username != "1600000000:v2" || expiresAt.Unix() != 1600000000 {
+		t.Errorf("got %q %v", username, expiresAt)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	keys := Keyring{
+		{ID: "v1", Secret: "a", ActivatesAt: now.Add(-48 * time.Hour), RetiresAt: now.Add(time.Hour)},
+		{ID: "v2", Secret: "b", ActivatesAt: now.Add(-time.Hour)},
+		{ID: "v3", Secret: "c", ActivatesAt: now.Add(time.Hour)},
+		{ID: "v0", Secret: "d", ActivatesAt: now.Add(-72 * time.Hour), RetiresAt: now.Add(-time.Hour)},
+	}
+
+	// v3 isn't active yet, but the TURN servers already accept it.
+	if key, ok := keys.Current(now); !ok || key.ID != "v2" {
+		t.Errorf("got %v, %v", key.ID, ok)
+	}
+	if _, ok := keys.Find("v3", now); !ok {
+		t.Error("didn't find a pending key")
+	}
+	if _, ok := keys.Find("v0", now); ok {
+		t.Error("found a retired key")
+	}
+
+	// Once v3 activates it takes over, and v1 is still accepted until it
+	// retires.
+	if key, ok := keys.Current(now.Add(2 * time.Hour)); !ok || key.ID != "v3" {
+		t.Errorf("got %v, %v", key.ID, ok)
+	}
+	if _, ok := keys.Find("v1", now.Add(2*time.Hour)); ok {
+		t.Error("found a retired key")
+	}
+
+	if _, ok := (Keyring{}).Current(now); ok {
+		t.Error("empty keyring has a current key")
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	keys, err := ParseKeyring("v1=a, v2=b")
+	if err != nil || len(keys) != 2 || keys[0].ID != "v1" || keys[0].Secret != "a" || keys[1].ID != "v2" || keys[1].Secret != "b" {
+		t.Errorf("got %+v, %v", keys, err)
+	}
+	if _, err := ParseKeyring("first=a"); err == nil {
+		t.Error("accepted a bad key id")
+	}
+	if _, err := ParseKeyring("v1="); err == nil {
+		t.Error("accepted an empty secret")
+	}
+}
@@ -0,0 +1,232 @@
+// Package turnserver runs a TURN/STUN server in-process, for small
+// deployments and local development that don't want an external TURN fleet.
+// It accepts the same time-limited credentials the api hands out, with or
+// without a key id and a user id after the expiry, and can report what each
+// allocation relayed.
+package turnserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/lib/turncred"
+
+	pTurn "github.com/pion/turn/v2"
+)
+
+// DefaultRealm is the realm used when none is configured.
+const DefaultRealm = "airtap.dev"
+
+// Config configures a TURN server.
+type Config struct {
+	// UDPAddrs and TCPAddrs are the addresses to listen on, such as
+	// "0.0.0.0:3478". At least one is required.
+	UDPAddrs []string
+	TCPAddrs []string
+	// RelayIP is the public IP address relayed candidates are advertised
+	// with.
+	RelayIP net.IP
+	// RelayBindAddress is the local address relays are bound to. Defaults to
+	// "0.0.0.0".
+	RelayBindAddress string
+	// MinPort and MaxPort, if set, limit the ports relays are allocated on.
+	MinPort uint16
+	MaxPort uint16
+	// Realm defaults to DefaultRealm.
+	Realm string
+	// Secret is the shared secret credentials without a key id are signed
+	// with.
+	Secret string
+	// Keys, if set, returns the versions of the shared secret credentials
+	// with a key id may be signed with. It's called for every allocation, so
+	// versions can be added and retired while the server runs.
+	Keys func() turncred.Keyring
+	// ReportUsage, if set, is called with what allocations relayed, once a
+	// minute for the ones that went idle and for all of them when the server
+	// closes. A report that fails is retried with the same reportID, so it can
+	// be counted only once.
+	ReportUsage func(reportID string, usage []Usage) error
+}
+
+// Server is a running TURN server.
+type Server struct {
+	turn  *pTurn.Server
+	usage *usageTracker
+}
+
+// Close stops serving, then reports what was left to.
+func (s *Server) Close() error {
+	err := s.turn.Close()
+	if s.usage != nil {
+		s.usage.close()
+	}
+	return err
+}
+
+// ParseAddrs splits a comma-separated list of addresses.
+func ParseAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// ParsePortRange parses a port range such as "49152-65535". An empty string
+// means any port.
+func ParsePortRange(portRange string) (uint16, uint16, error) {
+	if portRange == "" {
+		return 0, 0, nil
+	}
+
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("turnserver: bad port range %q", portRange)
+	}
+
+	min, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+	if err != nil {
+		return 0, 0, err
+	} else if min == 0 || min > max {
+		return 0, 0, fmt.Errorf("turnserver: bad port range %q", portRange)
+	}
+
+	return uint16(min), uint16(max), nil
+}
+
+func (c Config) relayAddressGenerator() pTurn.RelayAddressGenerator {
+	bindAddress := c.RelayBindAddress
+	if bindAddress == "" {
+		bindAddress = "0.0.0.0"
+	}
+
+	if c.MinPort != 0 {
+		return &pTurn.RelayAddressGeneratorPortRange{
+			RelayAddress: c.RelayIP,
+			Address:      bindAddress,
+			MinPort:      c.MinPort,
+			MaxPort:      c.MaxPort,
+		}
+	}
+
+	return &pTurn.RelayAddressGeneratorStatic{
+		RelayAddress: c.RelayIP,
+		Address:      bindAddress,
+	}
+}
+
+func authHandler(secret string, keys func() turncred.Keyring, usage *usageTracker) pTurn.AuthHandler {
+	return func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+		now := time.Now()
+		expiresAt, id, _, err := turncred.ParseWithKey(username)
+		if err != nil || now.After(expiresAt) {
+			return nil, false
+		}
+
+		key := turncred.Key{Secret: secret}
+		if id != "" {
+			if keys == nil {
+				return nil, false
+			}
+			var ok bool
+			if key, ok = keys().Find(id, now); !ok {
+				return nil, false
+			}
+		} else if secret == "" {
+			return nil, false
+		}
+
+		if usage != nil {
+			usage.auth(srcAddr, username)
+		}
+		return pTurn.GenerateAuthKey(username, realm, turncred.Password(key.Secret, username)), true
+	}
+}
+
+// Start starts listening and serving. Close the returned server to stop.
+func Start(c Config) (*Server, error) {
+	if len(c.UDPAddrs) == 0 && len(c.TCPAddrs) == 0 {
+		return nil, errors.New("turnserver: no listen addresses")
+	} else if c.RelayIP == nil {
+		return nil, errors.New("turnserver: no relay IP")
+	} else if c.Secret == "" && c.Keys == nil {
+		return nil, errors.New("turnserver: no secret")
+	}
+
+	realm := c.Realm
+	if realm == "" {
+		realm = DefaultRealm
+	}
+
+	var usage *usageTracker
+	if c.ReportUsage != nil {
+		usage = newUsageTracker(c.ReportUsage, time.Now)
+	}
+
+	serverConfig := pTurn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: authHandler(c.Secret, c.Keys, usage),
+	}
+
+	// Close whatever has been opened if a later listener fails.
+	var opened []interface{ Close() error }
+	fail := func(err error) (*Server, error) {
+		for _, l := range opened {
+			l.Close()
+		}
+		return nil, err
+	}
+
+	for _, addr := range c.UDPAddrs {
+		conn, err := net.ListenPacket("udp4", addr)
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, conn)
+		if usage != nil {
+			conn = countingPacketConn{conn, usage}
+		}
+		serverConfig.PacketConnConfigs = append(serverConfig.PacketConnConfigs, pTurn.PacketConnConfig{
+			PacketConn:            conn,
+			RelayAddressGenerator: c.relayAddressGenerator(),
+		})
+	}
+
+	for _, addr := range c.TCPAddrs {
+		listener, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return fail(err)
+		}
+		opened = append(opened, listener)
+		if usage != nil {
+			listener = countingListener{listener, usage}
+		}
+		serverConfig.ListenerConfigs = append(serverConfig.ListenerConfigs, pTurn.ListenerConfig{
+			Listener:              listener,
+			RelayAddressGenerator: c.relayAddressGenerator(),
+		})
+	}
+
+	server, err := pTurn.NewServer(serverConfig)
+	if err != nil {
+		return fail(err)
+	}
+
+	if usage != nil {
+		go usage.run()
+	}
+
+	log.Printf("TURN server listening on UDP %v and TCP %v, relaying from %v", c.UDPAddrs, c.TCPAddrs, c.RelayIP)
+	return &Server{turn: server, usage: usage}, nil
+}
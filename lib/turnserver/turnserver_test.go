@@ -0,0 +1,196 @@
+package turnserver
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"server/lib/turncred"
+
+	pTurn "github.com/pion/turn/v2"
+)
+
+func freeUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func allocate(t *testing.T, addr, username, password string) error {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := pTurn.NewClient(&pTurn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          DefaultRealm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	relayConn, err := client.Allocate()
+	if err != nil {
+		return err
+	}
+	return relayConn.Close()
+}
+
+func TestStart(t *testing.T) {
+	addr := freeUDPAddr(t)
+	server, err := Start(Config{
+		UDPAddrs: []string{addr},
+		RelayIP:  net.ParseIP("127.0.0.1"),
+		Secret:   "secretkey",
+		Keys: func() turncred.Keyring {
+			return turncred.Keyring{
+				{ID: "v1", Secret: "oldkey", RetiresAt: time.Now().Add(-time.Minute)},
+				{ID: "v2", Secret: "newkey"},
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	username, password, err := pTurn.GenerateLongTermCredentials("secretkey", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := allocate(t, addr, username, password); err != nil {
+		t.Errorf("allocation with valid credentials failed: %v", err)
+	}
+
+	username, password = turncred.New("secretkey", "42", time.Now().Add(time.Hour))
+	if err := allocate(t, addr, username, password); err != nil {
+		t.Errorf("allocation with a user id in the username failed: %v", err)
+	}
+
+	username, password = turncred.New("secretkey", "", time.Now().Add(-time.Minute))
+	if err := allocate(t, addr, username, password); err == nil {
+		t.Error("allocation with expired credentials succeeded")
+	}
+
+	username, password, _ = turncred.NewWithKey(turncred.Key{ID: "v2", Secret: "newkey"}, "42", time.Now().Add(time.Hour))
+	if err := allocate(t, addr, username, password); err != nil {
+		t.Errorf("allocation with credentials signed by the current key failed: %v", err)
+	}
+
+	username, password, _ = turncred.NewWithKey(turncred.Key{ID: "v1", Secret: "oldkey"}, "42", time.Now().Add(time.Hour))
+	if err := allocate(t, addr, username, password); err == nil {
+		t.Error("allocation with credentials signed by a retired key succeeded")
+	}
+
+	username, password, _ = turncred.NewWithKey(turncred.Key{ID: "v3", Secret: "newkey"}, "", time.Now().Add(time.Hour))
+	if err := allocate(t, addr, username, password); err == nil {
+		t.Error("allocation with credentials signed by an unknown key succeeded")
+	}
+
+	username, password, err = pTurn.GenerateLongTermCredentials("wrongkey", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := allocate(t, addr, username, password); err == nil {
+		t.Error("allocation with credentials signed by another secret succeeded")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	if min, max, err := ParsePortRange("49152-65535"); err != nil || min != 49152 || max != 65535 {
+		t.Errorf("got %v-%v, %v", min, max, err)
+	}
+	if min, max, err := ParsePortRange(""); err != nil || min != 0 || max != 0 {
+		t.Errorf("got %v-%v, %v", min, max, err)
+	}
+	if _, _, err := ParsePortRange("65535-49152"); err == nil {
+		t.Error("accepted an inverted range")
+	}
+}
+
+func TestReportUsage(t *testing.T) {
+	var mutex sync.Mutex
+	var reported []Usage
+	addr := freeUDPAddr(t)
+	server, err := Start(Config{
+		UDPAddrs: []string{addr},
+		RelayIP:  net.ParseIP("127.0.0.1"),
+		Secret:   "secretkey",
+		ReportUsage: func(reportID string, usage []Usage) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			reported = append(reported, usage...)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	username, password := turncred.New("secretkey", "42", time.Now().Add(time.Hour))
+	if err := allocate(t, addr, username, password); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing reports what's left.
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(reported) != 1 || reported[0].Username != username || reported[0].Bytes == 0 {
+		t.Errorf("got %+v", reported)
+	}
+}
+
+func TestUsageRetry(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var ids []string
+	fail := true
+	u := newUsageTracker(func(reportID string, usage []Usage) error {
+		ids = append(ids, reportID)
+		if fail {
+			return errors.New("unavailable")
+		}
+		return nil
+	}, func() time.Time { return now })
+
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	u.auth(addr, "user")
+	now = now.Add(time.Minute)
+	u.count(addr, 100)
+
+	// Allocations aren't reported until they go idle.
+	u.flush(false)
+	if len(ids) != 0 {
+		t.Fatalf("reported an active allocation")
+	}
+
+	now = now.Add(usageIdleTimeout)
+	u.flush(false)
+	fail = false
+	u.flush(false)
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Errorf("retried with different ids: %v", ids)
+	}
+	u.flush(false)
+	if len(ids) != 2 {
+		t.Errorf("reported twice: %v", ids)
+	}
+}
@@ -0,0 +1,232 @@
+package turnserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Usage is what one allocation relayed, by the username it was made with.
+type Usage struct {
+	Username string `json:"username"`
+	Bytes    int64  `json:"bytes"`
+	Seconds  int64  `json:"seconds"`
+}
+
+const (
+	// usageReportInterval is how often finished allocations are reported.
+	usageReportInterval = time.Minute
+	// usageIdleTimeout is how long a client can go without sending or
+	// receiving anything before its allocation counts as finished. Clients
+	// refresh allocations well within it.
+	usageIdleTimeout = 5 * time.Minute
+	// maxPendingUsageReports is how many failed reports are kept for
+	// retrying. Past it, the oldest are dropped.
+	maxPendingUsageReports = 100
+	// maxUsageReportSize is how many allocations the api takes in a report.
+	maxUsageReportSize = 1000
+)
+
+type allocationUsage struct {
+	username    string
+	bytes       int64
+	first, last time.Time
+}
+
+type usageReport struct {
+	id    string
+	usage []Usage
+}
+
+// usageTracker counts what every client address sends and receives, under the
+// username it last authenticated with, and reports it once the client goes
+// idle.
+type usageTracker struct {
+	mutex       sync.Mutex
+	allocations map[string]*allocationUsage
+	finished    []Usage
+	pending     []usageReport
+
+	report func(reportID string, usage []Usage) error
+	now    func() time.Time
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newUsageTracker(report func(string, []Usage) error, now func() time.Time) *usageTracker {
+	return &usageTracker{
+		allocations: make(map[string]*allocationUsage),
+		report:      report,
+		now:         now,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func addrKey(addr net.Addr) string {
+	return addr.Network() + ":" + addr.String()
+}
+
+func (a *allocationUsage) usage() Usage {
+	return Usage{
+		Username: a.username,
+		Bytes:    a.bytes,
+		Seconds:  int64((a.last.Sub(a.first) + time.Second - 1) / time.Second),
+	}
+}
+
+// auth starts counting for an address, unless it's already counted under the
+// same username.
+func (u *usageTracker) auth(addr net.Addr, username string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	key, now := addrKey(addr), u.now()
+	if a, ok := u.allocations[key]; ok {
+		if a.username == username {
+			return
+		}
+		u.finished = append(u.finished, a.usage())
+	}
+	u.allocations[key] = &allocationUsage{username: username, first: now, last: now}
+}
+
+// count adds bytes sent to or received from an address, if it authenticated.
+func (u *usageTracker) count(addr net.Addr, n int) {
+	if n <= 0 || addr == nil {
+		return
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if a, ok := u.allocations[addrKey(addr)]; ok {
+		a.bytes += int64(n)
+		a.last = u.now()
+	}
+}
+
+// flush reports idle allocations, or every one if all is set, and retries
+// reports that failed before.
+func (u *usageTracker) flush(all bool) {
+	u.mutex.Lock()
+	now := u.now()
+	usage := u.finished
+	u.finished = nil
+	for key, a := range u.allocations {
+		if all || now.Sub(a.last) >= usageIdleTimeout {
+			usage = append(usage, a.usage())
+			delete(u.allocations, key)
+		}
+	}
+	for len(usage) > 0 {
+		n := len(usage)
+		if n > maxUsageReportSize {
+			n = maxUsageReportSize
+		}
+		u.pending = append(u.pending, usageReport{id: newReportID(), usage: usage[:n]})
+		usage = usage[n:]
+	}
+	if dropped := len(u.pending) - maxPendingUsageReports; dropped > 0 {
+		log.Printf("Dropping %v TURN usage reports that couldn't be sent", dropped)
+		u.pending = u.pending[dropped:]
+	}
+	pending := u.pending
+	u.pending = nil
+	u.mutex.Unlock()
+
+	// Stop at the first failure, and keep the rest for next time with the
+	// same ids, so a report that did arrive isn't counted twice.
+	for i, r := range pending {
+		if err := u.report(r.id, r.usage); err != nil {
+			log.Printf("Failed to report TURN usage: %v", err)
+			u.mutex.Lock()
+			u.pending = append(pending[i:], u.pending...)
+			u.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (u *usageTracker) run() {
+	defer close(u.done)
+
+	ticker := time.NewTicker(usageReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.flush(false)
+		case <-u.stop:
+			u.flush(true)
+			return
+		}
+	}
+}
+
+// close reports everything left.
+func (u *usageTracker) close() {
+	close(u.stop)
+	<-u.done
+}
+
+func newReportID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// countingPacketConn counts what a UDP listener sends and receives.
+type countingPacketConn struct {
+	net.PacketConn
+	usage *usageTracker
+}
+
+func (c countingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.usage.count(addr, n)
+	return n, addr, err
+}
+
+func (c countingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.usage.count(addr, n)
+	return n, err
+}
+
+// countingListener counts what the connections a TCP listener accepts send
+// and receive.
+type countingListener struct {
+	net.Listener
+	usage *usageTracker
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	return countingConn{conn, l.usage}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	usage *usageTracker
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.usage.count(c.RemoteAddr(), n)
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.usage.count(c.RemoteAddr(), n)
+	return n, err
+}
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS public.public_keys (
+    account_id bigint NOT NULL,
+    device_id character varying(64) NOT NULL,
+    public_key character(44) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (account_id, device_id),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.public_keys FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
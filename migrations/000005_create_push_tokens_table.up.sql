@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS public.push_tokens (
+    token character varying(256) NOT NULL,
+    account_id bigint NOT NULL,
+    platform character varying(8) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (token),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS push_tokens_account_id_idx ON public.push_tokens (account_id);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.push_tokens FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.turn_servers;
+DROP TABLE IF EXISTS public.turn_regions;
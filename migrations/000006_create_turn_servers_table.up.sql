@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS public.turn_regions (
+    id character varying(32) NOT NULL,
+    continents character(2)[] NOT NULL DEFAULT '{}',
+    is_default boolean NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (id)
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.turn_regions FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
+
+CREATE TABLE IF NOT EXISTS public.turn_servers (
+    id character varying(64) NOT NULL,
+    urls text[] NOT NULL,
+    transports character varying(8)[] NOT NULL DEFAULT '{udp,tcp}',
+    region character varying(32) NOT NULL,
+    secret_env character varying(64) NOT NULL,
+    weight integer NOT NULL DEFAULT 1 CHECK (weight >= 0),
+    enabled boolean NOT NULL DEFAULT true,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (id),
+    CONSTRAINT fk_region
+        FOREIGN KEY(region)
+            REFERENCES turn_regions(id)
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.turn_servers FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
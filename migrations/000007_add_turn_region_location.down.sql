@@ -0,0 +1,3 @@
+ALTER TABLE public.turn_regions
+    DROP COLUMN IF EXISTS latitude,
+    DROP COLUMN IF EXISTS longitude;
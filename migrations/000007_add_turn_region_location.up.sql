@@ -0,0 +1,3 @@
+ALTER TABLE public.turn_regions
+    ADD COLUMN IF NOT EXISTS latitude double precision NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS longitude double precision NOT NULL DEFAULT 0;
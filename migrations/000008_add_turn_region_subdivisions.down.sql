@@ -0,0 +1 @@
+ALTER TABLE public.turn_regions DROP COLUMN IF EXISTS subdivisions;
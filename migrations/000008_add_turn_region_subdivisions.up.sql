@@ -0,0 +1 @@
+ALTER TABLE public.turn_regions ADD COLUMN IF NOT EXISTS subdivisions character varying(6)[] NOT NULL DEFAULT '{}';
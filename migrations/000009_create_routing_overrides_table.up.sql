@@ -0,0 +1,30 @@
+CREATE TABLE IF NOT EXISTS public.routing_overrides (
+    id bigserial NOT NULL,
+    country_code character(2),
+    account_id bigint,
+    license_id bigint,
+    region character varying(32) NOT NULL,
+    note text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (id),
+    CONSTRAINT one_match CHECK (num_nonnulls(country_code, account_id, license_id) = 1),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE,
+    CONSTRAINT fk_license
+        FOREIGN KEY(license_id)
+            REFERENCES license_keys(id)
+            ON DELETE CASCADE,
+    CONSTRAINT fk_region
+        FOREIGN KEY(region)
+            REFERENCES turn_regions(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS routing_overrides_country_code_idx ON public.routing_overrides (country_code);
+CREATE UNIQUE INDEX IF NOT EXISTS routing_overrides_account_id_idx ON public.routing_overrides (account_id);
+CREATE UNIQUE INDEX IF NOT EXISTS routing_overrides_license_id_idx ON public.routing_overrides (license_id);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.routing_overrides FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
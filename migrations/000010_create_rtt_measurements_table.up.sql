@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS public.rtt_measurements (
+    account_id bigint NOT NULL,
+    network character varying(64) NOT NULL,
+    region character varying(32) NOT NULL,
+    rtt_ms integer NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (account_id, network, region),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.rtt_measurements FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
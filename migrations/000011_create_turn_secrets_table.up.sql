@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS public.turn_secrets (
+    secret_env character varying(64) NOT NULL,
+    version integer NOT NULL CHECK (version > 0),
+    secret character varying(128) NOT NULL,
+    activates_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    retires_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (secret_env, version)
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.turn_secrets FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.turn_usage;
+
+ALTER TABLE public.license_keys DROP COLUMN IF EXISTS turn_quota_seconds;
+ALTER TABLE public.license_keys DROP COLUMN IF EXISTS turn_quota_bytes;
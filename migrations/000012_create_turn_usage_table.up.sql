@@ -0,0 +1,20 @@
+ALTER TABLE public.license_keys ADD COLUMN IF NOT EXISTS turn_quota_bytes bigint CHECK (turn_quota_bytes >= 0);
+ALTER TABLE public.license_keys ADD COLUMN IF NOT EXISTS turn_quota_seconds bigint CHECK (turn_quota_seconds >= 0);
+
+CREATE TABLE IF NOT EXISTS public.turn_usage (
+    account_id bigint NOT NULL,
+    month date NOT NULL,
+    bytes bigint NOT NULL DEFAULT 0,
+    seconds bigint NOT NULL DEFAULT 0,
+    allocations integer NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (account_id, month),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.turn_usage FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1,4 @@
+-- Hashed tokens can't be turned back into tokens, so accounts that only have
+-- a hash can't sign in after this.
+ALTER TABLE public.accounts DROP CONSTRAINT IF EXISTS token_or_hash;
+ALTER TABLE public.accounts DROP COLUMN IF EXISTS token_hash;
@@ -0,0 +1,3 @@
+ALTER TABLE public.accounts ADD COLUMN IF NOT EXISTS token_hash character(64);
+ALTER TABLE public.accounts ALTER COLUMN token DROP NOT NULL;
+ALTER TABLE public.accounts ADD CONSTRAINT token_or_hash CHECK (token IS NOT NULL OR token_hash IS NOT NULL);
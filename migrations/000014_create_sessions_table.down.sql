@@ -0,0 +1,11 @@
+ALTER TABLE public.accounts ADD COLUMN IF NOT EXISTS token_hash character(64);
+
+-- Accounts keep the token of their oldest session.
+UPDATE public.accounts SET token_hash = oldest.token_hash
+    FROM (SELECT DISTINCT ON (account_id) account_id, token_hash FROM public.sessions ORDER BY account_id, created_at, id) AS oldest
+    WHERE accounts.id = oldest.account_id AND accounts.token IS NULL;
+
+-- Accounts that had revoked every session stay signed out.
+ALTER TABLE public.accounts ADD CONSTRAINT token_or_hash CHECK (token IS NOT NULL OR token_hash IS NOT NULL) NOT VALID;
+
+DROP TABLE IF EXISTS public.sessions;
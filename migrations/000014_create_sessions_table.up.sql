@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS public.sessions (
+    id bigserial NOT NULL,
+    account_id bigint NOT NULL,
+    token_hash character(64) NOT NULL UNIQUE,
+    device_name character varying(64) NOT NULL DEFAULT '',
+    ip character varying(45) NOT NULL DEFAULT '',
+    last_used_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (id),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS sessions_account_id_idx ON public.sessions (account_id);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.sessions FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
+
+-- Every hashed account token becomes its account's first session. Tokens still
+-- in the clear become sessions when the api hashes them.
+INSERT INTO public.sessions(account_id, token_hash, created_at, last_used_at)
+    SELECT id, token_hash, created_at, last_updated_at FROM public.accounts WHERE token_hash IS NOT NULL;
+
+ALTER TABLE public.accounts DROP CONSTRAINT IF EXISTS token_or_hash;
+ALTER TABLE public.accounts DROP COLUMN IF EXISTS token_hash;
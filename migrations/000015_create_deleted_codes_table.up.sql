@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS public.deleted_codes (
+    code character(12) NOT NULL,
+    account_id bigint NOT NULL,
+    deleted_by character varying(8) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (code)
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.deleted_codes FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
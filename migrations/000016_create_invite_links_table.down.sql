@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.invite_links;
+ALTER TABLE IF EXISTS public.accounts DROP COLUMN IF EXISTS code_revoked_at;
@@ -0,0 +1,24 @@
+ALTER TABLE IF EXISTS public.accounts ADD COLUMN IF NOT EXISTS code_revoked_at timestamptz;
+
+CREATE TABLE IF NOT EXISTS public.invite_links (
+    id bigserial NOT NULL,
+    account_id bigint NOT NULL,
+    code character(12) NOT NULL UNIQUE,
+    label character varying(64) NOT NULL DEFAULT '',
+    max_uses integer CHECK (max_uses > 0),
+    uses integer NOT NULL DEFAULT 0,
+    expires_at timestamptz,
+    revoked_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (id),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS invite_links_account_id_idx ON public.invite_links (account_id);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.invite_links FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
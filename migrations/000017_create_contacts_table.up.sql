@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS public.contacts (
+    account_id bigint NOT NULL,
+    contact_id bigint NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (account_id, contact_id),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE,
+    CONSTRAINT fk_contact
+        FOREIGN KEY(contact_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS contacts_contact_id_idx ON public.contacts (contact_id);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.contacts FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.pair_choices;
+
+DROP TABLE IF EXISTS public.client_locations;
@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS public.client_locations (
+    account_id bigint PRIMARY KEY,
+    country_code varchar(16) NOT NULL,
+    subdivision varchar(16) NOT NULL DEFAULT '',
+    latitude double precision,
+    longitude double precision,
+    ip varchar(45) NOT NULL DEFAULT '',
+    network varchar(64) NOT NULL DEFAULT '',
+    seen_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.client_locations FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
+
+CREATE TABLE IF NOT EXISTS public.pair_choices (
+    account_id bigint NOT NULL,
+    peer_id bigint NOT NULL,
+    server_ids text[] NOT NULL,
+    chosen_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (account_id, peer_id),
+    CHECK (account_id < peer_id),
+    CONSTRAINT fk_account
+        FOREIGN KEY(account_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE,
+    CONSTRAINT fk_peer
+        FOREIGN KEY(peer_id)
+            REFERENCES accounts(id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS pair_choices_peer_id_idx ON public.pair_choices (peer_id);
+CREATE INDEX IF NOT EXISTS pair_choices_chosen_at_idx ON public.pair_choices (chosen_at);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.pair_choices FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS public.turn_usage_reports (
+    report_id varchar(64) PRIMARY KEY,
+    recorded integer NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS turn_usage_reports_created_at_idx ON public.turn_usage_reports (created_at);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.turn_usage_reports FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.deleted_turn_usage;
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS public.deleted_turn_usage (
+    license_id bigint NOT NULL,
+    month date NOT NULL,
+    bytes bigint NOT NULL DEFAULT 0,
+    seconds bigint NOT NULL DEFAULT 0,
+    allocations integer NOT NULL DEFAULT 0,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    PRIMARY KEY (license_id, month),
+    CONSTRAINT fk_license
+        FOREIGN KEY(license_id)
+            REFERENCES license_keys(id)
+            ON DELETE CASCADE
+);
+
+CREATE TRIGGER update_time BEFORE UPDATE ON public.deleted_turn_usage FOR EACH ROW EXECUTE PROCEDURE set_last_updated_at_column();
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS public.revoked_sessions (
+    session_id bigint PRIMARY KEY,
+    revoked_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS revoked_sessions_revoked_at_idx ON public.revoked_sessions (revoked_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS public.push_tokens_session_id_idx;
+ALTER TABLE public.push_tokens DROP COLUMN IF EXISTS session_id;
@@ -0,0 +1,5 @@
+-- Push tokens belong to the session that registered them, and go with it. Tokens
+-- from before this have none.
+ALTER TABLE public.push_tokens ADD COLUMN IF NOT EXISTS session_id bigint REFERENCES public.sessions(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS push_tokens_session_id_idx ON public.push_tokens (session_id);